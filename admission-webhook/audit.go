@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+)
+
+// These are the keys of the audit annotations recording which GMSA's pods get admitted with; the API server
+// prefixes them with the webhook's name. They're part of the webhook's API, and as such must not be changed.
+// Annotations holding several entries are JSON objects.
+const (
+	// credSpecsAuditAnnotation maps each resource using a GMSA, described as `pod`, `container:<name>`,
+	// `initContainer:<name>` or `ephemeralContainer:<name>`, to the name of its cred spec.
+	credSpecsAuditAnnotation = "credspecs"
+	// credSpecResourceVersionsAuditAnnotation maps cred spec names to the resource versions used.
+	credSpecResourceVersionsAuditAnnotation = "credspec-resource-versions"
+	// credSpecContentHashesAuditAnnotation maps cred spec names to their contents' hashes, see credSpecContentsHash.
+	credSpecContentHashesAuditAnnotation = "credspec-content-hashes"
+	// serviceAccountAuditAnnotation is the service account whose authorization to use the cred specs got checked.
+	serviceAccountAuditAnnotation = "service-account"
+	// credSpecAuthorizationsAuditAnnotation maps cred spec names to `allowed` or `denied`, depending on whether
+	// the service account is authorized to use them.
+	credSpecAuthorizationsAuditAnnotation = "credspec-authorizations"
+	// hostnameAuditAnnotation is the pod's hostname, whether set explicitly or generated.
+	hostnameAuditAnnotation = "hostname"
+)
+
+// auditResourcePrefixes are the prefixes used to describe containers in the credSpecsAuditAnnotation.
+var auditResourcePrefixes = map[gmsaResourceKind]string{
+	containerKind:          "container:",
+	initContainerKind:      "initContainer:",
+	ephemeralContainerKind: "ephemeralContainer:",
+}
+
+// admissionAuditAnnotations collects the audit annotations returned along with the response to an admission
+// request. Like admissionWarnings, it gets threaded through the request's context.
+type admissionAuditAnnotations struct {
+	values  map[string]string
+	entries map[string]map[string]string
+}
+
+type auditAnnotationsContextKey struct{}
+
+// withAuditAnnotations returns a context carrying a new audit annotations collector, along with that collector.
+func withAuditAnnotations(ctx context.Context) (context.Context, *admissionAuditAnnotations) {
+	auditAnnotations := &admissionAuditAnnotations{
+		values:  make(map[string]string),
+		entries: make(map[string]map[string]string),
+	}
+	return context.WithValue(ctx, auditAnnotationsContextKey{}, auditAnnotations), auditAnnotations
+}
+
+// setAuditAnnotation sets a single-valued audit annotation on the context's collector, if any.
+func setAuditAnnotation(ctx context.Context, key, value string) {
+	if collector, _ := ctx.Value(auditAnnotationsContextKey{}).(*admissionAuditAnnotations); collector != nil {
+		collector.values[key] = value
+	}
+}
+
+// setAuditEntry sets an entry of an audit annotation holding a JSON object on the context's collector, if any.
+func setAuditEntry(ctx context.Context, key, entryKey, value string) {
+	if collector, _ := ctx.Value(auditAnnotationsContextKey{}).(*admissionAuditAnnotations); collector != nil {
+		if collector.entries[key] == nil {
+			collector.entries[key] = make(map[string]string)
+		}
+		collector.entries[key][entryKey] = value
+	}
+}
+
+// auditCredSpecUse records that a pod or one of its containers uses the given cred spec.
+func auditCredSpecUse(ctx context.Context, resourceKind gmsaResourceKind, resourceName, credSpecName string) {
+	resource := "pod"
+	if resourceKind != podKind {
+		resource = auditResourcePrefixes[resourceKind] + resourceName
+	}
+	setAuditEntry(ctx, credSpecsAuditAnnotation, resource, credSpecName)
+}
+
+// auditCredSpec records the version and the contents' hash of a cred spec used by the pod.
+func auditCredSpec(ctx context.Context, credSpec *gmsaCredSpec) {
+	setAuditEntry(ctx, credSpecResourceVersionsAuditAnnotation, credSpec.name, credSpec.resourceVersion)
+	setAuditEntry(ctx, credSpecContentHashesAuditAnnotation, credSpec.name, credSpecContentsHash(credSpec.contents))
+}
+
+// auditAuthorization records whether the service account is authorized to use the cred spec.
+func auditAuthorization(ctx context.Context, serviceAccountName, credSpecName string, authorized bool) {
+	result := "denied"
+	if authorized {
+		result = "allowed"
+	}
+	setAuditAnnotation(ctx, serviceAccountAuditAnnotation, serviceAccountName)
+	setAuditEntry(ctx, credSpecAuthorizationsAuditAnnotation, credSpecName, result)
+}
+
+// annotations returns the collected audit annotations.
+func (auditAnnotations *admissionAuditAnnotations) annotations() map[string]string {
+	annotations := make(map[string]string, len(auditAnnotations.values)+len(auditAnnotations.entries))
+	for key, value := range auditAnnotations.values {
+		annotations[key] = value
+	}
+	for key, entries := range auditAnnotations.entries {
+		value, err := json.Marshal(entries)
+		if err != nil {
+			logrus.Errorf("unable to marshall audit annotation %s: %v", key, err)
+			continue
+		}
+		annotations[key] = string(value)
+	}
+	return annotations
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionV1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestValidateOrMutateAuditAnnotations(t *testing.T) {
+	client := &dummyKubeClient{
+		isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (bool, string) {
+			return credSpecName != "other-cred-spec", ""
+		},
+		retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+			return &gmsaCredSpec{name: credSpecName, resourceVersion: "42", contents: dummyCredSpecContents}, http.StatusOK, nil
+		},
+	}
+
+	buildRequest := func(t *testing.T, pod *corev1.Pod) *admissionV1.AdmissionRequest {
+		podJSON, err := json.Marshal(pod)
+		require.Nil(t, err)
+		return &admissionV1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: dummyNamespace,
+			Operation: admissionV1.Create,
+			Object:    runtime.RawExtension{Raw: podJSON},
+		}
+	}
+
+	buildAuditedPod := func() *corev1.Pod {
+		hostname := "my-host"
+		pod := buildPodWithHostName(dummyServiceAccoutName, &hostname, buildWindowsOptions(dummyCredSpecName, ""), map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions(dummyCredSpecName, ""),
+		})
+		pod.Spec.InitContainers = []corev1.Container{{Name: dummyInitContainerName, SecurityContext: &corev1.SecurityContext{WindowsOptions: buildWindowsOptions("other-cred-spec", "")}}}
+		return pod
+	}
+
+	expectedCredSpecs := `{"container:dummy-container-name":"dummy-cred-spec-name","initContainer:dummy-init-container-name":"other-cred-spec","pod":"dummy-cred-spec-name"}`
+	expectedHash := credSpecContentsHash(dummyCredSpecContents)
+
+	t.Run("the mutating endpoint records the cred specs it inlines", func(t *testing.T) {
+		response, err := newWebhook(client).validateOrMutate(context.Background(), buildRequest(t, buildAuditedPod()), mutate)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+
+		assert.Equal(t, map[string]string{
+			credSpecsAuditAnnotation:                expectedCredSpecs,
+			credSpecResourceVersionsAuditAnnotation: `{"dummy-cred-spec-name":"42","other-cred-spec":"42"}`,
+			credSpecContentHashesAuditAnnotation:    `{"dummy-cred-spec-name":"` + expectedHash + `","other-cred-spec":"` + expectedHash + `"}`,
+			hostnameAuditAnnotation:                 "my-host",
+		}, response.AuditAnnotations)
+	})
+
+	t.Run("the validating endpoint also records authorizations", func(t *testing.T) {
+		pod := buildAuditedPod()
+		iterateOverWindowsSecurityOptions(pod, func(windowsOptions *corev1.WindowsSecurityContextOptions, _ gmsaResourceKind, _ string, _ int) *podAdmissionError {
+			contents := dummyCredSpecContents
+			windowsOptions.GMSACredentialSpec = &contents
+			return nil
+		})
+
+		response, err := newWebhookWithOptions(client, WithPolicyMode(AuditPolicyMode)).validateOrMutate(context.Background(), buildRequest(t, pod), validate)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+
+		assert.Equal(t, expectedCredSpecs, response.AuditAnnotations[credSpecsAuditAnnotation])
+		assert.Equal(t, `{"dummy-cred-spec-name":"42","other-cred-spec":"42"}`, response.AuditAnnotations[credSpecResourceVersionsAuditAnnotation])
+		assert.Equal(t, dummyServiceAccoutName, response.AuditAnnotations[serviceAccountAuditAnnotation])
+		assert.Equal(t, `{"dummy-cred-spec-name":"allowed","other-cred-spec":"denied"}`, response.AuditAnnotations[credSpecAuthorizationsAuditAnnotation])
+		assert.Equal(t, "my-host", response.AuditAnnotations[hostnameAuditAnnotation])
+		assert.Contains(t, response.AuditAnnotations[policyViolationsAuditAnnotation], `not authorized to `+"`use`"+` GMSA cred spec "other-cred-spec"`)
+	})
+
+	t.Run("denials also record audit annotations", func(t *testing.T) {
+		pod := buildAuditedPod()
+		iterateOverWindowsSecurityOptions(pod, func(windowsOptions *corev1.WindowsSecurityContextOptions, _ gmsaResourceKind, _ string, _ int) *podAdmissionError {
+			contents := dummyCredSpecContents
+			windowsOptions.GMSACredentialSpec = &contents
+			return nil
+		})
+
+		response, err := newWebhook(client).validateOrMutate(context.Background(), buildRequest(t, pod), validate)
+		assert.Nil(t, response)
+		require.NotNil(t, err)
+		assert.Equal(t, http.StatusForbidden, err.code)
+
+		denial := deniedAdmissionResponse(err)
+		assert.False(t, denial.Allowed)
+		assert.Equal(t, expectedCredSpecs, denial.AuditAnnotations[credSpecsAuditAnnotation])
+		assert.Equal(t, dummyServiceAccoutName, denial.AuditAnnotations[serviceAccountAuditAnnotation])
+		assert.Equal(t, `{"dummy-cred-spec-name":"allowed","other-cred-spec":"denied"}`, denial.AuditAnnotations[credSpecAuthorizationsAuditAnnotation])
+		assert.Equal(t, "my-host", denial.AuditAnnotations[hostnameAuditAnnotation])
+	})
+
+	t.Run("pods not using GMSA's don't get any audit annotation", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+
+		for _, operation := range []webhookOperation{mutate, validate} {
+			response, err := newWebhook(client).validateOrMutate(context.Background(), buildRequest(t, pod), operation)
+			require.Nil(t, err)
+			require.NotNil(t, response)
+			assert.Empty(t, response.AuditAnnotations)
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// gmsaCompatibleAccountsHint lists the accounts whose processes authenticate on the network with the identity of
+// their container's GMSA.
+const gmsaCompatibleAccountsHint = `run as "NT AUTHORITY\NETWORK SERVICE", "NT AUTHORITY\SYSTEM", "ContainerUser" or "ContainerAdministrator" instead`
+
+// nonDomainAccountPrefixes are the prefixes of the Windows account names that don't refer to domain accounts,
+// in lower case.
+var nonDomainAccountPrefixes = []string{`nt authority\`, `builtin\`, `user manager\`, `.\`}
+
+// checkWindowsOptionsCompatibility records a violation for each container using a GMSA that is a HostProcess
+// container, or that runs as a user that can't use GMSA's, whether these settings come from the container itself
+// or from its pod. Containers for which `skip` returns true don't get checked.
+func checkWindowsOptionsCompatibility(pod *corev1.Pod, violations *policyViolations, skip func(container podContainer) bool) {
+	var podWindowsOptions *corev1.WindowsSecurityContextOptions
+	if pod.Spec.SecurityContext != nil {
+		podWindowsOptions = pod.Spec.SecurityContext.WindowsOptions
+	}
+
+	for _, container := range podContainers(pod) {
+		credSpecName := effectiveCredSpecName(pod, container)
+		if credSpecName == "" || (skip != nil && skip(container)) {
+			continue
+		}
+
+		var containerWindowsOptions *corev1.WindowsSecurityContextOptions
+		if container.securityContext != nil {
+			containerWindowsOptions = container.securityContext.WindowsOptions
+		}
+
+		var hostProcess *bool
+		var hostProcessField string
+		switch {
+		case containerWindowsOptions != nil && containerWindowsOptions.HostProcess != nil:
+			hostProcess, hostProcessField = containerWindowsOptions.HostProcess, windowsOptionsField(container.kind, container.index, "hostProcess")
+		case podWindowsOptions != nil && podWindowsOptions.HostProcess != nil:
+			hostProcess, hostProcessField = podWindowsOptions.HostProcess, windowsOptionsField(podKind, -1, "hostProcess")
+		}
+		if hostProcess != nil && *hostProcess {
+			msg := fmt.Sprintf("%s %q uses GMSA cred spec %q, but is a HostProcess container; HostProcess containers run as host accounts, and can't use GMSA's",
+				container.kind, container.name, credSpecName)
+			violations.check(&podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusUnprocessableEntity, reason: gmsaWithHostProcessReason, field: hostProcessField})
+		}
+
+		var userName *string
+		var userNameField string
+		switch {
+		case containerWindowsOptions != nil && containerWindowsOptions.RunAsUserName != nil:
+			userName, userNameField = containerWindowsOptions.RunAsUserName, windowsOptionsField(container.kind, container.index, "runAsUserName")
+		case podWindowsOptions != nil && podWindowsOptions.RunAsUserName != nil:
+			userName, userNameField = podWindowsOptions.RunAsUserName, windowsOptionsField(podKind, -1, "runAsUserName")
+		}
+		if userName != nil {
+			if reason := gmsaIncompatibleUserReason(*userName); reason != "" {
+				msg := fmt.Sprintf("%s %q uses GMSA cred spec %q, but runs as %q: %s; %s",
+					container.kind, container.name, credSpecName, *userName, reason, gmsaCompatibleAccountsHint)
+				violations.check(&podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusUnprocessableEntity, reason: incompatibleRunAsUserNameReason, field: userNameField})
+			}
+		}
+	}
+}
+
+// windowsOptionsField returns the path of a field of a pod's or container's `WindowsSecurityOptions`.
+func windowsOptionsField(resourceKind gmsaResourceKind, containerIndex int, fieldName string) string {
+	return fieldPath(resourceSpecPath(resourceKind, containerIndex) + "/securityContext/windowsOptions/" + fieldName)
+}
+
+// gmsaIncompatibleUserReason returns why processes running as the given user don't authenticate on the network
+// with their container's GMSA, or an empty string if they do.
+func gmsaIncompatibleUserReason(userName string) string {
+	normalized := strings.ToLower(strings.TrimSpace(userName))
+
+	switch normalized {
+	case `nt authority\local service`, `nt authority\localservice`:
+		return "LOCAL SERVICE authenticates anonymously on the network"
+	}
+
+	if strings.Contains(normalized, "@") {
+		return "containers can't run as domain accounts"
+	}
+	if strings.Contains(normalized, `\`) {
+		for _, prefix := range nonDomainAccountPrefixes {
+			if strings.HasPrefix(normalized, prefix) {
+				return ""
+			}
+		}
+		return "containers can't run as domain accounts"
+	}
+	return ""
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGMSAIncompatibleUserReason(t *testing.T) {
+	for userName, compatible := range map[string]bool{
+		"ContainerUser":                true,
+		"ContainerAdministrator":       true,
+		`NT AUTHORITY\NETWORK SERVICE`: true,
+		`nt authority\system`:          true,
+		`User Manager\ContainerUser`:   true,
+		`.\webuser`:                    true,
+		`NT AUTHORITY\LOCAL SERVICE`:   false,
+		`CONTOSO\webapp`:               false,
+		"webapp@contoso.com":           false,
+	} {
+		assert.Equal(t, compatible, gmsaIncompatibleUserReason(userName) == "", userName)
+	}
+}
+
+func TestValidateCreateRequestWindowsOptionsCompatibility(t *testing.T) {
+	trueValue := true
+	falseValue := false
+
+	buildCompatibilityPod := func() *corev1.Pod {
+		return buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: {},
+		})
+	}
+
+	validate := func(pod *corev1.Pod, options ...WebhookOption) (*podAdmissionError, []string) {
+		response, err := newWebhookWithOptions(&dummyKubeClient{}, options...).validateCreateRequest(context.Background(), pod, dummyNamespace)
+		if err != nil {
+			return err, nil
+		}
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+		return nil, response.Warnings
+	}
+
+	t.Run("HostProcess containers inheriting a GMSA from their pod are denied", func(t *testing.T) {
+		pod := buildCompatibilityPod()
+		pod.Spec.Containers[0].SecurityContext.WindowsOptions.HostProcess = &trueValue
+
+		err, _ := validate(pod)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusUnprocessableEntity,
+			"container %q uses GMSA cred spec %q, but is a HostProcess container", dummyContainerName, dummyCredSpecName) {
+			assert.Equal(t, gmsaWithHostProcessReason, err.reason)
+			assert.Equal(t, "spec.containers[0].securityContext.windowsOptions.hostProcess", err.field)
+		}
+	})
+
+	t.Run("HostProcess pods using a GMSA are denied", func(t *testing.T) {
+		pod := buildCompatibilityPod()
+		pod.Spec.SecurityContext.WindowsOptions.HostProcess = &trueValue
+
+		err, _ := validate(pod)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusUnprocessableEntity, "is a HostProcess container") {
+			assert.Equal(t, "spec.securityContext.windowsOptions.hostProcess", err.field)
+		}
+
+		// containers can opt out of their pod's setting
+		pod.Spec.Containers[0].SecurityContext.WindowsOptions.HostProcess = &falseValue
+		err, _ = validate(pod)
+		assert.Nil(t, err)
+	})
+
+	t.Run("containers running as users that can't use GMSA's are denied", func(t *testing.T) {
+		userName := `CONTOSO\webapp`
+		pod := buildCompatibilityPod()
+		pod.Spec.SecurityContext.WindowsOptions.RunAsUserName = &userName
+
+		err, _ := validate(pod)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusUnprocessableEntity,
+			`container %q uses GMSA cred spec %q, but runs as "CONTOSO\\webapp": containers can't run as domain accounts; run as`, dummyContainerName, dummyCredSpecName) {
+			assert.Equal(t, incompatibleRunAsUserNameReason, err.reason)
+			assert.Equal(t, "spec.securityContext.windowsOptions.runAsUserName", err.field)
+		}
+
+		compatibleUserName := `NT AUTHORITY\NETWORK SERVICE`
+		pod.Spec.Containers[0].SecurityContext.WindowsOptions.RunAsUserName = &compatibleUserName
+		err, _ = validate(pod)
+		assert.Nil(t, err)
+	})
+
+	t.Run("they follow the policy mode", func(t *testing.T) {
+		pod := buildCompatibilityPod()
+		pod.Spec.Containers[0].SecurityContext.WindowsOptions.HostProcess = &trueValue
+
+		err, warnings := validate(pod, WithPolicyMode(WarnPolicyMode))
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(warnings)) {
+			assert.Contains(t, warnings[0], "is a HostProcess container")
+		}
+	})
+
+	t.Run("containers without any GMSA are left alone", func(t *testing.T) {
+		userName := `CONTOSO\webapp`
+		pod := buildPod(dummyServiceAccoutName, &corev1.WindowsSecurityContextOptions{HostProcess: &trueValue, RunAsUserName: &userName},
+			map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+
+		err, _ := validate(pod)
+		assert.Nil(t, err)
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// deprecatedCredSpecAnnotation can be set on cred specs that shouldn't be used any more, either to `true`
+// or to a message telling users what to use instead; pods using them then get a warning.
+const deprecatedCredSpecAnnotation = "windows.k8s.io/gmsa-deprecated"
+
+// gmsaCredSpec is a GMSA cred spec resource, as far as the webhook is concerned.
+type gmsaCredSpec struct {
+	name            string
+	resourceVersion string
+	labels          map[string]string
+	annotations     map[string]string
+	// contents is the JSON representation of the cred spec itself
+	contents string
+}
+
+// credSpecCache memoizes the cred specs retrieved while handling a single admission request,
+// so that each of them only gets fetched once even when several checks or mutations need it;
+// as well as the GMSAPolicies, see gmsaPolicies.
+type credSpecCache struct {
+	client    kubeClientInterface
+	credSpecs map[string]*gmsaCredSpec
+	policies  []gmsaPolicy
+}
+
+func newCredSpecCache(client kubeClientInterface) *credSpecCache {
+	return &credSpecCache{
+		client:    client,
+		credSpecs: make(map[string]*gmsaCredSpec),
+	}
+}
+
+// get returns the cred spec with the given name, only fetching it the first time.
+// If it returns an error, it also returns the corresponding HTTP code; errors don't get cached.
+func (cache *credSpecCache) get(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+	if credSpec, present := cache.credSpecs[credSpecName]; present {
+		return credSpec, 0, nil
+	}
+
+	credSpec, code, err := cache.client.retrieveCredSpec(ctx, credSpecName)
+	if err != nil {
+		return nil, code, err
+	}
+	cache.credSpecs[credSpecName] = credSpec
+	return credSpec, code, nil
+}
+
+// deprecatedCredSpecWarning returns the warning to give users of the cred spec if it's deprecated, or an
+// empty string otherwise.
+func deprecatedCredSpecWarning(credSpec *gmsaCredSpec) string {
+	value, present := credSpec.annotations[deprecatedCredSpecAnnotation]
+	if !present {
+		return ""
+	}
+	value = strings.TrimSpace(value)
+	if deprecated, err := strconv.ParseBool(value); err == nil {
+		if !deprecated {
+			return ""
+		}
+		value = ""
+	}
+
+	warning := fmt.Sprintf("GMSA cred spec %q is deprecated", credSpec.name)
+	if value != "" {
+		warning += ": " + value
+	}
+	return warning
+}
+
+// credSpecContentsHash returns the hash identifying a cred spec's contents, as `sha256:<hex digest>`.
+func credSpecContentsHash(contents string) string {
+	digest := sha256.Sum256([]byte(contents))
+	return "sha256:" + hex.EncodeToString(digest[:])
+}
+
+// credSpecNames returns the distinct names of the GMSA cred specs that the pod or any of its
+// containers requests, in order of appearance.
+func credSpecNames(pod *corev1.Pod) []string {
+	var names []string
+	seen := make(map[string]bool)
+
+	iterateOverWindowsSecurityOptions(pod, func(windowsOptions *corev1.WindowsSecurityContextOptions, _ gmsaResourceKind, _ string, _ int) *podAdmissionError {
+		if name := windowsOptions.GMSACredentialSpecName; name != nil && !seen[*name] {
+			seen[*name] = true
+			names = append(names, *name)
+		}
+		return nil
+	})
+
+	return names
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// credSpecCaseInsensitiveFields are the cred spec fields that Windows compares regardless of letter case:
+// GUIDs, SIDs, and domain and account names. Array items are denoted by `[]`.
+var credSpecCaseInsensitiveFields = map[string]bool{
+	"ActiveDirectoryConfig.GroupManagedServiceAccounts[].Name":  true,
+	"ActiveDirectoryConfig.GroupManagedServiceAccounts[].Scope": true,
+	"ActiveDirectoryConfig.HostAccountConfig.PluginGUID":        true,
+	"DomainJoinConfig.DnsName":                                  true,
+	"DomainJoinConfig.DnsTreeName":                              true,
+	"DomainJoinConfig.Guid":                                     true,
+	"DomainJoinConfig.MachineAccountName":                       true,
+	"DomainJoinConfig.NetBiosName":                              true,
+	"DomainJoinConfig.Sid":                                      true,
+}
+
+// credSpecUnorderedFields are the cred spec arrays whose items' order doesn't matter.
+var credSpecUnorderedFields = map[string]bool{
+	"ActiveDirectoryConfig.GroupManagedServiceAccounts": true,
+}
+
+// credSpecDifference describes the first difference found between two cred specs' contents.
+type credSpecDifference struct {
+	// path is the path to the differing field, e.g. `DomainJoinConfig.Sid` or
+	// `ActiveDirectoryConfig.GroupManagedServiceAccounts[1].Name`
+	path        string
+	description string
+}
+
+func (difference *credSpecDifference) String() string {
+	return fmt.Sprintf("field %s %s", difference.path, difference.description)
+}
+
+// compareCredSpecContents compares the cred spec contents set on a pod or container with the ones from the
+// GMSA resource, and returns the first difference between them, or nil if they represent the same credential
+// spec. Fields are compared the way Windows does: GUIDs, SIDs, domain and account names regardless of case,
+// and GMSA's regardless of their order; unknown fields have to be strictly equal.
+func compareCredSpecContents(fromResource, fromCRD string) (*credSpecDifference, error) {
+	// this is actually what happens almost all the time, when users don't set the GMSA contents directly
+	// but instead rely on the mutating webhook to do that for them; and in that case no need for a slow
+	// JSON parsing and comparison
+	if fromResource == fromCRD {
+		return nil, nil
+	}
+
+	var (
+		jsonObjectFromResource map[string]interface{}
+		jsonObjectFromCRD      map[string]interface{}
+	)
+
+	if err := json.Unmarshal([]byte(fromResource), &jsonObjectFromResource); err != nil {
+		return nil, fmt.Errorf("unable to parse %q as a JSON object: %v", fromResource, err)
+	}
+	if err := json.Unmarshal([]byte(fromCRD), &jsonObjectFromCRD); err != nil {
+		return nil, fmt.Errorf("unable to parse CRD %q as a JSON object: %v", fromCRD, err)
+	}
+
+	return compareCredSpecValues(jsonObjectFromResource, jsonObjectFromCRD, "", ""), nil
+}
+
+// compareCredSpecValues recursively compares two parsed JSON values found at the given path; schemaPath is
+// the same path, with array indices left out to look up the credSpecCaseInsensitiveFields and
+// credSpecUnorderedFields.
+func compareCredSpecValues(fromResource, fromCRD interface{}, path, schemaPath string) *credSpecDifference {
+	switch crdValue := fromCRD.(type) {
+	case map[string]interface{}:
+		resourceValue, ok := fromResource.(map[string]interface{})
+		if !ok {
+			return &credSpecDifference{path: path, description: "has a different type"}
+		}
+		return compareCredSpecObjects(resourceValue, crdValue, path, schemaPath)
+
+	case []interface{}:
+		resourceValue, ok := fromResource.([]interface{})
+		if !ok {
+			return &credSpecDifference{path: path, description: "has a different type"}
+		}
+		if credSpecUnorderedFields[schemaPath] {
+			return compareUnorderedCredSpecArrays(resourceValue, crdValue, path, schemaPath)
+		}
+		for i := 0; i < len(resourceValue) && i < len(crdValue); i++ {
+			if difference := compareCredSpecValues(resourceValue[i], crdValue[i], fmt.Sprintf("%s[%d]", path, i), schemaPath+"[]"); difference != nil {
+				return difference
+			}
+		}
+		if len(resourceValue) != len(crdValue) {
+			return &credSpecDifference{path: path, description: fmt.Sprintf("has %d items instead of %d", len(resourceValue), len(crdValue))}
+		}
+		return nil
+
+	case string:
+		resourceValue, ok := fromResource.(string)
+		if !ok {
+			return &credSpecDifference{path: path, description: "has a different type"}
+		}
+		if resourceValue == crdValue || (credSpecCaseInsensitiveFields[schemaPath] && strings.EqualFold(resourceValue, crdValue)) {
+			return nil
+		}
+		return &credSpecDifference{path: path, description: "differs"}
+
+	default:
+		if reflect.DeepEqual(fromResource, fromCRD) {
+			return nil
+		}
+		return &credSpecDifference{path: path, description: "differs"}
+	}
+}
+
+func compareCredSpecObjects(fromResource, fromCRD map[string]interface{}, path, schemaPath string) *credSpecDifference {
+	keys := make([]string, 0, len(fromCRD))
+	for key := range fromCRD {
+		keys = append(keys, key)
+	}
+	for key := range fromResource {
+		if _, present := fromCRD[key]; !present {
+			keys = append(keys, key)
+		}
+	}
+	// makes the first difference reported deterministic
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fieldPath, fieldSchemaPath := key, key
+		if path != "" {
+			fieldPath = path + "." + key
+		}
+		if schemaPath != "" {
+			fieldSchemaPath = schemaPath + "." + key
+		}
+
+		resourceValue, inResource := fromResource[key]
+		crdValue, inCRD := fromCRD[key]
+		switch {
+		case !inResource:
+			return &credSpecDifference{path: fieldPath, description: "is missing"}
+		case !inCRD:
+			return &credSpecDifference{path: fieldPath, description: "is not set in the GMSA resource"}
+		}
+		if difference := compareCredSpecValues(resourceValue, crdValue, fieldPath, fieldSchemaPath); difference != nil {
+			return difference
+		}
+	}
+
+	return nil
+}
+
+// compareUnorderedCredSpecArrays matches each item from the resource's array with an equivalent item from the
+// CRD's, and reports the first one that doesn't have any.
+func compareUnorderedCredSpecArrays(fromResource, fromCRD []interface{}, path, schemaPath string) *credSpecDifference {
+	if len(fromResource) != len(fromCRD) {
+		return &credSpecDifference{path: path, description: fmt.Sprintf("has %d items instead of %d", len(fromResource), len(fromCRD))}
+	}
+
+	matched := make([]bool, len(fromCRD))
+	for i, resourceItem := range fromResource {
+		found := false
+		for j, crdItem := range fromCRD {
+			if !matched[j] && compareCredSpecValues(resourceItem, crdItem, "", schemaPath+"[]") == nil {
+				matched[j] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &credSpecDifference{path: fmt.Sprintf("%s[%d]", path, i), description: "has no equivalent item in the GMSA resource"}
+		}
+	}
+
+	return nil
+}
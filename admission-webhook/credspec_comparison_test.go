@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sampleCredSpecContents = `{
+	"ActiveDirectoryConfig": {
+		"GroupManagedServiceAccounts": [
+			{"Name": "WebApplication2", "Scope": "CONTOSO"},
+			{"Name": "WebApplication2", "Scope": "contoso.com"}
+		],
+		"HostAccountConfig": {
+			"PluginGUID": "{GDMA0342-266A-4D1P-831J-20990E82944F}",
+			"PluginInput": "contoso.com:gmsaccg:<password>",
+			"PortableCcgVersion": "1"
+		}
+	},
+	"CmsPlugins": ["ActiveDirectory"],
+	"DomainJoinConfig": {
+		"DnsName": "contoso.com",
+		"DnsTreeName": "contoso.com",
+		"Guid": "244818ae-87ca-4fcd-92ec-e79e5252348a",
+		"MachineAccountName": "WebApplication2",
+		"NetBiosName": "CONTOSO",
+		"Sid": "S-1-5-21-2126729477-2524275714-3294792973"
+	}
+}`
+
+func TestCompareCredSpecContents(t *testing.T) {
+	for testName, testCase := range map[string]struct {
+		replacements []string
+		// expectedDifference is empty iff the contents should be deemed equivalent
+		expectedDifference string
+	}{
+		"identical contents": {},
+		"GMSA's in a different order": {
+			replacements: []string{`"Scope": "CONTOSO"`, `"Scope": "contoso.com"`, `"Scope": "contoso.com"`, `"Scope": "CONTOSO"`},
+		},
+		"GUIDs, SIDs and names with different letter cases": {
+			replacements: []string{
+				"244818ae-87ca-4fcd-92ec-e79e5252348a", "244818AE-87CA-4FCD-92EC-E79E5252348A",
+				"{GDMA0342-266A-4D1P-831J-20990E82944F}", "{gdma0342-266a-4d1p-831j-20990e82944f}",
+				"S-1-5-21", "s-1-5-21",
+				`"NetBiosName": "CONTOSO"`, `"NetBiosName": "Contoso"`,
+				`"Scope": "CONTOSO"`, `"Scope": "contoso"`,
+			},
+		},
+		"a different SID": {
+			replacements:       []string{"2126729477", "2126729478"},
+			expectedDifference: "field DomainJoinConfig.Sid differs",
+		},
+		"a GMSA without any equivalent": {
+			replacements:       []string{`"Scope": "contoso.com"`, `"Scope": "fabrikam.com"`},
+			expectedDifference: "field ActiveDirectoryConfig.GroupManagedServiceAccounts[1] has no equivalent item in the GMSA resource",
+		},
+		"a missing GMSA": {
+			replacements:       []string{`{"Name": "WebApplication2", "Scope": "CONTOSO"},`, ""},
+			expectedDifference: "field ActiveDirectoryConfig.GroupManagedServiceAccounts has 1 items instead of 2",
+		},
+		"plugin inputs with different letter cases": {
+			replacements:       []string{"gmsaccg", "GMSACCG"},
+			expectedDifference: "field ActiveDirectoryConfig.HostAccountConfig.PluginInput differs",
+		},
+		"CMS plugins": {
+			replacements:       []string{`["ActiveDirectory"]`, `["ActiveDirectory", "Other"]`},
+			expectedDifference: "field CmsPlugins has 2 items instead of 1",
+		},
+		"a missing field": {
+			replacements:       []string{`"DnsTreeName": "contoso.com",`, ""},
+			expectedDifference: "field DomainJoinConfig.DnsTreeName is missing",
+		},
+		"an extra field": {
+			replacements:       []string{`"CmsPlugins"`, `"Extra": true, "CmsPlugins"`},
+			expectedDifference: "field Extra is not set in the GMSA resource",
+		},
+		"a field with a different type": {
+			replacements:       []string{`"PortableCcgVersion": "1"`, `"PortableCcgVersion": 1`},
+			expectedDifference: "field ActiveDirectoryConfig.HostAccountConfig.PortableCcgVersion has a different type",
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			fromResource := strings.NewReplacer(testCase.replacements...).Replace(sampleCredSpecContents)
+			require.NotEqual(t, len(testCase.replacements) != 0, fromResource == sampleCredSpecContents)
+
+			difference, err := compareCredSpecContents(fromResource, sampleCredSpecContents)
+			require.NoError(t, err)
+
+			if testCase.expectedDifference == "" {
+				assert.Nil(t, difference)
+			} else if assert.NotNil(t, difference) {
+				assert.Equal(t, testCase.expectedDifference, difference.String())
+			}
+		})
+	}
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		difference, err := compareCredSpecContents("i ain't no JSON object", sampleCredSpecContents)
+		assert.Nil(t, difference)
+		assert.ErrorContains(t, err, "unable to parse")
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+	"github.com/google/cel-go/common/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	celconfig "k8s.io/apiserver/pkg/apis/cel"
+	"k8s.io/apiserver/pkg/cel/environment"
+	"k8s.io/apiserver/pkg/cel/library"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// customRuleCostLimit caps how much work evaluating a single custom rule may take, in CEL cost units; same
+	// as the per-expression limit of Kubernetes' own validating admission policies.
+	customRuleCostLimit = celconfig.PerCallLimit
+
+	// customRuleMaxInputSize is what the sizes of custom rules' inputs are assumed to be at most when estimating
+	// their cost at load time: in elements for lists and maps, in characters for strings. That's enough for pods'
+	// lists, and for most of their strings, e.g. names and images; rules whose estimated cost on such inputs
+	// exceeds customRuleCostLimit get rejected when loaded, rather than failing to evaluate on most pods.
+	customRuleMaxInputSize = 1024
+)
+
+// CustomRuleConfig is a site-specific rule that pods using GMSA's must follow, on top of the built-in checks.
+type CustomRuleConfig struct {
+	// Name identifies the rule in violations.
+	Name string `json:"name"`
+	// Expression is a CEL expression that must evaluate to true for pods to be allowed. It can use the
+	// `object` variable, the pod; `namespaceObject`, its namespace, or null if it doesn't exist; and
+	// `credSpecs`, which maps the names of the cred specs the pod uses to their `name`, `labels`, `annotations`,
+	// and `credspec` contents.
+	Expression string `json:"expression"`
+	// Message is returned when pods don't follow the rule; if empty, the expression gets returned instead.
+	Message string `json:"message,omitempty"`
+	// Field optionally is the path of the pod's field the rule is about, e.g. `spec.hostNetwork`.
+	Field string `json:"field,omitempty"`
+}
+
+// customRule is a CustomRuleConfig, compiled.
+type customRule struct {
+	config  CustomRuleConfig
+	program cel.Program
+}
+
+// loadCustomRules reads a list of CustomRuleConfig's from a YAML or JSON file, and compiles them.
+func loadCustomRules(filePath string) ([]customRule, error) {
+	contents, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read custom rules config file %s: %v", filePath, err)
+	}
+
+	var configs []CustomRuleConfig
+	if err := yaml.UnmarshalStrict(contents, &configs); err != nil {
+		return nil, fmt.Errorf("unable to parse custom rules config file %s: %v", filePath, err)
+	}
+
+	rules, err := compileCustomRules(configs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid custom rules config file %s: %v", filePath, err)
+	}
+	return rules, nil
+}
+
+// compileCustomRules compiles the given rules' expressions, which must evaluate to booleans, with the same CEL
+// libraries as Kubernetes' own expressions, e.g. for lists, regexes, quantities and strings. It also rejects
+// rules whose estimated cost exceeds customRuleCostLimit, see customRuleMaxInputSize.
+func compileCustomRules(configs []CustomRuleConfig) ([]customRule, error) {
+	envSet, err := environment.MustBaseEnvSet(environment.DefaultCompatibilityVersion(), true).Extend(environment.VersionedOptions{
+		IntroducedVersion: environment.DefaultCompatibilityVersion(),
+		EnvOptions: []cel.EnvOption{
+			cel.Variable("object", cel.DynType),
+			cel.Variable("namespaceObject", cel.DynType),
+			cel.Variable("credSpecs", cel.MapType(cel.StringType, cel.DynType)),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create CEL environment: %v", err)
+	}
+	env := envSet.NewExpressionsEnv()
+	costEstimator := &library.CostEstimator{SizeEstimator: customRuleSizeEstimator{}}
+
+	names := make(map[string]bool)
+	rules := make([]customRule, 0, len(configs))
+	for i, config := range configs {
+		if config.Name == "" || strings.TrimSpace(config.Expression) == "" {
+			return nil, fmt.Errorf("entry #%d must define both a name and an expression", i)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("duplicate custom rule name %q", config.Name)
+		}
+		names[config.Name] = true
+
+		ast, issues := env.Compile(config.Expression)
+		if issues.Err() != nil {
+			return nil, fmt.Errorf("unable to compile custom rule %q: %v", config.Name, issues.Err())
+		}
+		if outputType := ast.OutputType(); !outputType.IsExactType(cel.BoolType) && !outputType.IsExactType(cel.DynType) {
+			return nil, fmt.Errorf("custom rule %q must evaluate to a boolean, not %s", config.Name, outputType)
+		}
+		cost, err := env.EstimateCost(ast, costEstimator)
+		if err != nil {
+			return nil, fmt.Errorf("unable to estimate the cost of custom rule %q: %v", config.Name, err)
+		}
+		if cost.Max > customRuleCostLimit {
+			return nil, fmt.Errorf("custom rule %q is too costly: its estimated cost of %d exceeds the limit of %d", config.Name, cost.Max, customRuleCostLimit)
+		}
+		program, err := env.Program(ast, cel.CostLimit(customRuleCostLimit))
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile custom rule %q: %v", config.Name, err)
+		}
+
+		rules = append(rules, customRule{config: config, program: program})
+	}
+	return rules, nil
+}
+
+// customRuleSizeEstimator bounds the sizes of custom rules' inputs to customRuleMaxInputSize, their variables
+// being untyped; it leaves the cost of functions to the Kubernetes libraries' estimator it gets plugged into.
+type customRuleSizeEstimator struct{}
+
+func (customRuleSizeEstimator) EstimateSize(element checker.AstNode) *checker.SizeEstimate {
+	return &checker.SizeEstimate{Min: 0, Max: customRuleMaxInputSize}
+}
+
+func (customRuleSizeEstimator) EstimateCallCost(function, overloadID string, target *checker.AstNode, args []checker.AstNode) *checker.CallEstimate {
+	return nil
+}
+
+// message returns what to tell users about pods that don't follow the rule.
+func (rule *customRule) message() string {
+	if rule.config.Message != "" {
+		return rule.config.Message
+	}
+	return "failed expression: " + rule.config.Expression
+}
+
+// checkCustomRules records a violation for each custom rule the pod doesn't follow, if it uses GMSA's; rules that
+// fail to evaluate, e.g. because they reference a field the pod doesn't set, count as not followed.
+// It only returns internal errors.
+func (webhook *webhook) checkCustomRules(ctx context.Context, pod *corev1.Pod, namespace string, credSpecs *credSpecCache, violations *policyViolations) *podAdmissionError {
+	if len(webhook.config.CustomRules) == 0 || !hasGMSASettings(pod) {
+		return nil
+	}
+
+	variables, err := webhook.customRuleVariables(ctx, pod, namespace, credSpecs)
+	if err != nil {
+		return err
+	}
+
+	for i := range webhook.config.CustomRules {
+		rule := &webhook.config.CustomRules[i]
+
+		var msg string
+		result, _, evalErr := rule.program.Eval(variables)
+		switch {
+		case evalErr != nil:
+			msg = fmt.Sprintf("pod does not satisfy custom GMSA rule %q: unable to evaluate it: %v", rule.config.Name, evalErr)
+		case result.Type() != types.BoolType:
+			msg = fmt.Sprintf("pod does not satisfy custom GMSA rule %q: it evaluated to a %s instead of a boolean", rule.config.Name, result.Type().TypeName())
+		case result == types.True:
+			continue
+		default:
+			msg = fmt.Sprintf("pod does not satisfy custom GMSA rule %q: %s", rule.config.Name, rule.message())
+		}
+
+		// each rule only gets evaluated once per pod, so unlike check there's nothing to deduplicate here;
+		// distinct rules about the same field must all get reported
+		violations.violations = append(violations.violations,
+			&podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusForbidden, reason: customRuleViolationReason, field: rule.config.Field})
+	}
+
+	return nil
+}
+
+// customRuleVariables returns the variables custom rules get evaluated with, see CustomRuleConfig.
+// Cred specs that can't be retrieved get left out, other checks deny their pods.
+func (webhook *webhook) customRuleVariables(ctx context.Context, pod *corev1.Pod, namespace string, credSpecs *credSpecCache) (map[string]interface{}, *podAdmissionError) {
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pod)
+	if err != nil {
+		return nil, &podAdmissionError{error: fmt.Errorf("unable to convert pod to evaluate custom rules: %v", err), pod: pod, code: http.StatusInternalServerError}
+	}
+	// pods being created don't necessarily say which namespace they're in
+	if pod.Namespace == "" {
+		if err := unstructured.SetNestedField(object, namespace, "metadata", "namespace"); err != nil {
+			return nil, &podAdmissionError{error: fmt.Errorf("unable to convert pod to evaluate custom rules: %v", err), pod: pod, code: http.StatusInternalServerError}
+		}
+	}
+
+	// left as a nil interface, rather than a nil map, so that it's null for CEL
+	var namespaceObject interface{}
+	ns, code, err := webhook.client.retrieveNamespace(ctx, namespace)
+	if err != nil && code != http.StatusNotFound {
+		return nil, &podAdmissionError{error: err, pod: pod, code: code}
+	}
+	if ns != nil {
+		converted, err := runtime.DefaultUnstructuredConverter.ToUnstructured(ns)
+		if err != nil {
+			return nil, &podAdmissionError{error: fmt.Errorf("unable to convert namespace %q to evaluate custom rules: %v", namespace, err), pod: pod, code: http.StatusInternalServerError}
+		}
+		namespaceObject = converted
+	}
+
+	credSpecObjects := make(map[string]interface{})
+	for _, credSpecName := range credSpecNames(pod) {
+		credSpec, code, err := credSpecs.get(ctx, credSpecName)
+		if err != nil {
+			if code >= http.StatusInternalServerError {
+				return nil, &podAdmissionError{error: err, pod: pod, code: code}
+			}
+			continue
+		}
+
+		var contents interface{}
+		if err := json.Unmarshal([]byte(credSpec.contents), &contents); err != nil {
+			continue
+		}
+		credSpecObjects[credSpecName] = map[string]interface{}{
+			"name":        credSpec.name,
+			"labels":      stringMapToInterfaces(credSpec.labels),
+			"annotations": stringMapToInterfaces(credSpec.annotations),
+			"credspec":    contents,
+		}
+	}
+
+	return map[string]interface{}{
+		"object":          object,
+		"namespaceObject": namespaceObject,
+		"credSpecs":       credSpecObjects,
+	}, nil
+}
+
+// stringMapToInterfaces converts labels or annotations to the same type as the rest of the objects custom rules
+// get evaluated against, so that they can all be handled the same way.
+func stringMapToInterfaces(values map[string]string) map[string]interface{} {
+	converted := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		converted[key] = value
+	}
+	return converted
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateCreateRequestCustomRules(t *testing.T) {
+	kubeClient := &dummyKubeClient{
+		retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+			return &gmsaCredSpec{
+				name:        credSpecName,
+				labels:      map[string]string{"tier": "web"},
+				annotations: map[string]string{"owner": "team-a"},
+				contents:    dummyCredSpecContents,
+			}, http.StatusOK, nil
+		},
+		retrieveNamespaceFunc: func(ctx context.Context, name string) (*corev1.Namespace, int, error) {
+			return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"team": "team-a"}}}, http.StatusOK, nil
+		},
+	}
+
+	buildGMSAPod := func() *corev1.Pod {
+		return buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+	}
+
+	validate := func(t *testing.T, pod *corev1.Pod, configs ...CustomRuleConfig) (bool, *podAdmissionError) {
+		rules, err := compileCustomRules(configs)
+		require.Nil(t, err)
+		response, admissionErr := newWebhookWithOptions(kubeClient, WithCustomRules(rules)).validateCreateRequest(context.Background(), pod, dummyNamespace)
+		return response != nil && response.Allowed, admissionErr
+	}
+
+	t.Run("it allows pods satisfying all rules", func(t *testing.T) {
+		allowed, err := validate(t, buildGMSAPod(),
+			CustomRuleConfig{Name: "no-host-network", Expression: "!has(object.spec.hostNetwork) || !object.spec.hostNetwork"},
+			CustomRuleConfig{Name: "team-owns-cred-spec", Expression: "credSpecs.all(name, credSpecs[name].annotations['owner'] == namespaceObject.metadata.labels['team'])"},
+			CustomRuleConfig{Name: "cred-spec-contents", Expression: "credSpecs[object.spec.securityContext.windowsOptions.gmsaCredentialSpecName].credspec['All in all you\\'re just another'].brick == 'in'"},
+			CustomRuleConfig{Name: "namespace", Expression: "object.metadata.namespace == '" + dummyNamespace + "'"},
+		)
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	})
+
+	t.Run("it denies pods violating rules, with their messages", func(t *testing.T) {
+		pod := buildGMSAPod()
+		pod.Spec.HostNetwork = true
+
+		allowed, err := validate(t, pod,
+			CustomRuleConfig{Name: "no-host-network", Expression: "!object.spec.hostNetwork", Message: "GMSA pods must not use the host's network", Field: "spec.hostNetwork"},
+			CustomRuleConfig{Name: "web-only", Expression: "credSpecs.all(name, credSpecs[name].labels['tier'] == 'db')"},
+		)
+		assert.False(t, allowed)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden,
+			`pod does not satisfy custom GMSA rule "no-host-network": GMSA pods must not use the host's network`) {
+			assert.Equal(t, customRuleViolationReason, err.reason)
+			assert.Equal(t, "spec.hostNetwork", err.field)
+			assert.Contains(t, err.Error(), `pod does not satisfy custom GMSA rule "web-only": failed expression: credSpecs.all(`)
+			assert.Equal(t, 2, len(err.causes))
+		}
+	})
+
+	t.Run("rules that fail to evaluate count as violated", func(t *testing.T) {
+		pod := buildGMSAPod()
+
+		allowed, err := validate(t, pod, CustomRuleConfig{Name: "labelled", Expression: "object.metadata.labels['app'] == 'web'"})
+		assert.False(t, allowed)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, `pod does not satisfy custom GMSA rule "labelled": unable to evaluate it: `) {
+			assert.Equal(t, customRuleViolationReason, err.reason)
+		}
+	})
+
+	t.Run("rules evaluating to non-booleans count as violated", func(t *testing.T) {
+		pod := buildGMSAPod()
+
+		allowed, err := validate(t, pod, CustomRuleConfig{Name: "dyn", Expression: "object.metadata.name"})
+		assert.False(t, allowed)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, `pod does not satisfy custom GMSA rule "dyn": it evaluated to a string instead of a boolean`)
+	})
+
+	t.Run("it only checks pods using GMSA's", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+		pod.Spec.HostNetwork = true
+
+		allowed, err := validate(t, pod, CustomRuleConfig{Name: "no-host-network", Expression: "!object.spec.hostNetwork"})
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	})
+
+	t.Run("rules can use Kubernetes' CEL libraries", func(t *testing.T) {
+		pod := buildGMSAPod()
+		pod.Spec.Containers[0].Image = "Contoso.azurecr.io/web/app:v1"
+		pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")}
+
+		allowed, err := validate(t, pod,
+			CustomRuleConfig{Name: "strings", Expression: "object.spec.containers.all(c, c.image.lowerAscii().startsWith('contoso.azurecr.io/'))"},
+			CustomRuleConfig{Name: "regex", Expression: "object.spec.containers.all(c, c.image.find('[^:]+$') == 'v1')"},
+			CustomRuleConfig{Name: "lists", Expression: "object.spec.containers.map(c, c.name).isSorted()"},
+			CustomRuleConfig{Name: "quantity", Expression: "quantity(object.spec.containers[0].resources.limits.memory).isLessThan(quantity('1Gi'))"},
+		)
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	})
+
+	t.Run("in warn mode, violations are returned as warnings", func(t *testing.T) {
+		rules, err := compileCustomRules([]CustomRuleConfig{{Name: "never", Expression: "false", Message: "nope"}})
+		require.Nil(t, err)
+
+		response, admissionErr := newWebhookWithOptions(kubeClient, WithCustomRules(rules), WithPolicyMode(WarnPolicyMode)).
+			validateCreateRequest(context.Background(), buildGMSAPod(), dummyNamespace)
+		require.Nil(t, admissionErr)
+		assert.True(t, response.Allowed)
+		assert.Equal(t, []string{`GMSA policy violation: pod does not satisfy custom GMSA rule "never": nope`}, response.Warnings)
+	})
+}
+
+func TestLoadCustomRules(t *testing.T) {
+	writeConfig := func(t *testing.T, contents string) string {
+		filePath := path.Join(t.TempDir(), "custom-rules.yml")
+		require.Nil(t, os.WriteFile(filePath, []byte(contents), 0644))
+		return filePath
+	}
+
+	t.Run("with a valid config, it parses and compiles it", func(t *testing.T) {
+		rules, err := loadCustomRules(writeConfig(t, `
+- name: no-host-network
+  expression: "!object.spec.hostNetwork"
+  message: GMSA pods must not use the host's network
+  field: spec.hostNetwork
+- name: web-only
+  expression: credSpecs.all(name, credSpecs[name].labels['tier'] == 'web')
+`))
+		require.Nil(t, err)
+
+		if assert.Equal(t, 2, len(rules)) {
+			assert.Equal(t, CustomRuleConfig{Name: "no-host-network", Expression: "!object.spec.hostNetwork", Message: "GMSA pods must not use the host's network", Field: "spec.hostNetwork"}, rules[0].config)
+			assert.Equal(t, "web-only", rules[1].config.Name)
+			assert.NotNil(t, rules[1].program)
+		}
+	})
+
+	for testName, contents := range map[string]string{
+		"with an unknown field":         "- name: a\n  expression: 'true'\n  msg: nope",
+		"without a name":                "- expression: 'true'",
+		"without an expression":         "- name: a",
+		"with duplicate names":          "- name: a\n  expression: 'true'\n- name: a\n  expression: 'false'",
+		"with an invalid expression":    "- name: a\n  expression: 'object.spec.'",
+		"with an unknown variable":      "- name: a\n  expression: 'pod.spec.hostNetwork'",
+		"with a non-boolean expression": "- name: a\n  expression: '1 + 1'",
+		"with a too costly expression":  "- name: a\n  expression: 'object.spec.containers.all(c, object.spec.containers.all(d, c.image == d.image))'",
+		"with an invalid format":        "name: a",
+	} {
+		t.Run(testName+", it fails", func(t *testing.T) {
+			_, err := loadCustomRules(writeConfig(t, contents))
+			assert.NotNil(t, err)
+		})
+	}
+
+	t.Run("too costly expressions get rejected with their estimated cost", func(t *testing.T) {
+		_, err := compileCustomRules([]CustomRuleConfig{{Name: "quadratic", Expression: "object.spec.containers.all(c, object.spec.containers.all(d, c.image == d.image))"}})
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), `custom rule "quadratic" is too costly: its estimated cost of `)
+		}
+
+		_, err = compileCustomRules([]CustomRuleConfig{{Name: "linear", Expression: "object.spec.containers.all(c, c.image.contains('latest'))"}})
+		assert.Nil(t, err)
+	})
+
+	t.Run("with a non-existing file, it fails", func(t *testing.T) {
+		_, err := loadCustomRules(path.Join(t.TempDir(), "i-dont-exist.yml"))
+		assert.NotNil(t, err)
+	})
+}
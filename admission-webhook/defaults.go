@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// defaultCredSpecAnnotation can be set on service accounts and namespaces to the name of the GMSA
+// cred spec that their pods should use when they don't request any.
+const defaultCredSpecAnnotation = "windows.k8s.io/gmsa-default-credential-spec-name"
+
+// defaultCredSpecPatches returns the JSON patches setting the pod's GMSA name to the default one
+// for its service account, or failing that for its namespace. Pods that already have GMSA settings
+// on themselves or any of their containers are left untouched, as are pods meant to run on Linux.
+// The pod itself gets updated too, so that the cred spec's contents get inlined afterwards.
+func (webhook *webhook) defaultCredSpecPatches(ctx context.Context, pod *corev1.Pod, namespace string) ([]jsonPatchOperation, *podAdmissionError) {
+	if hasGMSASettings(pod) || isLinuxPod(pod) {
+		return nil, nil
+	}
+
+	credSpecName, source, err := webhook.defaultCredSpecName(ctx, pod, namespace)
+	if err != nil || credSpecName == "" {
+		return nil, err
+	}
+	logrus.Infof("defaulting GMSA cred spec of pod %q in namespace %q to %q from %s", pod.Name, namespace, credSpecName, source)
+
+	windowsOptions, patches := ensureWindowsOptions(pod, podKind, -1)
+	windowsOptions.GMSACredentialSpecName = &credSpecName
+
+	return append(patches, jsonPatchOperation{
+		Op:    "add",
+		Path:  resourceSpecPath(podKind, -1) + "/securityContext/windowsOptions/gmsaCredentialSpecName",
+		Value: credSpecName,
+	}), nil
+}
+
+// defaultCredSpecName looks up the default cred spec annotation on the pod's service account first,
+// then on its namespace. It returns an empty name if neither defines one, and otherwise also returns
+// a description of where the name comes from.
+func (webhook *webhook) defaultCredSpecName(ctx context.Context, pod *corev1.Pod, namespace string) (string, string, *podAdmissionError) {
+	serviceAccountName := pod.Spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = defaultServiceAccountName
+	}
+
+	serviceAccount, code, err := webhook.client.retrieveServiceAccount(ctx, namespace, serviceAccountName)
+	if err != nil && code != http.StatusNotFound {
+		return "", "", &podAdmissionError{error: err, pod: pod, code: code}
+	}
+	if serviceAccount != nil {
+		if credSpecName := strings.TrimSpace(serviceAccount.Annotations[defaultCredSpecAnnotation]); credSpecName != "" {
+			return credSpecName, "service account " + serviceAccountName, nil
+		}
+	}
+
+	ns, code, err := webhook.client.retrieveNamespace(ctx, namespace)
+	if err != nil && code != http.StatusNotFound {
+		return "", "", &podAdmissionError{error: err, pod: pod, code: code}
+	}
+	if ns != nil {
+		if credSpecName := strings.TrimSpace(ns.Annotations[defaultCredSpecAnnotation]); credSpecName != "" {
+			return credSpecName, "namespace " + namespace, nil
+		}
+	}
+
+	return "", "", nil
+}
+
+// hasGMSASettings returns true iff the pod or any of its containers sets a GMSA name or contents.
+func hasGMSASettings(pod *corev1.Pod) bool {
+	found := false
+	iterateOverWindowsSecurityOptions(pod, func(windowsOptions *corev1.WindowsSecurityContextOptions, _ gmsaResourceKind, _ string, _ int) *podAdmissionError {
+		if windowsOptions.GMSACredentialSpecName != nil || windowsOptions.GMSACredentialSpec != nil {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+// isLinuxPod returns true iff the pod explicitly declares it's meant to run on Linux, either through
+// its OS field or its node selector.
+func isLinuxPod(pod *corev1.Pod) bool {
+	if pod.Spec.OS != nil {
+		return pod.Spec.OS.Name == corev1.Linux
+	}
+	return pod.Spec.NodeSelector[corev1.LabelOSStable] == string(corev1.Linux)
+}
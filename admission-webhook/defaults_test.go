@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutateCreateRequestWithDefaultCredSpec(t *testing.T) {
+	const (
+		serviceAccountCredSpecName = "service-account-cred-spec"
+		namespaceCredSpecName      = "namespace-cred-spec"
+	)
+
+	kubeClientFactory := func(serviceAccountCredSpec, namespaceCredSpec string) *dummyKubeClient {
+		return &dummyKubeClient{
+			retrieveCredSpecContentsFunc: func(ctx context.Context, credSpecName string) (contents string, httpCode int, err error) {
+				contents = credSpecName + "-contents"
+				return
+			},
+			retrieveServiceAccountFunc: func(ctx context.Context, namespace, name string) (serviceAccount *corev1.ServiceAccount, httpCode int, err error) {
+				assert.Equal(t, dummyNamespace, namespace)
+				assert.Equal(t, dummyServiceAccoutName, name)
+				serviceAccount = &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+				if serviceAccountCredSpec != "" {
+					serviceAccount.Annotations = map[string]string{defaultCredSpecAnnotation: serviceAccountCredSpec}
+				}
+				return
+			},
+			retrieveNamespaceFunc: func(ctx context.Context, name string) (namespace *corev1.Namespace, httpCode int, err error) {
+				assert.Equal(t, dummyNamespace, name)
+				namespace = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+				if namespaceCredSpec != "" {
+					namespace.Annotations = map[string]string{defaultCredSpecAnnotation: namespaceCredSpec}
+				}
+				return
+			},
+		}
+	}
+
+	expectedPatches := func(credSpecName string) []jsonPatchOperation {
+		return []jsonPatchOperation{
+			{Op: "add", Path: "/spec/securityContext", Value: map[string]interface{}{}},
+			{Op: "add", Path: "/spec/securityContext/windowsOptions", Value: map[string]interface{}{}},
+			{Op: "add", Path: "/spec/securityContext/windowsOptions/gmsaCredentialSpecName", Value: credSpecName},
+			{Op: "add", Path: "/spec/securityContext/windowsOptions/gmsaCredentialSpec", Value: credSpecName + "-contents"},
+		}
+	}
+
+	assertPatches := func(t *testing.T, expected []jsonPatchOperation, response []byte) {
+		var patches []jsonPatchOperation
+		if assert.Nil(t, json.Unmarshal(response, &patches)) {
+			assert.Equal(t, expected, patches)
+		}
+	}
+
+	t.Run("the service account's default cred spec takes precedence over the namespace's", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(serviceAccountCredSpecName, namespaceCredSpecName), WithDefaultCredSpec(true))
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, err)
+
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+		assertPatches(t, expectedPatches(serviceAccountCredSpecName), response.Patch)
+	})
+
+	t.Run("it falls back to the namespace's default cred spec", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory("", namespaceCredSpecName), WithDefaultCredSpec(true))
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, err)
+
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+		assertPatches(t, expectedPatches(namespaceCredSpecName), response.Patch)
+	})
+
+	t.Run("it only creates the missing objects", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(serviceAccountCredSpecName, ""), WithDefaultCredSpec(true))
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{}
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, err)
+
+		require.NotNil(t, response)
+		assertPatches(t, expectedPatches(serviceAccountCredSpecName)[1:], response.Patch)
+	})
+
+	t.Run("the injected cred spec still gets validated", func(t *testing.T) {
+		client := kubeClientFactory(serviceAccountCredSpecName, "")
+		client.isAuthorizedToUseCredSpecFunc = func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string) {
+			assert.Equal(t, serviceAccountCredSpecName, credSpecName)
+			return false, "no role binding"
+		}
+		webhook := newWebhookWithOptions(client, WithDefaultCredSpec(true))
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+
+		_, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+
+		response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, response)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, "not authorized to `use` GMSA cred spec %q", serviceAccountCredSpecName)
+	})
+
+	failingClient := func() *dummyKubeClient {
+		return &dummyKubeClient{
+			retrieveServiceAccountFunc: func(ctx context.Context, namespace, name string) (*corev1.ServiceAccount, int, error) {
+				t.Fatal("should not look up the service account")
+				return nil, 0, nil
+			},
+		}
+	}
+
+	for testCaseName, podFactory := range map[string]func() *corev1.Pod{
+		"it does not override the pod's own GMSA settings": func() *corev1.Pod {
+			return buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents)})
+		},
+		"it does not default pods whose OS is Linux": func() *corev1.Pod {
+			pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+			pod.Spec.OS = &corev1.PodOS{Name: corev1.Linux}
+			return pod
+		},
+		"it does not default pods selecting Linux nodes": func() *corev1.Pod {
+			pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+			pod.Spec.NodeSelector = map[string]string{corev1.LabelOSStable: "linux"}
+			return pod
+		},
+	} {
+		t.Run(testCaseName, func(t *testing.T) {
+			webhook := newWebhookWithOptions(failingClient(), WithDefaultCredSpec(true))
+
+			response, err := webhook.mutateCreateRequest(context.Background(), podFactory(), dummyNamespace)
+			assert.Nil(t, err)
+
+			require.NotNil(t, response)
+			assert.True(t, response.Allowed)
+			assert.Nil(t, response.Patch)
+		})
+	}
+
+	t.Run("it does nothing when not enabled", func(t *testing.T) {
+		webhook := newWebhook(failingClient())
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, err)
+
+		require.NotNil(t, response)
+		assert.Nil(t, response.Patch)
+	})
+
+	t.Run("if there is an error when retrieving the service account, it fails", func(t *testing.T) {
+		dummyError := fmt.Errorf("dummy error")
+		client := kubeClientFactory("", "")
+		client.retrieveServiceAccountFunc = func(ctx context.Context, namespace, name string) (*corev1.ServiceAccount, int, error) {
+			return nil, http.StatusInternalServerError, dummyError
+		}
+		webhook := newWebhookWithOptions(client, WithDefaultCredSpec(true))
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, response)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusInternalServerError, dummyError.Error())
+	})
+}
@@ -17,7 +17,7 @@ This script:
  * deploys a k8s service running the webhook
  * registers that service as a webhook admission controller
 
-usage: $0 --file MANIFESTS_FILE [--name NAME] [--namespace NAMESPACE] [--image IMAGE_NAME] [--certs-dir CERTS_DIR] [--dry-run] [--overwrite] [--tolerate-master]
+usage: $0 --file MANIFESTS_FILE [--name NAME] [--namespace NAMESPACE] [--image IMAGE_NAME] [--certs-dir CERTS_DIR] [--dry-run] [--overwrite] [--tolerate-master] [--validate-workloads]
 
 MANIFESTS_FILE is the path to the file the k8s manifests will be written to.
 NAME defaults to 'gmsa-webhook' and is used in the names of most of the k8s resources created.
@@ -30,6 +30,11 @@ without actually affecting the k8s cluster.
 If the files this script generates already exist and --overwrite is
 not set, it will not regenerate the files.
 If --tolerate-master is set, the webhook will tolerate running on master nodes.
+If --validate-workloads is set, deployments, statefulsets, daemonsets, replicasets, jobs
+and cronjobs get their pod templates' GMSA settings validated on creation and update.
+
+The webhook's other opt-in features, e.g. cluster-wide unique hostnames, can only be
+enabled when deploying with the Helm chart.
 EOF
     exit 1
 }
@@ -71,7 +76,7 @@ write_manifests_file() {
         # due to a bug in --env-file convert varaibles we care about to -e parameters 
         # The sed commands get only the env names before =, clean any white space, add -e to them, then make it all one line
         # https://github.com/moby/moby/issues/12997#issuecomment-307665540
-        ENVS=`env | grep -E 'NAME|NAMESPACE|TLS|RBAC|TOLERATIONS|IMAGE|CA' | sed -n '/^[^\t]/s/=.*//p' | sed '/^$/d' | sed 's/^/-e /g' | tr '\n' ' '`
+        ENVS=`env | grep -E 'NAME|NAMESPACE|TLS|RBAC|TOLERATIONS|WORKLOAD_RULES|IMAGE|CA' | sed -n '/^[^\t]/s/=.*//p' | sed '/^$/d' | sed 's/^/-e /g' | tr '\n' ' '`
 
         # envsubst is installed in the nginx images which we already maintain
         docker run --rm -v "$TEMPLATE_PATH:$TEMPLATE_PATH" $ENVS registry.k8s.io/e2e-test-images/nginx:1.15-1 sh -c "cat $TEMPLATE_PATH | envsubst" > $MANIFESTS_FILE
@@ -89,6 +94,7 @@ main() {
     local DRY_RUN=false
     local OVERWRITE=false
     local TOLERATE_MASTER=false
+    local VALIDATE_WORKLOADS=false
 
     # parse arguments
     while [[ $# -gt 0 ]]; do
@@ -109,6 +115,8 @@ main() {
                 OVERWRITE=true && shift ;;
             --tolerate-master)
                 TOLERATE_MASTER=true && shift ;;
+            --validate-workloads)
+                VALIDATE_WORKLOADS=true && shift ;;
             *)
                 echo "Unknown option: $1"
                 usage ;;
@@ -170,6 +178,19 @@ main() {
         effect: NoSchedule'
     fi
 
+    WORKLOAD_RULES=''
+    if $VALIDATE_WORKLOADS; then
+        WORKLOAD_RULES='
+  - operations: ["CREATE", "UPDATE"]
+    apiGroups: ["apps"]
+    apiVersions: ["v1"]
+    resources: ["deployments", "statefulsets", "daemonsets", "replicasets"]
+  - operations: ["CREATE", "UPDATE"]
+    apiGroups: ["batch"]
+    apiVersions: ["v1"]
+    resources: ["jobs", "cronjobs"]'
+    fi
+
     if [ -f "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt" ]; then
         info 'using pod based authentication'
         BUNDLE=$(cat /var/run/secrets/kubernetes.io/serviceaccount/ca.crt | base64 | tr -d '\n')
@@ -190,6 +211,7 @@ main() {
         NAMESPACE="$NAMESPACE" \
         IMAGE_NAME="$IMAGE_NAME" \
         TOLERATIONS="$TOLERATIONS" \
+        WORKLOAD_RULES="$WORKLOAD_RULES" \
         write_manifests_file "$TEMPLATE_PATH" "$MANIFESTS_FILE"
 
     echo_or_run --with-kubectl-dry-run "$KUBECTL apply -f $MANIFESTS_FILE"
@@ -44,6 +44,12 @@ rules:
 - apiGroups: ["authorization.k8s.io"]
   resources: ["localsubjectaccessreviews"]
   verbs: ["create"]
+- apiGroups: [""]
+  resources: ["serviceaccounts"]
+  verbs: ["get"]
+- apiGroups: [""]
+  resources: ["namespaces"]
+  verbs: ["get", "list", "watch"]
 
 ---
 
@@ -144,7 +150,7 @@ webhooks:
   - operations: ["CREATE", "UPDATE"]
     apiGroups: [""]
     apiVersions: ["*"]
-    resources: ["pods"]
+    resources: ["pods", "pods/ephemeralcontainers"]${WORKLOAD_RULES}
   failurePolicy: Fail
   admissionReviewVersions: ["v1", "v1beta1"]
   sideEffects: None
@@ -174,6 +180,10 @@ webhooks:
     apiGroups: [""]
     apiVersions: ["*"]
     resources: ["pods"]
+  - operations: ["UPDATE"]
+    apiGroups: [""]
+    apiVersions: ["*"]
+    resources: ["pods/ephemeralcontainers"]
   failurePolicy: Fail
   admissionReviewVersions: ["v1", "v1beta1"]
   sideEffects: None
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// gmsaPolicyResourceName is the resource name of the cluster-scoped GMSAPolicy Custom Resource Definition,
+// in the same API group and version as cred specs.
+const gmsaPolicyResourceName = "gmsapolicies"
+
+// gmsaPolicy is a GMSAPolicy resource: it restricts which pods may use the cred specs it applies to, on top of
+// their service accounts being authorized to `use` them.
+type gmsaPolicy struct {
+	name string
+	spec gmsaPolicySpec
+}
+
+// gmsaPolicySpec is the spec of a GMSAPolicy; unset fields don't restrict anything.
+type gmsaPolicySpec struct {
+	// CredSpecNames and CredSpecSelector select the cred specs that the policy applies to: those named, and
+	// those whose labels match; if neither is set, the policy applies to all cred specs.
+	CredSpecNames    []string              `json:"credSpecNames,omitempty"`
+	CredSpecSelector *metav1.LabelSelector `json:"credSpecSelector,omitempty"`
+
+	// NamespaceSelector and PodSelector restrict, by their labels, the namespaces and the pods allowed to use
+	// these cred specs.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	PodSelector       *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// ServiceAccountNames restricts the service accounts allowed to use these cred specs, as glob patterns,
+	// e.g. `web-*`.
+	ServiceAccountNames []string `json:"serviceAccountNames,omitempty"`
+	// ImageRegistries restricts the images of the containers using these cred specs to those from the given
+	// registries, optionally followed by a repository prefix, e.g. `mcr.microsoft.com` or `contoso.azurecr.io/web`.
+	ImageRegistries []string `json:"imageRegistries,omitempty"`
+}
+
+// appliesTo returns true iff the policy applies to the given cred spec. Policies with an invalid cred spec
+// selector apply to all cred specs, and don't allow any pod to use them, see mismatch.
+func (policy *gmsaPolicy) appliesTo(credSpec *gmsaCredSpec) bool {
+	if len(policy.spec.CredSpecNames) == 0 && policy.spec.CredSpecSelector == nil {
+		return true
+	}
+	if containsString(policy.spec.CredSpecNames, credSpec.name) {
+		return true
+	}
+	if policy.spec.CredSpecSelector != nil {
+		matches, err := selectorMatches(policy.spec.CredSpecSelector, credSpec.labels)
+		return matches || err != nil
+	}
+	return false
+}
+
+// mismatch returns why the policy doesn't allow the pod to use the cred specs it applies to, for containers
+// running the given images; or an empty string if it does allow it.
+func (policy *gmsaPolicy) mismatch(pod *corev1.Pod, namespaceName string, namespace *corev1.Namespace, images []string) string {
+	if _, err := selectorMatches(policy.spec.CredSpecSelector, nil); err != nil {
+		return fmt.Sprintf("its cred spec selector is invalid: %v", err)
+	}
+
+	var namespaceLabels map[string]string
+	if namespace != nil {
+		namespaceLabels = namespace.Labels
+	}
+	if matches, err := selectorMatches(policy.spec.NamespaceSelector, namespaceLabels); err != nil {
+		return fmt.Sprintf("its namespace selector is invalid: %v", err)
+	} else if !matches {
+		return fmt.Sprintf("namespace %q does not match its namespace selector", namespaceName)
+	}
+
+	if matches, err := selectorMatches(policy.spec.PodSelector, pod.Labels); err != nil {
+		return fmt.Sprintf("its pod selector is invalid: %v", err)
+	} else if !matches {
+		return "the pod does not match its pod selector"
+	}
+
+	if len(policy.spec.ServiceAccountNames) != 0 && !matchesAnyPattern(policy.spec.ServiceAccountNames, pod.Spec.ServiceAccountName) {
+		return fmt.Sprintf("service account %q does not match any of its service account names: %s",
+			pod.Spec.ServiceAccountName, strings.Join(policy.spec.ServiceAccountNames, ", "))
+	}
+
+	if len(policy.spec.ImageRegistries) != 0 {
+		for _, image := range images {
+			if !isImageFromRegistries(image, policy.spec.ImageRegistries) {
+				return fmt.Sprintf("image %q is not from any of its image registries: %s", image, strings.Join(policy.spec.ImageRegistries, ", "))
+			}
+		}
+	}
+
+	return ""
+}
+
+// checkGMSAPolicies checks that the GMSAPolicies applying to the cred spec, if any, allow the pod or container
+// to use it: at least one of them has to. It returns a violation if none does, along with why.
+func (webhook *webhook) checkGMSAPolicies(ctx context.Context, pod *corev1.Pod, namespace string, credSpecs *credSpecCache, resourceKind gmsaResourceKind, resourceName string, containerIndex int, credSpecName string, field string) *podAdmissionError {
+	policies, code, err := credSpecs.gmsaPolicies(ctx)
+	if err != nil {
+		return &podAdmissionError{error: err, pod: pod, code: code}
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+
+	credSpec, code, err := credSpecs.get(ctx, credSpecName)
+	if err != nil {
+		reason := credSpecInvalidReason
+		if code == http.StatusNotFound {
+			reason = credSpecNotFoundReason
+		}
+		return &podAdmissionError{error: err, pod: pod, code: code, reason: reason, field: field}
+	}
+
+	ns, code, err := webhook.client.retrieveNamespace(ctx, namespace)
+	if err != nil && code != http.StatusNotFound {
+		return &podAdmissionError{error: err, pod: pod, code: code}
+	}
+	images := resourceImages(pod, resourceKind, containerIndex)
+
+	var mismatches []string
+	for i := range policies {
+		policy := &policies[i]
+		if !policy.appliesTo(credSpec) {
+			continue
+		}
+		mismatch := policy.mismatch(pod, namespace, ns, images)
+		if mismatch == "" {
+			return nil
+		}
+		mismatches = append(mismatches, fmt.Sprintf("GMSAPolicy %q: %s", policy.name, mismatch))
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%s %q is not allowed to use GMSA cred spec %q by any of the GMSAPolicies applying to it: %s",
+		resourceKind, resourceName, credSpecName, strings.Join(mismatches, "; "))
+	return &podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusForbidden, reason: credSpecUseNotAllowedByPolicyReason, field: field}
+}
+
+// gmsaPolicies returns all the GMSAPolicies, only listing them the first time.
+// If it returns an error, it also returns the corresponding HTTP code; errors don't get cached.
+func (cache *credSpecCache) gmsaPolicies(ctx context.Context) ([]gmsaPolicy, int, error) {
+	if cache.policies != nil {
+		return cache.policies, 0, nil
+	}
+
+	policies, code, err := cache.client.listGMSAPolicies(ctx)
+	if err != nil {
+		return nil, code, err
+	}
+	if policies == nil {
+		policies = []gmsaPolicy{}
+	}
+	cache.policies = policies
+	return policies, code, nil
+}
+
+// selectorMatches returns true iff the label selector matches the labels; nil selectors match everything.
+func selectorMatches(selector *metav1.LabelSelector, objectLabels map[string]string) (bool, error) {
+	if selector == nil {
+		return true, nil
+	}
+	parsedSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false, err
+	}
+	return parsedSelector.Matches(labels.Set(objectLabels)), nil
+}
+
+// matchesAnyPattern returns true iff the name matches any of the glob patterns.
+func matchesAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isImageFromRegistries returns true iff the image's repository is in one of the registries, or repository
+// prefixes, given; see normalizeImagePrefix for how they get compared.
+func isImageFromRegistries(image string, registries []string) bool {
+	repository := imageRepository(image)
+	for _, registry := range registries {
+		prefix, valid := normalizeImagePrefix(registry)
+		if valid && (repository == prefix || strings.HasPrefix(repository, prefix+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeImagePrefix returns the fully qualified form of a registry, e.g. `mcr.microsoft.com`, or of a
+// repository or repository prefix, e.g. `docker.io/library/nginx` for `nginx`, so that it can be compared
+// with imageRepository's results. Tags being mutable, prefixes with a tag, e.g. `nginx:latest`, aren't valid.
+func normalizeImagePrefix(prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.Contains(prefix, "/") {
+		if host, _, _ := strings.Cut(prefix, ":"); strings.Contains(host, ".") || host == "localhost" {
+			return strings.ToLower(prefix), true
+		}
+	}
+	if i := strings.LastIndex(prefix, ":"); i > strings.LastIndex(prefix, "/") {
+		return "", false
+	}
+	return imageRepository(prefix), true
+}
+
+// imageRepository returns the fully qualified repository of a container image, the way container runtimes
+// resolve it, e.g. `docker.io/library/nginx` for `nginx:latest`.
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i != -1 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	domain, remainder, found := strings.Cut(image, "/")
+	switch {
+	case !found:
+		return "docker.io/library/" + image
+	case !strings.ContainsAny(domain, ".:") && domain != "localhost":
+		return "docker.io/" + image
+	case strings.ToLower(domain) == "docker.io" && !strings.Contains(remainder, "/"):
+		return "docker.io/library/" + remainder
+	default:
+		return strings.ToLower(domain) + "/" + remainder
+	}
+}
+
+// resourceImages returns the images of the containers that a pod's or a container's GMSA settings apply to:
+// for the former, those of the pod's containers that run with the pod's cred spec, see effectiveCredSpecName.
+func resourceImages(pod *corev1.Pod, resourceKind gmsaResourceKind, containerIndex int) []string {
+	switch resourceKind {
+	case initContainerKind:
+		return []string{pod.Spec.InitContainers[containerIndex].Image}
+	case containerKind:
+		return []string{pod.Spec.Containers[containerIndex].Image}
+	case ephemeralContainerKind:
+		return []string{pod.Spec.EphemeralContainers[containerIndex].Image}
+	}
+
+	podCredSpecName := effectiveCredSpecName(pod, podContainer{})
+	var images []string
+	for _, container := range podContainers(pod) {
+		if effectiveCredSpecName(pod, container) == podCredSpecName {
+			images = append(images, container.image)
+		}
+	}
+	return images
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestImageRepository(t *testing.T) {
+	for image, expected := range map[string]string{
+		"nginx":       "docker.io/library/nginx",
+		"nginx:1.27":  "docker.io/library/nginx",
+		"contoso/web": "docker.io/contoso/web",
+		"mcr.microsoft.com/windows/servercore:ltsc2022": "mcr.microsoft.com/windows/servercore",
+		"Contoso.azurecr.io/web/app@sha256:0123abcd":    "contoso.azurecr.io/web/app",
+		"localhost:5000/app:v1":                         "localhost:5000/app",
+		"docker.io/nginx":                               "docker.io/library/nginx",
+	} {
+		assert.Equal(t, expected, imageRepository(image), image)
+	}
+
+	assert.True(t, isImageFromRegistries("contoso.azurecr.io/web/app:v1", []string{"mcr.microsoft.com", "contoso.azurecr.io/web/"}))
+	assert.False(t, isImageFromRegistries("contoso.azurecr.io/webapp:v1", []string{"contoso.azurecr.io/web"}))
+	assert.False(t, isImageFromRegistries("mcr.microsoft.com.evil.com/app", []string{"mcr.microsoft.com"}))
+	assert.True(t, isImageFromRegistries("nginx:1.25", []string{"nginx"}))
+	assert.True(t, isImageFromRegistries("contoso.azurecr.io/web/app", []string{"Contoso.azurecr.io/web"}))
+	assert.False(t, isImageFromRegistries("nginx:latest", []string{"nginx:latest"}))
+}
+
+func TestValidateCreateRequestGMSAPolicies(t *testing.T) {
+	kubeClientFactory := func(policies ...gmsaPolicy) *dummyKubeClient {
+		return &dummyKubeClient{
+			retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+				return &gmsaCredSpec{name: credSpecName, contents: dummyCredSpecContents, labels: map[string]string{"tier": "web"}}, http.StatusOK, nil
+			},
+			retrieveNamespaceFunc: func(ctx context.Context, name string) (*corev1.Namespace, int, error) {
+				return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"team": "web"}}}, http.StatusOK, nil
+			},
+			listGMSAPoliciesFunc: func(ctx context.Context) ([]gmsaPolicy, int, error) {
+				return policies, http.StatusOK, nil
+			},
+		}
+	}
+
+	buildPolicyPod := func() *corev1.Pod {
+		pod := buildPod("web-frontend", nil, map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents),
+		})
+		pod.Labels = map[string]string{"app": "web"}
+		pod.Spec.Containers[0].Image = "contoso.azurecr.io/web/frontend:v1"
+		pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "busybox"}}
+		return pod
+	}
+
+	webPolicy := gmsaPolicy{name: "web", spec: gmsaPolicySpec{
+		CredSpecSelector:    &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "web"}},
+		NamespaceSelector:   &metav1.LabelSelector{MatchLabels: map[string]string{"team": "web"}},
+		PodSelector:         &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		ServiceAccountNames: []string{"web-*"},
+		ImageRegistries:     []string{"contoso.azurecr.io/web"},
+	}}
+
+	validate := func(client *dummyKubeClient, pod *corev1.Pod) (bool, *podAdmissionError) {
+		response, err := newWebhookWithOptions(client, WithGMSAPolicies(true)).validateCreateRequest(context.Background(), pod, dummyNamespace)
+		return response != nil && response.Allowed, err
+	}
+
+	t.Run("without any policy, RBAC alone decides", func(t *testing.T) {
+		allowed, err := validate(kubeClientFactory(), buildPolicyPod())
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	})
+
+	t.Run("pods matching a policy are allowed", func(t *testing.T) {
+		allowed, err := validate(kubeClientFactory(webPolicy), buildPolicyPod())
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	})
+
+	t.Run("policies that don't apply to the cred spec are ignored", func(t *testing.T) {
+		otherPolicy := gmsaPolicy{name: "other", spec: gmsaPolicySpec{CredSpecNames: []string{"other-cred-spec"}, ServiceAccountNames: []string{"nobody"}}}
+
+		allowed, err := validate(kubeClientFactory(otherPolicy), buildPolicyPod())
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	})
+
+	t.Run("pods need to match only one of the policies applying to the cred spec", func(t *testing.T) {
+		strictPolicy := gmsaPolicy{name: "strict", spec: gmsaPolicySpec{ServiceAccountNames: []string{"nobody"}}}
+
+		allowed, err := validate(kubeClientFactory(strictPolicy, webPolicy), buildPolicyPod())
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	})
+
+	for description, testCase := range map[string]struct {
+		updatePod        func(pod *corev1.Pod)
+		expectedMismatch string
+	}{
+		"namespace": {
+			expectedMismatch: fmt.Sprintf("namespace %q does not match its namespace selector", dummyNamespace),
+		},
+		"pod": {
+			updatePod:        func(pod *corev1.Pod) { pod.Labels["app"] = "batch" },
+			expectedMismatch: "the pod does not match its pod selector",
+		},
+		"service account": {
+			updatePod:        func(pod *corev1.Pod) { pod.Spec.ServiceAccountName = "batch-job" },
+			expectedMismatch: `service account "batch-job" does not match any of its service account names: web-*`,
+		},
+		"image": {
+			updatePod:        func(pod *corev1.Pod) { pod.Spec.Containers[0].Image = "contoso.azurecr.io/batch/job:v1" },
+			expectedMismatch: `image "contoso.azurecr.io/batch/job:v1" is not from any of its image registries: contoso.azurecr.io/web`,
+		},
+	} {
+		t.Run(fmt.Sprintf("pods whose %s doesn't match the policy are denied", description), func(t *testing.T) {
+			pod := buildPolicyPod()
+			policy := webPolicy
+			if testCase.updatePod != nil {
+				testCase.updatePod(pod)
+			} else {
+				policy.spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"team": "batch"}}
+			}
+
+			allowed, err := validate(kubeClientFactory(policy), pod)
+			assert.False(t, allowed)
+			if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden,
+				"container %q is not allowed to use GMSA cred spec %q by any of the GMSAPolicies applying to it: GMSAPolicy %q: %s",
+				dummyContainerName, dummyCredSpecName, "web", testCase.expectedMismatch) {
+				assert.Equal(t, credSpecUseNotAllowedByPolicyReason, err.reason)
+				assert.Equal(t, "spec.containers[0].securityContext.windowsOptions.gmsaCredentialSpecName", err.field)
+			}
+		})
+	}
+
+	t.Run("pod-level GMSA settings require all of the pod's images to come from the policy's registries", func(t *testing.T) {
+		pod := buildPolicyPod()
+		pod.Spec.Containers[0].SecurityContext = nil
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{WindowsOptions: buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents)}
+
+		allowed, err := validate(kubeClientFactory(webPolicy), pod)
+		assert.False(t, allowed)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, `image "busybox" is not from any of its image registries`)
+	})
+
+	t.Run("pod-level GMSA settings don't restrict the images of containers using other cred specs", func(t *testing.T) {
+		policy := webPolicy
+		policy.spec.CredSpecSelector = nil
+		policy.spec.CredSpecNames = []string{dummyCredSpecName}
+
+		pod := buildPolicyPod()
+		pod.Spec.Containers[0].SecurityContext = nil
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{WindowsOptions: buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents)}
+		pod.Spec.InitContainers[0].SecurityContext = &corev1.SecurityContext{WindowsOptions: buildWindowsOptions("other-cred-spec", dummyCredSpecContents)}
+
+		allowed, err := validate(kubeClientFactory(policy), pod)
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	})
+
+	t.Run("policies with invalid selectors deny all pods", func(t *testing.T) {
+		invalidPolicy := gmsaPolicy{name: "invalid", spec: gmsaPolicySpec{CredSpecSelector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "tier", Operator: "Unknown"}},
+		}}}
+
+		pod := buildPolicyPod()
+		allowed, err := validate(kubeClientFactory(invalidPolicy), pod)
+		assert.False(t, allowed)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, `GMSAPolicy "invalid": its cred spec selector is invalid`)
+	})
+
+	t.Run("failing to list policies is an internal error", func(t *testing.T) {
+		client := kubeClientFactory()
+		client.listGMSAPoliciesFunc = func(ctx context.Context) ([]gmsaPolicy, int, error) {
+			return nil, http.StatusInternalServerError, fmt.Errorf("unable to list GMSA policies")
+		}
+
+		pod := buildPolicyPod()
+		_, err := validate(client, pod)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusInternalServerError, "unable to list GMSA policies")
+	})
+
+	t.Run("policies are ignored unless enabled", func(t *testing.T) {
+		client := kubeClientFactory()
+		client.listGMSAPoliciesFunc = func(ctx context.Context) ([]gmsaPolicy, int, error) {
+			t.Fatal("policies should not get listed")
+			return nil, 0, nil
+		}
+
+		response, err := newWebhook(client).validateCreateRequest(context.Background(), buildPolicyPod(), dummyNamespace)
+		assert.Nil(t, err)
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+	})
+}
+
+func TestValidateUpdateRequestGMSAPolicies(t *testing.T) {
+	client := &dummyKubeClient{
+		retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+			return &gmsaCredSpec{name: credSpecName, contents: dummyCredSpecContents}, http.StatusOK, nil
+		},
+		listGMSAPoliciesFunc: func(ctx context.Context) ([]gmsaPolicy, int, error) {
+			return []gmsaPolicy{{name: "web", spec: gmsaPolicySpec{ImageRegistries: []string{"contoso.azurecr.io/web"}}}}, http.StatusOK, nil
+		},
+	}
+
+	buildDebuggedPod := func(image string) (*corev1.Pod, *corev1.Pod) {
+		oldPod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+		oldPod.Spec.Containers[0].Image = "contoso.azurecr.io/web/frontend:v1"
+
+		pod := oldPod.DeepCopy()
+		pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{buildEphemeralContainer(dummyEphemeralContainerName, nil)}
+		pod.Spec.EphemeralContainers[0].Image = image
+		return pod, oldPod
+	}
+
+	t.Run("new ephemeral containers inheriting the pod's GMSA must be allowed by the policies", func(t *testing.T) {
+		pod, oldPod := buildDebuggedPod("busybox")
+
+		response, err := newWebhookWithOptions(client, WithGMSAPolicies(true)).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
+		assert.Nil(t, response)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden,
+			`ephemeral container %q is not allowed to use GMSA cred spec %q by any of the GMSAPolicies applying to it: GMSAPolicy "web": image "busybox" is not from any of its image registries`,
+			dummyEphemeralContainerName, dummyCredSpecName) {
+			assert.Equal(t, credSpecUseNotAllowedByPolicyReason, err.reason)
+			assert.Equal(t, "spec.securityContext.windowsOptions.gmsaCredentialSpecName", err.field)
+		}
+	})
+
+	t.Run("new ephemeral containers allowed by the policies pass", func(t *testing.T) {
+		pod, oldPod := buildDebuggedPod("contoso.azurecr.io/web/debug:v1")
+
+		response, err := newWebhookWithOptions(client, WithGMSAPolicies(true)).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
+		assert.Nil(t, err)
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+	})
+}
+
+func TestListGMSAPoliciesWithoutInformer(t *testing.T) {
+	policies, code, err := (&kubeClient{}).listGMSAPolicies(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, policies)
+
+	// until the CRD gets discovered, GMSA pods get denied
+	_, code, err = (&kubeClient{gmsaPoliciesWatched: true}).listGMSAPolicies(context.Background())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "GMSA policies are enabled, but the gmsapolicies CRD isn't installed")
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// HostnameStrategy names one of the ways the webhook can generate hostnames for GMSA pods.
+type HostnameStrategy string
+
+const (
+	// RandomHostnameStrategy generates random hostnames, after the prefix if any.
+	RandomHostnameStrategy HostnameStrategy = "random"
+	// WorkloadHostnameStrategy derives hostnames from the name of the pod's owner workload, plus a random suffix.
+	WorkloadHostnameStrategy HostnameStrategy = "workload"
+	// StatefulSetOrdinalHostnameStrategy derives hostnames from the name of the pod's StatefulSet, plus its ordinal.
+	StatefulSetOrdinalHostnameStrategy HostnameStrategy = "statefulset-ordinal"
+	// JobIndexHostnameStrategy derives hostnames from the name of the pod's indexed Job, plus its completion index.
+	JobIndexHostnameStrategy HostnameStrategy = "job-index"
+	// PodNameHashHostnameStrategy derives hostnames from a hash of the pod's namespace and name.
+	// Pods created with `generateName`, e.g. by Deployments, ReplicaSets and Jobs, don't have a name yet
+	// when they get mutated, so they fall back to random hostnames.
+	PodNameHashHostnameStrategy HostnameStrategy = "pod-name-hash"
+)
+
+// InvalidHostnameMode is how the webhook handles GMSA pods setting a hostname that's not a valid NetBIOS name.
+type InvalidHostnameMode string
+
+const (
+	// DenyInvalidHostnames denies such pods; it's the default.
+	DenyInvalidHostnames InvalidHostnameMode = "deny"
+	// WarnInvalidHostnames admits such pods, with a warning; it has to be opted into explicitly, e.g. for
+	// clusters that still run such pods.
+	WarnInvalidHostnames InvalidHostnameMode = "warn"
+	// TruncateInvalidHostnames truncates hostnames that are too long, and denies pods whose hostnames are still
+	// not valid NetBIOS names.
+	TruncateInvalidHostnames InvalidHostnameMode = "truncate"
+	// NormalizeInvalidHostnames lower-cases hostnames, replaces characters that can't be used, prefixes all-digits
+	// hostnames with a letter, and truncates them.
+	NormalizeInvalidHostnames InvalidHostnameMode = "normalize"
+)
+
+var invalidHostnameModes = []InvalidHostnameMode{DenyInvalidHostnames, WarnInvalidHostnames, TruncateInvalidHostnames, NormalizeInvalidHostnames}
+
+const (
+	// maxNetBIOSNameLength is the maximum length of a NetBIOS computer name, which is what a GMSA
+	// pod's hostname gets used as when authenticating against the domain
+	maxNetBIOSNameLength = 15
+
+	// minRandomHostnameSuffixLength is the minimum number of random characters in hostnames that have some,
+	// to keep collisions unlikely
+	minRandomHostnameSuffixLength = 5
+
+	// hostnameStrategyAnnotation and hostnamePrefixAnnotation can be set on GMSA cred specs and namespaces
+	// to configure how hostnames get generated for pods using these cred specs, respectively in these
+	// namespaces; cred specs take precedence over namespaces, which take precedence over the global settings
+	hostnameStrategyAnnotation = "windows.k8s.io/gmsa-hostname-strategy"
+	hostnamePrefixAnnotation   = "windows.k8s.io/gmsa-hostname-prefix"
+
+	// these are set by the built-in StatefulSet and Job controllers
+	statefulSetPodIndexLabel     = "apps.kubernetes.io/pod-index"
+	jobCompletionIndexAnnotation = "batch.kubernetes.io/job-completion-index"
+	jobNameLabel                 = "batch.kubernetes.io/job-name"
+	podTemplateHashLabel         = "pod-template-hash"
+
+	hostnameAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// hostnameGenerator generates hostnames for GMSA pods that don't set one themselves.
+type hostnameGenerator interface {
+	// generate returns a NetBIOS-compliant hostname for the pod, starting with `prefix` if not empty,
+	// or an empty string if the strategy doesn't apply to that pod.
+	generate(pod *corev1.Pod, namespace, prefix string) string
+}
+
+var hostnameGenerators = map[HostnameStrategy]hostnameGenerator{
+	RandomHostnameStrategy:             randomHostnameGenerator{},
+	WorkloadHostnameStrategy:           workloadHostnameGenerator{},
+	StatefulSetOrdinalHostnameStrategy: statefulSetOrdinalHostnameGenerator{},
+	JobIndexHostnameStrategy:           jobIndexHostnameGenerator{},
+	PodNameHashHostnameStrategy:        podNameHashHostnameGenerator{},
+}
+
+// parseHostnameStrategy returns an error if `strategy` is not a known hostname strategy.
+func parseHostnameStrategy(strategy string) (HostnameStrategy, error) {
+	if _, known := hostnameGenerators[HostnameStrategy(strategy)]; !known {
+		strategies := make([]string, 0, len(hostnameGenerators))
+		for known := range hostnameGenerators {
+			strategies = append(strategies, string(known))
+		}
+		sort.Strings(strategies)
+		return "", fmt.Errorf("unknown hostname strategy %q, known strategies are: %s", strategy, strings.Join(strategies, ", "))
+	}
+	return HostnameStrategy(strategy), nil
+}
+
+// parseInvalidHostnameMode returns an error if `mode` is not a known invalid hostname mode.
+func parseInvalidHostnameMode(mode string) (InvalidHostnameMode, error) {
+	modes := make([]string, len(invalidHostnameModes))
+	for i, known := range invalidHostnameModes {
+		if InvalidHostnameMode(mode) == known {
+			return known, nil
+		}
+		modes[i] = string(known)
+	}
+	return "", fmt.Errorf("unknown invalid hostname mode %q, known modes are: %s", mode, strings.Join(modes, ", "))
+}
+
+type randomHostnameGenerator struct{}
+
+func (randomHostnameGenerator) generate(_ *corev1.Pod, _, prefix string) string {
+	return withRandomSuffix(prefix)
+}
+
+type workloadHostnameGenerator struct{}
+
+func (workloadHostnameGenerator) generate(pod *corev1.Pod, _, prefix string) string {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return ""
+	}
+
+	workloadName := owner.Name
+	// pods owned by a deployment's replica set get named after the deployment
+	if hash := pod.Labels[podTemplateHashLabel]; owner.Kind == "ReplicaSet" && hash != "" {
+		workloadName = strings.TrimSuffix(workloadName, "-"+hash)
+	}
+
+	return withRandomSuffix(prefix + workloadName)
+}
+
+type statefulSetOrdinalHostnameGenerator struct{}
+
+func (statefulSetOrdinalHostnameGenerator) generate(pod *corev1.Pod, _, prefix string) string {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" {
+		return ""
+	}
+
+	ordinal := pod.Labels[statefulSetPodIndexLabel]
+	if ordinal == "" && strings.HasPrefix(pod.Name, owner.Name+"-") {
+		// older clusters don't set the index label, but stateful pods are always named `<statefulset>-<ordinal>`
+		ordinal = strings.TrimPrefix(pod.Name, owner.Name+"-")
+	}
+	if !isDigits(ordinal) {
+		return ""
+	}
+
+	return withSuffix(prefix+owner.Name, ordinal)
+}
+
+type jobIndexHostnameGenerator struct{}
+
+func (jobIndexHostnameGenerator) generate(pod *corev1.Pod, _, prefix string) string {
+	index := pod.Annotations[jobCompletionIndexAnnotation]
+	if !isDigits(index) {
+		return ""
+	}
+
+	jobName := pod.Labels[jobNameLabel]
+	if owner := metav1.GetControllerOf(pod); owner != nil && owner.Kind == "Job" {
+		jobName = owner.Name
+	}
+	if jobName == "" {
+		return ""
+	}
+
+	return withSuffix(prefix+jobName, index)
+}
+
+type podNameHashHostnameGenerator struct{}
+
+func (podNameHashHostnameGenerator) generate(pod *corev1.Pod, namespace, prefix string) string {
+	// the hash must differ between pods sharing the same `generateName`, which rules out hashing that instead
+	if pod.Name == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(namespace + "/" + pod.Name))
+	hash := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:]))
+
+	base := truncateHostname(sanitizeHostname(prefix), maxNetBIOSNameLength-minRandomHostnameSuffixLength-1)
+	if base == "" {
+		return sanitizeHostname(hash[:maxNetBIOSNameLength])
+	}
+	return base + "-" + hash[:maxNetBIOSNameLength-len(base)-1]
+}
+
+// withRandomSuffix returns `base`, sanitized and truncated to leave enough room, followed by random characters
+// up to the maximum NetBIOS name length.
+func withRandomSuffix(base string) string {
+	base = truncateHostname(sanitizeHostname(base), maxNetBIOSNameLength-minRandomHostnameSuffixLength-1)
+	if base == "" {
+		// start with a letter, to make sure the name isn't all digits
+		return randomString(1, hostnameAlphabet[:26]) + randomString(maxNetBIOSNameLength-1, hostnameAlphabet)
+	}
+	return base + "-" + randomString(maxNetBIOSNameLength-len(base)-1, hostnameAlphabet)
+}
+
+// withSuffix returns `base`, sanitized and truncated to leave enough room, followed by `suffix`.
+func withSuffix(base, suffix string) string {
+	base = truncateHostname(sanitizeHostname(base), maxNetBIOSNameLength-len(suffix)-1)
+	if base == "" {
+		return sanitizeHostname(suffix)
+	}
+	return base + "-" + suffix
+}
+
+// sanitizeHostname lower-cases `name`, and replaces runs of characters that can't be used in hostnames with
+// a single dash. Since NetBIOS names can't be all digits, these get prefixed with a letter.
+func sanitizeHostname(name string) string {
+	var builder strings.Builder
+	lastIsDash := true
+	for _, r := range strings.ToLower(name) {
+		if strings.ContainsRune(hostnameAlphabet, r) {
+			builder.WriteRune(r)
+			lastIsDash = false
+		} else if !lastIsDash {
+			builder.WriteRune('-')
+			lastIsDash = true
+		}
+	}
+
+	sanitized := strings.TrimRight(builder.String(), "-")
+	if isDigits(sanitized) {
+		sanitized = truncateHostname("n"+sanitized, maxNetBIOSNameLength)
+	}
+	return sanitized
+}
+
+// truncateHostname truncates a sanitized hostname to at most `maxLength` characters, making sure
+// it doesn't end with a dash.
+func truncateHostname(name string, maxLength int) string {
+	if maxLength < 0 {
+		maxLength = 0
+	}
+	if len(name) > maxLength {
+		name = name[:maxLength]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// invalidNetBIOSNameReason returns why `hostname` can't be used as a NetBIOS computer name, or an empty string
+// if it can.
+func invalidNetBIOSNameReason(hostname string) string {
+	switch {
+	case len(hostname) > maxNetBIOSNameLength:
+		return fmt.Sprintf("it is longer than %d characters", maxNetBIOSNameLength)
+	case isDigits(hostname):
+		return "it only contains digits"
+	case strings.HasPrefix(hostname, "-") || strings.HasSuffix(hostname, "-"):
+		return "it starts or ends with a hyphen"
+	case strings.Trim(strings.ToLower(hostname), hostnameAlphabet+"-") != "":
+		return "it contains characters other than letters, digits and hyphens"
+	default:
+		return ""
+	}
+}
+
+// invalidHostnameError returns an error explaining why the pod's hostname can't be used, or nil if it can.
+func invalidHostnameError(pod *corev1.Pod) *podAdmissionError {
+	if reason := invalidNetBIOSNameReason(pod.Spec.Hostname); reason != "" {
+		msg := fmt.Errorf("hostname %q can't be used by pods using GMSA's, as it's not a valid NetBIOS name: %s; "+
+			"use at most %d letters, digits and hyphens, not only digits", pod.Spec.Hostname, reason, maxNetBIOSNameLength)
+		return &podAdmissionError{error: msg, pod: pod, code: http.StatusUnprocessableEntity, reason: invalidNetBIOSHostnameReason, field: "spec.hostname"}
+	}
+	return nil
+}
+
+// isDigits returns true iff `s` is a non-empty string of decimal digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func randomString(length int, alphabet string) string {
+	bytes := make([]byte, length)
+	for i := range bytes {
+		bytes[i] = alphabet[rand.IntN(len(alphabet))]
+	}
+	return string(bytes)
+}
+
+// hostnamePatch returns the JSON patch setting the hostname of a GMSA pod that doesn't set one, generated
+// with the strategy and prefix configured on the pod itself if its namespace allows it, or failing that on
+// the GMSA cred specs it uses, or failing that on its namespace, or failing that globally. Strategies that
+// don't apply to the pod fall back to random hostnames, as do those generating a hostname that's already
+// reserved by another pod, if the hostname registry is enabled.
+// It also returns warnings about invalid strategies found in annotations.
+// The pod itself gets updated too.
+func (webhook *webhook) hostnamePatch(ctx context.Context, pod *corev1.Pod, namespace string, settings *podSettings, credSpecs *credSpecCache) (*jsonPatchOperation, []string, *podAdmissionError) {
+	strategy, prefix := webhook.config.HostnameStrategy, webhook.config.HostnamePrefix
+	var warnings []string
+
+	// annotations from the first sources that define them win
+	strategyFound, prefixFound := false, false
+	applyAnnotations := func(annotations map[string]string, source string) {
+		if value, present := annotations[hostnameStrategyAnnotation]; present && !strategyFound {
+			if parsed, err := parseHostnameStrategy(strings.TrimSpace(value)); err == nil {
+				strategy, strategyFound = parsed, true
+			} else {
+				warnings = append(warnings, fmt.Sprintf("ignoring the %s annotation on %s: %v", hostnameStrategyAnnotation, source, err))
+			}
+		}
+		if value, present := annotations[hostnamePrefixAnnotation]; present && !prefixFound {
+			prefix, prefixFound = value, true
+		}
+	}
+
+	podOverrides := make(map[string]string)
+	for _, annotation := range []string{hostnameStrategyAnnotation, hostnamePrefixAnnotation} {
+		if value, present := pod.Annotations[annotation]; present && settings.allowsPodOverride(annotation) {
+			podOverrides[annotation] = value
+		}
+	}
+	applyAnnotations(podOverrides, "the pod")
+
+	for _, credSpecName := range credSpecNames(pod) {
+		credSpec, code, err := credSpecs.get(ctx, credSpecName)
+		if err != nil {
+			return nil, nil, &podAdmissionError{error: err, pod: pod, code: code}
+		}
+		applyAnnotations(credSpec.annotations, fmt.Sprintf("GMSA cred spec %q", credSpecName))
+	}
+
+	if settings.namespace != nil {
+		applyAnnotations(settings.namespace.Annotations, fmt.Sprintf("namespace %q", namespace))
+	}
+
+	if strategy == "" {
+		strategy = RandomHostnameStrategy
+	}
+	generator := hostnameGenerators[strategy]
+
+	var hostname string
+	for attempt := 1; ; attempt++ {
+		hostname = generator.generate(pod, namespace, prefix)
+		if hostname == "" {
+			logrus.Debugf("hostname strategy %q does not apply to pod %q in namespace %q, falling back to a random hostname", strategy, pod.Name, namespace)
+			generator = randomHostnameGenerator{}
+			hostname = generator.generate(pod, namespace, prefix)
+		}
+
+		reserved, err := webhook.reserveHostname(ctx, pod, namespace, hostname)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reserved {
+			break
+		}
+		if attempt >= maxHostnameReservationAttempts {
+			msg := fmt.Errorf("unable to generate a hostname that's not already in use after %d attempts", attempt)
+			return nil, nil, &podAdmissionError{error: msg, pod: pod, code: http.StatusConflict}
+		}
+
+		logrus.Infof("hostname %q is already in use, generating another one for pod %q in namespace %q", hostname, pod.Name, namespace)
+		if _, isRandom := generator.(randomHostnameGenerator); !isRandom {
+			// other strategies are deterministic
+			warnings = append(warnings, fmt.Sprintf("hostname %q generated with the %s strategy is already in use, using a random hostname instead", hostname, strategy))
+			generator = randomHostnameGenerator{}
+		}
+	}
+
+	pod.Spec.Hostname = hostname
+	return &jsonPatchOperation{Op: "add", Path: "/spec/hostname", Value: hostname}, warnings, nil
+}
+
+// explicitHostnamePatch returns the JSON patch fixing the hostname that a GMSA pod sets itself when it's not a valid
+// NetBIOS name, as configured by the invalid hostname mode, along with a warning. In the warn mode, it only returns
+// a warning. Hostnames that can't be fixed, or when the mode is to deny them, are left for the validating webhook
+// to handle according to the policy modes.
+// The pod itself gets updated too.
+func (webhook *webhook) explicitHostnamePatch(pod *corev1.Pod) (*jsonPatchOperation, []string) {
+	reason := invalidNetBIOSNameReason(pod.Spec.Hostname)
+	if reason == "" {
+		return nil, nil
+	}
+	if webhook.warnsOnInvalidHostnames() {
+		return nil, []string{invalidHostnameError(pod).Error()}
+	}
+
+	var hostname string
+	switch webhook.config.InvalidHostnameMode {
+	case TruncateInvalidHostnames:
+		hostname = truncateHostname(strings.ToLower(pod.Spec.Hostname), maxNetBIOSNameLength)
+	case NormalizeInvalidHostnames:
+		hostname = truncateHostname(sanitizeHostname(pod.Spec.Hostname), maxNetBIOSNameLength)
+	}
+	if hostname == "" || invalidNetBIOSNameReason(hostname) != "" {
+		return nil, nil
+	}
+
+	warning := fmt.Sprintf("hostname %q is not a valid NetBIOS name (%s), it was changed to %q", pod.Spec.Hostname, reason, hostname)
+	pod.Spec.Hostname = hostname
+	return &jsonPatchOperation{Op: "replace", Path: "/spec/hostname", Value: hostname}, []string{warning}
+}
+
+// warnsOnInvalidHostnames returns true iff GMSA pods setting a hostname that's not a valid NetBIOS name only
+// get a warning.
+func (webhook *webhook) warnsOnInvalidHostnames() bool {
+	return webhook.config.InvalidHostnameMode == WarnInvalidHostnames
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// hostnameLeasePrefix prefixes the names of the leases reserving GMSA pods' hostnames, one lease per hostname.
+	// Since creating an object that already exists fails, this guarantees that a hostname gets reserved by at most
+	// one pod at a time, even with several webhook replicas.
+	hostnameLeasePrefix = "gmsa-hostname-"
+
+	// hostnameReservationAnnotation is set by the mutating webhook, to the same random ID, on GMSA pods and on the
+	// leases reserving their hostnames. Pods created with `generateName`, e.g. by deployments or jobs, have neither
+	// a name nor a UID yet when they get mutated, so that ID is what ties a lease to its pod until the validating
+	// webhook binds the lease to the pod's name and UID, see reserveHostname.
+	hostnameReservationAnnotation = "windows.k8s.io/gmsa-hostname-reservation"
+
+	// hostnameLeasePodUIDAnnotation records the UID of the pod holding a hostname lease, once bound, to tell a pod
+	// that got re-created with the same name apart from the one that reserved the hostname
+	hostnameLeasePodUIDAnnotation = "windows.k8s.io/gmsa-pod-uid"
+
+	// hostnameReservationIDLength is the number of random characters in hostname reservation IDs.
+	hostnameReservationIDLength = 20
+
+	// hostnameReservationGracePeriod is how long a hostname lease is considered valid even if it hasn't been bound
+	// to a pod, or if the pod holding it can't be found, since the pod only gets persisted once all admission
+	// webhooks have accepted it; after that, leases whose pods never got created or didn't get released can be
+	// taken over.
+	hostnameReservationGracePeriod = time.Minute
+
+	// maxHostnameReservationAttempts bounds how many times we retry reserving a hostname when racing with other
+	// webhook replicas, respectively how many hostnames we try before giving up when they're already taken.
+	maxHostnameReservationAttempts = 5
+)
+
+type dryRunContextKey struct{}
+
+// withDryRun returns a context recording whether the admission request being handled is a dry run, in which case
+// the webhook must not have any side effect.
+func withDryRun(ctx context.Context, dryRun bool) context.Context {
+	return context.WithValue(ctx, dryRunContextKey{}, dryRun)
+}
+
+func isDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunContextKey{}).(bool)
+	return dryRun
+}
+
+func hostnameLeaseName(hostname string) string {
+	return hostnameLeasePrefix + strings.ToLower(hostname)
+}
+
+func hostnameLeaseHolder(pod *corev1.Pod, namespace string) string {
+	return namespace + "/" + pod.Name
+}
+
+// hostnameReservationPatches gives the pod a hostname reservation ID, unless it already has one, e.g. when
+// the mutating webhook gets re-invoked, and returns the corresponding JSON patches.
+// The pod itself gets updated too.
+func hostnameReservationPatches(pod *corev1.Pod) []jsonPatchOperation {
+	if pod.Annotations[hostnameReservationAnnotation] != "" {
+		return nil
+	}
+
+	var patches []jsonPatchOperation
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+		patches = append(patches, jsonPatchOperation{Op: "add", Path: "/metadata/annotations", Value: struct{}{}})
+	}
+	reservationID := randomString(hostnameReservationIDLength, hostnameAlphabet)
+	pod.Annotations[hostnameReservationAnnotation] = reservationID
+	return append(patches, jsonPatchOperation{Op: "add", Path: "/metadata/annotations/" + escapeJSONPointer(hostnameReservationAnnotation), Value: reservationID})
+}
+
+// reserveHostname reserves a hostname for the pod in the cluster-wide registry, if enabled. It returns false if
+// the hostname is already reserved by another pod.
+// The mutating webhook reserves hostnames under the pod's reservation ID, see hostnameReservationPatches; the
+// validating webhook, which sees the name and UID that the API server assigned to the pod, then calls this again
+// to bind the lease to them, so that it only becomes stale once that very pod is gone.
+// Dry runs only check whether the hostname is available.
+func (webhook *webhook) reserveHostname(ctx context.Context, pod *corev1.Pod, namespace, hostname string) (bool, *podAdmissionError) {
+	if !webhook.config.EnableUniqueHostnames {
+		return true, nil
+	}
+
+	holder := hostnameLeaseHolder(pod, namespace)
+	now := metav1.NewMicroTime(time.Now())
+	leaseName := hostnameLeaseName(hostname)
+	annotations := map[string]string{
+		hostnameReservationAnnotation: pod.Annotations[hostnameReservationAnnotation],
+		hostnameLeasePodUIDAnnotation: string(pod.UID),
+	}
+
+	for attempt := 0; attempt < maxHostnameReservationAttempts; attempt++ {
+		lease, code, err := webhook.client.retrieveLease(ctx, webhook.config.HostnameLeaseNamespace, leaseName)
+		if err != nil && code != http.StatusNotFound {
+			return false, &podAdmissionError{error: err, pod: pod, code: code}
+		}
+
+		if lease == nil {
+			if isDryRun(ctx) {
+				return true, nil
+			}
+
+			lease = &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        leaseName,
+					Namespace:   webhook.config.HostnameLeaseNamespace,
+					Annotations: annotations,
+				},
+				Spec: coordinationv1.LeaseSpec{HolderIdentity: &holder, AcquireTime: &now},
+			}
+			code, err = webhook.client.createLease(ctx, lease)
+		} else {
+			if !isHostnameLeaseOwner(lease, pod) {
+				stale, err := webhook.isStaleHostnameLease(ctx, lease, hostname)
+				if err != nil {
+					return false, err
+				}
+				if !stale {
+					return false, nil
+				}
+				logrus.Infof("taking over stale lease %s/%s for hostname %q", lease.Namespace, lease.Name, hostname)
+			} else if isHeldBy(lease, holder) && lease.Annotations[hostnameLeasePodUIDAnnotation] == string(pod.UID) {
+				// e.g. the mutating webhook getting re-invoked
+				return true, nil
+			}
+			if isDryRun(ctx) {
+				return true, nil
+			}
+
+			lease = lease.DeepCopy()
+			if lease.Annotations == nil {
+				lease.Annotations = map[string]string{}
+			}
+			for key, value := range annotations {
+				lease.Annotations[key] = value
+			}
+			lease.Spec.HolderIdentity = &holder
+			lease.Spec.AcquireTime = &now
+			code, err = webhook.client.updateLease(ctx, lease)
+		}
+
+		switch {
+		case err == nil:
+			return true, nil
+		case code == http.StatusConflict || code == http.StatusNotFound:
+			// another webhook replica modified the lease concurrently, look again
+			logrus.Debugf("conflict when reserving hostname %q: %v", hostname, err)
+		default:
+			return false, &podAdmissionError{error: err, pod: pod, code: code}
+		}
+	}
+
+	return false, nil
+}
+
+// isHostnameLeaseOwner returns true iff the hostname lease belongs to the pod: leases bound to a pod belong
+// to the pod with that UID, and unbound ones to the pod with the same reservation ID.
+func isHostnameLeaseOwner(lease *coordinationv1.Lease, pod *corev1.Pod) bool {
+	if uid := lease.Annotations[hostnameLeasePodUIDAnnotation]; uid != "" {
+		return uid == string(pod.UID)
+	}
+	reservationID := lease.Annotations[hostnameReservationAnnotation]
+	return reservationID != "" && reservationID == pod.Annotations[hostnameReservationAnnotation]
+}
+
+// isHeldBy returns true iff the lease is held by the given holder.
+func isHeldBy(lease *coordinationv1.Lease, holder string) bool {
+	return lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == holder
+}
+
+// isStaleHostnameLease returns true iff the hostname lease was acquired more than a grace period ago, and either
+// hasn't been bound to a pod, or the pod holding it doesn't exist any more, or doesn't use that hostname.
+func (webhook *webhook) isStaleHostnameLease(ctx context.Context, lease *coordinationv1.Lease, hostname string) (bool, *podAdmissionError) {
+	if lease.Spec.AcquireTime != nil && time.Since(lease.Spec.AcquireTime.Time) < hostnameReservationGracePeriod {
+		return false, nil
+	}
+	// leases that the validating webhook hasn't bound to a pod by now never will be
+	uid := lease.Annotations[hostnameLeasePodUIDAnnotation]
+	if lease.Spec.HolderIdentity == nil || uid == "" {
+		return true, nil
+	}
+
+	namespace, name, found := strings.Cut(*lease.Spec.HolderIdentity, "/")
+	if !found || name == "" {
+		return true, nil
+	}
+	holder, code, err := webhook.client.retrievePod(ctx, namespace, name)
+	if err != nil {
+		if code == http.StatusNotFound {
+			return true, nil
+		}
+		return false, &podAdmissionError{error: err, code: code}
+	}
+
+	if uid != string(holder.UID) {
+		return true, nil
+	}
+	return !strings.EqualFold(holder.Spec.Hostname, hostname), nil
+}
+
+// reserveExplicitHostname reserves the hostname that a GMSA pod sets itself, if the registry is enabled, and
+// denies the pod if that hostname is already in use.
+func (webhook *webhook) reserveExplicitHostname(ctx context.Context, pod *corev1.Pod, namespace string) *podAdmissionError {
+	reserved, err := webhook.reserveHostname(ctx, pod, namespace, pod.Spec.Hostname)
+	if err != nil {
+		return err
+	}
+	if !reserved {
+		msg := fmt.Errorf("hostname %q is already in use by another pod using GMSA's; GMSA pods need unique hostnames to authenticate against the domain", pod.Spec.Hostname)
+		return &podAdmissionError{error: msg, pod: pod, code: http.StatusConflict}
+	}
+	return nil
+}
+
+// releaseHostnameReservation releases the hostname that the mutating webhook reserved for a pod that then got
+// denied, provided the lease hasn't been bound to a pod since. Failures only get logged, as the lease eventually
+// becomes stale anyway.
+func (webhook *webhook) releaseHostnameReservation(ctx context.Context, pod *corev1.Pod, namespace string) {
+	reservationID := pod.Annotations[hostnameReservationAnnotation]
+	if !webhook.config.EnableUniqueHostnames || pod.Spec.Hostname == "" || reservationID == "" || !hasGMSASettings(pod) || isDryRun(ctx) {
+		return
+	}
+
+	lease, code, err := webhook.client.retrieveLease(ctx, webhook.config.HostnameLeaseNamespace, hostnameLeaseName(pod.Spec.Hostname))
+	if err != nil {
+		if code != http.StatusNotFound {
+			logrus.Warnf("unable to release hostname %q reserved for denied pod %s/%s: %v", pod.Spec.Hostname, namespace, pod.Name, err)
+		}
+		return
+	}
+	if lease.Annotations[hostnameLeasePodUIDAnnotation] != "" || lease.Annotations[hostnameReservationAnnotation] != reservationID {
+		return
+	}
+
+	if code, err := webhook.client.deleteLease(ctx, lease.Namespace, lease.Name, lease.ResourceVersion); err != nil && code != http.StatusNotFound {
+		logrus.Warnf("unable to release hostname %q reserved for denied pod %s/%s: %v", pod.Spec.Hostname, namespace, pod.Name, err)
+	}
+}
+
+// releaseHostname releases the hostname reserved by a GMSA pod that's being deleted, if the registry is enabled.
+// Pods usually keep running for their termination grace period after the first deletion request, so their
+// hostname only gets released once they're actually gone, see isFinalPodDeletion.
+// Failures only get logged, as they must not prevent deleting pods; leases that don't get released eventually
+// become stale and can be taken over.
+func (webhook *webhook) releaseHostname(ctx context.Context, pod *corev1.Pod, namespace string, options *metav1.DeleteOptions) {
+	if !webhook.config.EnableUniqueHostnames || pod.Spec.Hostname == "" || !hasGMSASettings(pod) || isDryRun(ctx) || !isFinalPodDeletion(pod, options) {
+		return
+	}
+
+	lease, code, err := webhook.client.retrieveLease(ctx, webhook.config.HostnameLeaseNamespace, hostnameLeaseName(pod.Spec.Hostname))
+	if err != nil {
+		if code != http.StatusNotFound {
+			logrus.Warnf("unable to release hostname %q of pod %s/%s: %v", pod.Spec.Hostname, namespace, pod.Name, err)
+		}
+		return
+	}
+	if !isHeldBy(lease, hostnameLeaseHolder(pod, namespace)) || lease.Annotations[hostnameLeasePodUIDAnnotation] != string(pod.UID) {
+		return
+	}
+
+	if code, err := webhook.client.deleteLease(ctx, lease.Namespace, lease.Name, lease.ResourceVersion); err != nil && code != http.StatusNotFound {
+		logrus.Warnf("unable to release hostname %q of pod %s/%s: %v", pod.Spec.Hostname, namespace, pod.Name, err)
+	}
+}
+
+// isFinalPodDeletion returns true iff deleting the pod with these options removes it right away, the same way
+// the API server decides whether to delete pods gracefully: unscheduled and terminated pods, as well as
+// deletions with a zero grace period, e.g. the kubelet's once the pod's containers have stopped, are final.
+func isFinalPodDeletion(pod *corev1.Pod, options *metav1.DeleteOptions) bool {
+	if options != nil && options.GracePeriodSeconds != nil && *options.GracePeriodSeconds == 0 {
+		return true
+	}
+	return pod.Spec.NodeName == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionV1 "k8s.io/api/admission/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const dummyLeaseNamespace = "gmsa-webhook"
+
+func buildHostnameLease(hostname, holder string, podUID types.UID, acquiredAgo time.Duration) *coordinationv1.Lease {
+	acquireTime := metav1.NewMicroTime(time.Now().Add(-acquiredAgo))
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            hostnameLeaseName(hostname),
+			Namespace:       dummyLeaseNamespace,
+			ResourceVersion: "1",
+			Annotations:     map[string]string{hostnameLeasePodUIDAnnotation: string(podUID)},
+		},
+		Spec: coordinationv1.LeaseSpec{HolderIdentity: &holder, AcquireTime: &acquireTime},
+	}
+}
+
+func leaseHolder(t *testing.T, client *dummyKubeClient, hostname string) string {
+	lease, present := client.leases[dummyLeaseNamespace+"/"+hostnameLeaseName(hostname)]
+	if !assert.True(t, present, "no lease for hostname %q", hostname) || !assert.NotNil(t, lease.Spec.HolderIdentity) {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func buildGMSAPod(hostname string) *corev1.Pod {
+	pod := buildPodWithHostName(dummyServiceAccoutName, &hostname, buildWindowsOptions(dummyCredSpecName, ""), nil)
+	pod.UID = "dummy-pod-uid"
+	return pod
+}
+
+// buildGeneratedNameGMSAPod builds a GMSA pod the way the mutating webhook sees pods created with `generateName`,
+// e.g. by deployments: without a name nor a UID.
+func buildGeneratedNameGMSAPod(hostname string) *corev1.Pod {
+	pod := buildGMSAPod(hostname)
+	pod.GenerateName = "dummy-deployment-"
+	pod.Name = ""
+	pod.UID = ""
+	return pod
+}
+
+func leaseAnnotation(t *testing.T, client *dummyKubeClient, hostname, key string) string {
+	lease, present := client.leases[dummyLeaseNamespace+"/"+hostnameLeaseName(hostname)]
+	if !assert.True(t, present, "no lease for hostname %q", hostname) {
+		return ""
+	}
+	return lease.Annotations[key]
+}
+
+func TestMutateCreateRequestReservesHostnames(t *testing.T) {
+	holder := dummyNamespace + "/" + dummyPodName
+
+	mutate := func(client *dummyKubeClient, pod *corev1.Pod, options ...WebhookOption) (*admissionV1.AdmissionResponse, *podAdmissionError) {
+		options = append([]WebhookOption{WithRandomHostname(true), WithUniqueHostnames(true, dummyLeaseNamespace)}, options...)
+		return newWebhookWithOptions(client, options...).mutateCreateRequest(context.Background(), pod, dummyNamespace)
+	}
+
+	t.Run("generated hostnames get reserved", func(t *testing.T) {
+		client := &dummyKubeClient{}
+		pod := buildGMSAPod("")
+
+		response, err := mutate(client, pod)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+
+		assert.Equal(t, holder, leaseHolder(t, client, pod.Spec.Hostname))
+		assert.Equal(t, 1, len(client.leases))
+		reservationID := pod.Annotations[hostnameReservationAnnotation]
+		assert.Len(t, reservationID, hostnameReservationIDLength)
+		assert.Equal(t, reservationID, leaseAnnotation(t, client, pod.Spec.Hostname, hostnameReservationAnnotation))
+
+		// being re-invoked for the same pod is fine
+		_, err = mutate(client, pod)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(client.leases))
+		assert.Equal(t, reservationID, pod.Annotations[hostnameReservationAnnotation])
+	})
+
+	t.Run("generated hostnames of pods without a name nor a UID yet don't collide", func(t *testing.T) {
+		client := &dummyKubeClient{}
+		webhook := newWebhookWithOptions(client, WithRandomHostname(true), WithUniqueHostnames(true, dummyLeaseNamespace), WithHostnameStrategy(JobIndexHostnameStrategy, ""))
+
+		// e.g. an indexed job's pod getting replaced while the previous one is still terminating
+		hostnames := make(map[string]bool)
+		for i := 0; i < 2; i++ {
+			pod := buildOwnedPod("", "Job", "db")
+			pod.Annotations = map[string]string{jobCompletionIndexAnnotation: "0"}
+			pod.Spec.SecurityContext = &corev1.PodSecurityContext{WindowsOptions: buildWindowsOptions(dummyCredSpecName, "")}
+
+			_, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+			require.Nil(t, err)
+			hostnames[pod.Spec.Hostname] = true
+		}
+		assert.Equal(t, 2, len(hostnames))
+		assert.True(t, hostnames["db-0"])
+	})
+
+	t.Run("hostnames already in use get re-generated", func(t *testing.T) {
+		client := &dummyKubeClient{}
+		lease := buildHostnameLease("db-0", "other-namespace/db-0", "other-uid", 0)
+		client.leases = map[string]*coordinationv1.Lease{lease.Namespace + "/" + lease.Name: lease}
+
+		pod := buildOwnedPod("db-0", "StatefulSet", "db")
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{WindowsOptions: buildWindowsOptions(dummyCredSpecName, "")}
+
+		ctx, warnings := withWarnings(context.Background())
+		webhook := newWebhookWithOptions(client, WithRandomHostname(true), WithUniqueHostnames(true, dummyLeaseNamespace), WithHostnameStrategy(StatefulSetOrdinalHostnameStrategy, ""))
+		response, err := webhook.mutateCreateRequest(ctx, pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+
+		assert.NotEqual(t, "db-0", pod.Spec.Hostname)
+		assert.Equal(t, maxNetBIOSNameLength, len(pod.Spec.Hostname))
+		assert.Equal(t, "other-namespace/db-0", leaseHolder(t, client, "db-0"))
+		assert.Equal(t, dummyNamespace+"/db-0", leaseHolder(t, client, pod.Spec.Hostname))
+		if assert.Equal(t, 1, len(warnings.list())) {
+			assert.Contains(t, warnings.list()[0], `hostname "db-0" generated with the statefulset-ordinal strategy is already in use`)
+		}
+	})
+
+	t.Run("explicit hostnames only get reserved once the pod has been validated", func(t *testing.T) {
+		client := &dummyKubeClient{}
+		pod := buildGMSAPod("my-host")
+
+		_, err := mutate(client, pod)
+		require.Nil(t, err)
+		assert.Equal(t, 0, len(client.leases))
+		assert.Len(t, pod.Annotations[hostnameReservationAnnotation], hostnameReservationIDLength)
+	})
+
+	t.Run("dry runs don't reserve anything", func(t *testing.T) {
+		client := &dummyKubeClient{}
+		webhook := newWebhookWithOptions(client, WithRandomHostname(true), WithUniqueHostnames(true, dummyLeaseNamespace))
+
+		response, err := webhook.mutateCreateRequest(withDryRun(context.Background(), true), buildGMSAPod(""), dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+		assert.Equal(t, 0, len(client.leases))
+	})
+
+	t.Run("nothing gets reserved when the registry is disabled", func(t *testing.T) {
+		client := &dummyKubeClient{}
+
+		_, err := mutate(client, buildGMSAPod("my-host"), WithUniqueHostnames(false, ""))
+		require.Nil(t, err)
+		assert.Equal(t, 0, len(client.leases))
+	})
+}
+
+func TestValidateCreateRequestReservesExplicitHostnames(t *testing.T) {
+	holder := dummyNamespace + "/" + dummyPodName
+
+	validate := func(client *dummyKubeClient, pod *corev1.Pod, options ...WebhookOption) (*admissionV1.AdmissionResponse, *podAdmissionError) {
+		options = append([]WebhookOption{WithRandomHostname(true), WithUniqueHostnames(true, dummyLeaseNamespace)}, options...)
+		return newWebhookWithOptions(client, options...).validateCreateRequest(context.Background(), pod, dummyNamespace)
+	}
+
+	t.Run("explicit hostnames get reserved", func(t *testing.T) {
+		client := &dummyKubeClient{}
+
+		_, err := validate(client, buildGMSAPod("my-host"))
+		require.Nil(t, err)
+		assert.Equal(t, holder, leaseHolder(t, client, "my-host"))
+	})
+
+	t.Run("explicit hostnames are reserved even when random hostnames are disabled", func(t *testing.T) {
+		client := &dummyKubeClient{}
+
+		_, err := validate(client, buildGMSAPod("my-host"), WithRandomHostname(false))
+		require.Nil(t, err)
+		assert.Equal(t, holder, leaseHolder(t, client, "my-host"))
+	})
+
+	t.Run("explicit hostnames already in use get denied", func(t *testing.T) {
+		client := &dummyKubeClient{}
+		lease := buildHostnameLease("my-host", "other-namespace/other-pod", "other-uid", 0)
+		client.leases = map[string]*coordinationv1.Lease{lease.Namespace + "/" + lease.Name: lease}
+
+		pod := buildGMSAPod("my-host")
+		response, err := validate(client, pod)
+		assert.Nil(t, response)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusConflict, `hostname "my-host" is already in use by another pod using GMSA's`)
+	})
+
+	t.Run("stale leases get taken over", func(t *testing.T) {
+		for name, retrievePodFunc := range map[string]func(ctx context.Context, namespace, name string) (*corev1.Pod, int, error){
+			"the holder doesn't exist": nil,
+			"the holder has been re-created": func(ctx context.Context, namespace, name string) (*corev1.Pod, int, error) {
+				return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "new-uid"}, Spec: corev1.PodSpec{Hostname: "my-host"}}, http.StatusOK, nil
+			},
+			"the holder uses another hostname": func(ctx context.Context, namespace, name string) (*corev1.Pod, int, error) {
+				return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "other-uid"}, Spec: corev1.PodSpec{Hostname: "another-host"}}, http.StatusOK, nil
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				client := &dummyKubeClient{retrievePodFunc: retrievePodFunc}
+				lease := buildHostnameLease("my-host", "other-namespace/other-pod", "other-uid", 2*hostnameReservationGracePeriod)
+				client.leases = map[string]*coordinationv1.Lease{lease.Namespace + "/" + lease.Name: lease}
+
+				_, err := validate(client, buildGMSAPod("my-host"))
+				require.Nil(t, err)
+				assert.Equal(t, holder, leaseHolder(t, client, "my-host"))
+			})
+		}
+	})
+
+	t.Run("leases that never got bound to a pod are stale after the grace period", func(t *testing.T) {
+		for name, testCase := range map[string]struct {
+			acquiredAgo time.Duration
+			stale       bool
+		}{
+			"within the grace period": {acquiredAgo: 0},
+			"after the grace period":  {acquiredAgo: 2 * hostnameReservationGracePeriod, stale: true},
+		} {
+			t.Run(name, func(t *testing.T) {
+				client := &dummyKubeClient{}
+				lease := buildHostnameLease("my-host", "other-namespace/", "", testCase.acquiredAgo)
+				lease.Annotations[hostnameReservationAnnotation] = "other-reservation"
+				client.leases = map[string]*coordinationv1.Lease{lease.Namespace + "/" + lease.Name: lease}
+
+				_, err := validate(client, buildGMSAPod("my-host"))
+				assert.Equal(t, testCase.stale, err == nil)
+				assert.Equal(t, !testCase.stale, leaseHolder(t, client, "my-host") == "other-namespace/")
+			})
+		}
+	})
+
+	t.Run("leases are not stale within the grace period, or while their holder still uses the hostname", func(t *testing.T) {
+		for name, acquiredAgo := range map[string]time.Duration{
+			"within the grace period": 0,
+			"after the grace period":  2 * hostnameReservationGracePeriod,
+		} {
+			t.Run(name, func(t *testing.T) {
+				client := &dummyKubeClient{
+					retrievePodFunc: func(ctx context.Context, namespace, name string) (*corev1.Pod, int, error) {
+						return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "other-uid"}, Spec: corev1.PodSpec{Hostname: "MY-HOST"}}, http.StatusOK, nil
+					},
+				}
+				lease := buildHostnameLease("my-host", "other-namespace/other-pod", "other-uid", acquiredAgo)
+				client.leases = map[string]*coordinationv1.Lease{lease.Namespace + "/" + lease.Name: lease}
+
+				_, err := validate(client, buildGMSAPod("my-host"))
+				assert.NotNil(t, err)
+				assert.Equal(t, "other-namespace/other-pod", leaseHolder(t, client, "my-host"))
+			})
+		}
+	})
+
+	t.Run("denied pods don't reserve their hostname", func(t *testing.T) {
+		client := &dummyKubeClient{
+			isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (bool, string) {
+				return false, ""
+			},
+		}
+
+		_, err := validate(client, buildGMSAPod("my-host"))
+		assert.NotNil(t, err)
+		assert.Equal(t, 0, len(client.leases))
+	})
+}
+
+func TestValidateCreateRequestBindsHostnameReservations(t *testing.T) {
+	newWebhook := func(client *dummyKubeClient) *webhook {
+		return newWebhookWithOptions(client, WithRandomHostname(true), WithUniqueHostnames(true, dummyLeaseNamespace))
+	}
+
+	// admit mimics the API server: it mutates a pod created with `generateName`, then assigns it
+	// a name and a UID before validating it
+	admit := func(t *testing.T, ctx context.Context, client *dummyKubeClient, pod *corev1.Pod, name string) (*admissionV1.AdmissionResponse, *podAdmissionError) {
+		_, err := newWebhook(client).mutateCreateRequest(ctx, pod, dummyNamespace)
+		require.Nil(t, err)
+
+		pod.Name = name
+		pod.UID = types.UID(name + "-uid")
+		return newWebhook(client).validateCreateRequest(ctx, pod, dummyNamespace)
+	}
+
+	t.Run("leases get bound to the pods' names and UIDs", func(t *testing.T) {
+		client := &dummyKubeClient{}
+		pod := buildGeneratedNameGMSAPod("")
+
+		response, err := admit(t, context.Background(), client, pod, "dummy-deployment-abcde")
+		require.Nil(t, err)
+		assert.True(t, response.Allowed)
+
+		assert.Equal(t, dummyNamespace+"/dummy-deployment-abcde", leaseHolder(t, client, pod.Spec.Hostname))
+		assert.Equal(t, "dummy-deployment-abcde-uid", leaseAnnotation(t, client, pod.Spec.Hostname, hostnameLeasePodUIDAnnotation))
+
+		// validating the same pod again is fine
+		response, err = newWebhook(client).validateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		assert.True(t, response.Allowed)
+	})
+
+	t.Run("pods can't take over hostnames bound to other pods by copying their reservation IDs", func(t *testing.T) {
+		client := &dummyKubeClient{}
+		pod := buildGeneratedNameGMSAPod("my-host")
+		_, err := admit(t, context.Background(), client, pod, "dummy-deployment-abcde")
+		require.Nil(t, err)
+
+		copycat := buildGeneratedNameGMSAPod("my-host")
+		copycat.Annotations = map[string]string{hostnameReservationAnnotation: pod.Annotations[hostnameReservationAnnotation]}
+		copycat.Name, copycat.UID = "copycat", "copycat-uid"
+		response, err := newWebhook(client).validateCreateRequest(context.Background(), copycat, dummyNamespace)
+		assert.Nil(t, response)
+		assertPodAdmissionErrorContains(t, err, copycat, http.StatusConflict, `hostname "my-host" is already in use by another pod using GMSA's`)
+		assert.Equal(t, dummyNamespace+"/dummy-deployment-abcde", leaseHolder(t, client, "my-host"))
+	})
+
+	t.Run("reservations of denied pods get released", func(t *testing.T) {
+		authorized := false
+		client := &dummyKubeClient{
+			isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (bool, string) {
+				return authorized, ""
+			},
+		}
+		pod := buildGeneratedNameGMSAPod("")
+
+		response, err := admit(t, context.Background(), client, pod, "dummy-deployment-abcde")
+		assert.Nil(t, response)
+		assert.NotNil(t, err)
+		assert.Equal(t, 0, len(client.leases))
+
+		// so that the corrected retry can use the same hostname
+		authorized = true
+		retry := buildGeneratedNameGMSAPod(pod.Spec.Hostname)
+		response, err = admit(t, context.Background(), client, retry, "dummy-deployment-fghij")
+		require.Nil(t, err)
+		assert.True(t, response.Allowed)
+		assert.Equal(t, dummyNamespace+"/dummy-deployment-fghij", leaseHolder(t, client, pod.Spec.Hostname))
+	})
+
+	t.Run("denied pods don't release hostnames bound to other pods", func(t *testing.T) {
+		client := &dummyKubeClient{}
+		pod := buildGeneratedNameGMSAPod("my-host")
+		_, err := admit(t, context.Background(), client, pod, "dummy-deployment-abcde")
+		require.Nil(t, err)
+
+		copycat := buildGeneratedNameGMSAPod("my-host")
+		copycat.Annotations = map[string]string{hostnameReservationAnnotation: pod.Annotations[hostnameReservationAnnotation]}
+		copycat.Spec.OS = &corev1.PodOS{Name: corev1.Linux}
+		copycat.Name, copycat.UID = "copycat", "copycat-uid"
+		_, err = newWebhook(client).validateCreateRequest(context.Background(), copycat, dummyNamespace)
+		assert.NotNil(t, err)
+		assert.Equal(t, dummyNamespace+"/dummy-deployment-abcde", leaseHolder(t, client, "my-host"))
+	})
+
+	t.Run("dry runs don't bind anything", func(t *testing.T) {
+		client := &dummyKubeClient{}
+		pod := buildGeneratedNameGMSAPod("")
+		_, err := newWebhook(client).mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+
+		pod.Name, pod.UID = "dummy-deployment-abcde", "dummy-deployment-abcde-uid"
+		response, err := newWebhook(client).validateCreateRequest(withDryRun(context.Background(), true), pod, dummyNamespace)
+		require.Nil(t, err)
+		assert.True(t, response.Allowed)
+		assert.Equal(t, dummyNamespace+"/", leaseHolder(t, client, pod.Spec.Hostname))
+	})
+}
+
+func TestValidateDeleteRequestReleasesHostnames(t *testing.T) {
+	deleteRequest := func(t *testing.T, pod *corev1.Pod, options *metav1.DeleteOptions) *admissionV1.AdmissionRequest {
+		podJSON, err := json.Marshal(pod)
+		require.Nil(t, err)
+		request := &admissionV1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: dummyNamespace,
+			Operation: admissionV1.Delete,
+			OldObject: runtime.RawExtension{Raw: podJSON},
+		}
+
+		if options != nil {
+			optionsJSON, err := json.Marshal(options)
+			require.Nil(t, err)
+			request.Options = runtime.RawExtension{Raw: optionsJSON}
+		}
+		return request
+	}
+
+	zero := int64(0)
+	thirty := int64(30)
+	scheduledPod := func(phase corev1.PodPhase) *corev1.Pod {
+		pod := buildGMSAPod("my-host")
+		pod.Spec.NodeName = "dummy-node"
+		pod.Status.Phase = phase
+		return pod
+	}
+
+	for name, testCase := range map[string]struct {
+		holder        string
+		podUID        types.UID
+		pod           *corev1.Pod
+		options       *metav1.DeleteOptions
+		shouldRelease bool
+	}{
+		"the pod's own lease gets released":                 {holder: dummyNamespace + "/" + dummyPodName, podUID: "dummy-pod-uid", shouldRelease: true},
+		"leases held by other pods don't get released":      {holder: "other-namespace/" + dummyPodName, podUID: "dummy-pod-uid"},
+		"leases held by re-created pods don't get released": {holder: dummyNamespace + "/" + dummyPodName, podUID: "new-uid"},
+		"leases that never got bound don't get released":    {holder: dummyNamespace + "/" + dummyPodName},
+		"running pods keep their hostname while terminating gracefully": {
+			holder: dummyNamespace + "/" + dummyPodName, podUID: "dummy-pod-uid",
+			pod: scheduledPod(corev1.PodRunning), options: &metav1.DeleteOptions{GracePeriodSeconds: &thirty},
+		},
+		"running pods release their hostname once deleted for good": {
+			holder: dummyNamespace + "/" + dummyPodName, podUID: "dummy-pod-uid",
+			pod: scheduledPod(corev1.PodRunning), options: &metav1.DeleteOptions{GracePeriodSeconds: &zero}, shouldRelease: true,
+		},
+		"terminated pods release their hostname right away": {
+			holder: dummyNamespace + "/" + dummyPodName, podUID: "dummy-pod-uid",
+			pod: scheduledPod(corev1.PodSucceeded), shouldRelease: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := &dummyKubeClient{}
+			lease := buildHostnameLease("my-host", testCase.holder, testCase.podUID, 0)
+			client.leases = map[string]*coordinationv1.Lease{lease.Namespace + "/" + lease.Name: lease}
+			webhook := newWebhookWithOptions(client, WithUniqueHostnames(true, dummyLeaseNamespace))
+
+			pod := testCase.pod
+			if pod == nil {
+				pod = buildGMSAPod("my-host")
+			}
+			response, err := webhook.validateOrMutate(context.Background(), deleteRequest(t, pod, testCase.options), validate)
+			require.Nil(t, err)
+			require.NotNil(t, response)
+			assert.True(t, response.Allowed)
+
+			_, present := client.leases[lease.Namespace+"/"+lease.Name]
+			assert.Equal(t, testCase.shouldRelease, !present)
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var netBIOSHostnameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,13}[a-z0-9])?$`)
+
+func assertNetBIOSHostname(t *testing.T, hostname string) bool {
+	return assert.Regexp(t, netBIOSHostnameRegexp, hostname) && assert.False(t, isDigits(hostname), "hostname %q is all digits", hostname)
+}
+
+func buildOwnedPod(name, ownerKind, ownerName string) *corev1.Pod {
+	isController := true
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:            name,
+		OwnerReferences: []metav1.OwnerReference{{Kind: ownerKind, Name: ownerName, Controller: &isController}},
+	}}
+}
+
+func TestHostnameGenerators(t *testing.T) {
+	t.Run("random", func(t *testing.T) {
+		hostname := randomHostnameGenerator{}.generate(&corev1.Pod{}, dummyNamespace, "")
+		assert.Equal(t, maxNetBIOSNameLength, len(hostname))
+		assertNetBIOSHostname(t, hostname)
+
+		hostname = randomHostnameGenerator{}.generate(&corev1.Pod{}, dummyNamespace, "Web_Front.End")
+		assert.Equal(t, maxNetBIOSNameLength, len(hostname))
+		assert.True(t, strings.HasPrefix(hostname, "web-front-"), hostname)
+		assertNetBIOSHostname(t, hostname)
+	})
+
+	t.Run("workload", func(t *testing.T) {
+		pod := buildOwnedPod("frontend-5d8f7b9c4-x2x7z", "ReplicaSet", "frontend-5d8f7b9c4")
+		pod.Labels = map[string]string{podTemplateHashLabel: "5d8f7b9c4"}
+
+		hostname := workloadHostnameGenerator{}.generate(pod, dummyNamespace, "")
+		assert.True(t, strings.HasPrefix(hostname, "frontend-"), hostname)
+		assert.Equal(t, maxNetBIOSNameLength, len(hostname))
+		assertNetBIOSHostname(t, hostname)
+
+		assert.Equal(t, "", workloadHostnameGenerator{}.generate(&corev1.Pod{}, dummyNamespace, ""))
+	})
+
+	t.Run("statefulset-ordinal", func(t *testing.T) {
+		assert.Equal(t, "db-3", statefulSetOrdinalHostnameGenerator{}.generate(buildOwnedPod("db-3", "StatefulSet", "db"), dummyNamespace, ""))
+		assert.Equal(t, "a-very-long-12", statefulSetOrdinalHostnameGenerator{}.generate(buildOwnedPod("a-very-long-statefulset-12", "StatefulSet", "a-very-long-statefulset"), dummyNamespace, ""))
+
+		pod := buildOwnedPod("renamed", "StatefulSet", "db")
+		pod.Labels = map[string]string{statefulSetPodIndexLabel: "7"}
+		assert.Equal(t, "gmsa-db-7", statefulSetOrdinalHostnameGenerator{}.generate(pod, dummyNamespace, "gmsa-"))
+
+		assert.Equal(t, "", statefulSetOrdinalHostnameGenerator{}.generate(buildOwnedPod("db-3", "ReplicaSet", "db"), dummyNamespace, ""))
+	})
+
+	t.Run("job-index", func(t *testing.T) {
+		pod := buildOwnedPod("batch-2-abcde", "Job", "batch")
+		pod.Annotations = map[string]string{jobCompletionIndexAnnotation: "2"}
+		assert.Equal(t, "batch-2", jobIndexHostnameGenerator{}.generate(pod, dummyNamespace, ""))
+
+		pod = &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Labels:      map[string]string{jobNameLabel: "12345"},
+			Annotations: map[string]string{jobCompletionIndexAnnotation: "0"},
+		}}
+		assert.Equal(t, "n12345-0", jobIndexHostnameGenerator{}.generate(pod, dummyNamespace, ""))
+
+		assert.Equal(t, "", jobIndexHostnameGenerator{}.generate(buildOwnedPod("batch-abcde", "Job", "batch"), dummyNamespace, ""))
+	})
+
+	t.Run("pod-name-hash", func(t *testing.T) {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: dummyPodName}}
+
+		hostname := podNameHashHostnameGenerator{}.generate(pod, dummyNamespace, "")
+		assert.Equal(t, maxNetBIOSNameLength, len(hostname))
+		assertNetBIOSHostname(t, hostname)
+		assert.Equal(t, hostname, podNameHashHostnameGenerator{}.generate(pod, dummyNamespace, ""))
+		assert.NotEqual(t, hostname, podNameHashHostnameGenerator{}.generate(pod, "other-namespace", ""))
+
+		prefixed := podNameHashHostnameGenerator{}.generate(pod, dummyNamespace, "app")
+		assert.True(t, strings.HasPrefix(prefixed, "app-"), prefixed)
+		assert.Equal(t, maxNetBIOSNameLength, len(prefixed))
+
+		assert.Equal(t, "", podNameHashHostnameGenerator{}.generate(&corev1.Pod{}, dummyNamespace, ""))
+	})
+}
+
+func TestSanitizeHostname(t *testing.T) {
+	for input, expected := range map[string]string{
+		"web":                  "web",
+		"Web_Front..End-":      "web-front-end",
+		"--leading":            "leading",
+		"123":                  "n123",
+		"":                     "",
+		"!!!":                  "",
+		"a-very-long-hostname": "a-very-long-hostname",
+	} {
+		assert.Equal(t, expected, sanitizeHostname(input), "input %q", input)
+	}
+	assert.Equal(t, "a-very-long", truncateHostname("a-very-long-hostname", 12))
+}
+
+func TestMutateCreateRequestHostnameStrategies(t *testing.T) {
+	kubeClientFactory := func(credSpecAnnotations, namespaceAnnotations map[string]string) *dummyKubeClient {
+		return &dummyKubeClient{
+			retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+				return &gmsaCredSpec{name: credSpecName, contents: dummyCredSpecContents, annotations: credSpecAnnotations}, http.StatusOK, nil
+			},
+			retrieveNamespaceFunc: func(ctx context.Context, name string) (*corev1.Namespace, int, error) {
+				return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: namespaceAnnotations}}, http.StatusOK, nil
+			},
+		}
+	}
+
+	buildStatefulPod := func() *corev1.Pod {
+		pod := buildOwnedPod("db-0", "StatefulSet", "db")
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{WindowsOptions: buildWindowsOptions(dummyCredSpecName, "")}
+		return pod
+	}
+
+	mutate := func(t *testing.T, client *dummyKubeClient, pod *corev1.Pod, options ...WebhookOption) []string {
+		webhook := newWebhookWithOptions(client, append([]WebhookOption{WithRandomHostname(true)}, options...)...)
+
+		ctx, warnings := withWarnings(context.Background())
+		response, err := webhook.mutateCreateRequest(ctx, pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+		return warnings.list()
+	}
+
+	t.Run("the cred spec's strategy and prefix take precedence", func(t *testing.T) {
+		client := kubeClientFactory(
+			map[string]string{hostnameStrategyAnnotation: string(StatefulSetOrdinalHostnameStrategy), hostnamePrefixAnnotation: "cs-"},
+			map[string]string{hostnameStrategyAnnotation: string(RandomHostnameStrategy), hostnamePrefixAnnotation: "ns-"},
+		)
+		pod := buildStatefulPod()
+
+		mutate(t, client, pod, WithHostnameStrategy(PodNameHashHostnameStrategy, "global-"))
+		assert.Equal(t, "cs-db-0", pod.Spec.Hostname)
+	})
+
+	t.Run("the namespace's settings apply to whatever the cred spec does not define", func(t *testing.T) {
+		client := kubeClientFactory(
+			map[string]string{hostnameStrategyAnnotation: string(StatefulSetOrdinalHostnameStrategy)},
+			map[string]string{hostnamePrefixAnnotation: "ns-"},
+		)
+		pod := buildStatefulPod()
+
+		mutate(t, client, pod, WithHostnameStrategy(PodNameHashHostnameStrategy, "global-"))
+		assert.Equal(t, "ns-db-0", pod.Spec.Hostname)
+	})
+
+	t.Run("it falls back to the global settings", func(t *testing.T) {
+		pod := buildStatefulPod()
+
+		mutate(t, kubeClientFactory(nil, nil), pod, WithHostnameStrategy(StatefulSetOrdinalHostnameStrategy, "global-"))
+		assert.Equal(t, "global-db-0", pod.Spec.Hostname)
+	})
+
+	t.Run("strategies that don't apply fall back to random hostnames", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""), nil)
+
+		mutate(t, kubeClientFactory(nil, nil), pod, WithHostnameStrategy(JobIndexHostnameStrategy, "job-"))
+		assert.True(t, strings.HasPrefix(pod.Spec.Hostname, "job-"), pod.Spec.Hostname)
+		assert.Equal(t, maxNetBIOSNameLength, len(pod.Spec.Hostname))
+	})
+
+	t.Run("invalid strategies get ignored with a warning", func(t *testing.T) {
+		pod := buildStatefulPod()
+
+		warnings := mutate(t, kubeClientFactory(nil, map[string]string{hostnameStrategyAnnotation: "unknown"}), pod, WithHostnameStrategy(StatefulSetOrdinalHostnameStrategy, ""))
+		assert.Equal(t, "db-0", pod.Spec.Hostname)
+		if assert.Equal(t, 1, len(warnings)) {
+			assert.Contains(t, warnings[0], `unknown hostname strategy "unknown"`)
+		}
+	})
+}
+
+func TestInvalidNetBIOSNameReason(t *testing.T) {
+	for hostname, expectedReason := range map[string]string{
+		"web-01":           "",
+		"exactly-15-char":  "",
+		"longer-than-15-c": "it is longer than 15 characters",
+		"12345":            "it only contains digits",
+		"-web":             "it starts or ends with a hyphen",
+		"web_01":           "it contains characters other than letters, digits and hyphens",
+	} {
+		assert.Equal(t, expectedReason, invalidNetBIOSNameReason(hostname), "hostname %q", hostname)
+	}
+}
+
+func TestExplicitHostnames(t *testing.T) {
+	buildPodWithHostname := func(hostname string) *corev1.Pod {
+		return buildPodWithHostName(dummyServiceAccoutName, &hostname, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), nil)
+	}
+
+	t.Run("valid hostnames are left alone", func(t *testing.T) {
+		webhook := newWebhookWithOptions(&dummyKubeClient{}, WithInvalidHostnameMode(NormalizeInvalidHostnames))
+		pod := buildPodWithHostname("web-01")
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		assert.Nil(t, response.Patch)
+
+		response, err = webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		assert.True(t, response.Allowed)
+	})
+
+	for mode, testCase := range map[InvalidHostnameMode]struct{ hostname, expected string }{
+		TruncateInvalidHostnames:  {hostname: "a-very-long-hostname", expected: "a-very-long-hos"},
+		NormalizeInvalidHostnames: {hostname: "123456", expected: "n123456"},
+	} {
+		t.Run(fmt.Sprintf("with the %s mode, invalid hostnames get fixed with a warning", mode), func(t *testing.T) {
+			webhook := newWebhookWithOptions(&dummyKubeClient{}, WithInvalidHostnameMode(mode))
+			pod := buildPodWithHostname(testCase.hostname)
+
+			ctx, warnings := withWarnings(context.Background())
+			response, err := webhook.mutateCreateRequest(ctx, pod, dummyNamespace)
+			require.Nil(t, err)
+			require.NotNil(t, response)
+
+			assert.Equal(t, testCase.expected, pod.Spec.Hostname)
+			assert.Contains(t, string(response.Patch), `{"op":"replace","path":"/spec/hostname","value":"`+testCase.expected+`"}`)
+			if assert.Equal(t, 1, len(warnings.list())) {
+				assert.Contains(t, warnings.list()[0], fmt.Sprintf("it was changed to %q", testCase.expected))
+			}
+		})
+	}
+
+	t.Run("hostnames that truncating doesn't fix get denied", func(t *testing.T) {
+		webhook := newWebhookWithOptions(&dummyKubeClient{}, WithInvalidHostnameMode(TruncateInvalidHostnames))
+		pod := buildPodWithHostname("123456")
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		assert.Nil(t, response.Patch)
+
+		response, err = webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, response)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusUnprocessableEntity, `hostname "123456" can't be used by pods using GMSA's, as it's not a valid NetBIOS name: it only contains digits`)
+	})
+
+	t.Run("by default, invalid hostnames get denied", func(t *testing.T) {
+		for _, options := range [][]WebhookOption{nil, {WithInvalidHostnameMode(DenyInvalidHostnames)}} {
+			webhook := newWebhookWithOptions(&dummyKubeClient{}, options...)
+			pod := buildPodWithHostname("a-very-long-hostname")
+
+			response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+			require.Nil(t, err)
+			assert.Nil(t, response.Patch)
+
+			response, err = webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+			assert.Nil(t, response)
+			assertPodAdmissionErrorContains(t, err, pod, http.StatusUnprocessableEntity, "it is longer than 15 characters")
+		}
+	})
+
+	t.Run("with the warn mode, invalid hostnames get admitted with a warning", func(t *testing.T) {
+		webhook := newWebhookWithOptions(&dummyKubeClient{}, WithInvalidHostnameMode(WarnInvalidHostnames))
+		pod := buildPodWithHostname("a-very-long-hostname")
+
+		ctx, warnings := withWarnings(context.Background())
+		response, err := webhook.mutateCreateRequest(ctx, pod, dummyNamespace)
+		require.Nil(t, err)
+		assert.Nil(t, response.Patch)
+		if assert.Equal(t, 1, len(warnings.list())) {
+			assert.Contains(t, warnings.list()[0], `hostname "a-very-long-hostname" can't be used by pods using GMSA's, as it's not a valid NetBIOS name: it is longer than 15 characters`)
+		}
+
+		response, err = webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		assert.True(t, response.Allowed)
+	})
+
+	t.Run("pods not using GMSA's can use any hostname", func(t *testing.T) {
+		webhook := newWebhookWithOptions(&dummyKubeClient{})
+		pod := buildPodWithHostname("a-very-long-hostname")
+		pod.Spec.SecurityContext = nil
+
+		response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		assert.True(t, response.Allowed)
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// allowedImagesAnnotation can be set on cred specs to a comma-separated list of the images allowed to run with
+// them: repositories or repository prefixes, e.g. `mcr.microsoft.com/windows`, `contoso.azurecr.io/web` or
+// `nginx`, but not tagged ones; and image digests, either alone, e.g. `sha256:<hex digest>`, or along with their
+// repository, e.g. `contoso.azurecr.io/web/app@sha256:<hex digest>`.
+const allowedImagesAnnotation = "windows.k8s.io/gmsa-allowed-images"
+
+// podContainer is any of a pod's containers, whatever its kind.
+type podContainer struct {
+	kind            gmsaResourceKind
+	name            string
+	index           int
+	image           string
+	securityContext *corev1.SecurityContext
+}
+
+// podContainers returns all the pod's containers: init containers, containers and ephemeral containers.
+func podContainers(pod *corev1.Pod) []podContainer {
+	var containers []podContainer
+	for i, container := range pod.Spec.InitContainers {
+		containers = append(containers, podContainer{kind: initContainerKind, name: container.Name, index: i, image: container.Image, securityContext: container.SecurityContext})
+	}
+	for i, container := range pod.Spec.Containers {
+		containers = append(containers, podContainer{kind: containerKind, name: container.Name, index: i, image: container.Image, securityContext: container.SecurityContext})
+	}
+	for i, container := range pod.Spec.EphemeralContainers {
+		containers = append(containers, podContainer{kind: ephemeralContainerKind, name: container.Name, index: i, image: container.Image, securityContext: container.SecurityContext})
+	}
+	return containers
+}
+
+// credSpecName returns the name of the cred spec the container sets in its own security context, if any.
+func (container podContainer) credSpecName() string {
+	if container.securityContext != nil && container.securityContext.WindowsOptions != nil && container.securityContext.WindowsOptions.GMSACredentialSpecName != nil {
+		return *container.securityContext.WindowsOptions.GMSACredentialSpecName
+	}
+	return ""
+}
+
+// effectiveCredSpecName returns the name of the cred spec the container runs with: its own if it sets one,
+// or else its pod's, if any.
+func effectiveCredSpecName(pod *corev1.Pod, container podContainer) string {
+	if credSpecName := container.credSpecName(); credSpecName != "" {
+		return credSpecName
+	}
+	if pod.Spec.SecurityContext != nil && pod.Spec.SecurityContext.WindowsOptions != nil && pod.Spec.SecurityContext.WindowsOptions.GMSACredentialSpecName != nil {
+		return *pod.Spec.SecurityContext.WindowsOptions.GMSACredentialSpecName
+	}
+	return ""
+}
+
+// checkAllowedImages records a violation for each container whose image isn't allowed by the
+// allowedImagesAnnotation of its effective cred spec, if that cred spec has one. Containers for which
+// `skip` returns true don't get checked. It only returns internal errors.
+func (webhook *webhook) checkAllowedImages(ctx context.Context, pod *corev1.Pod, credSpecs *credSpecCache, violations *policyViolations, skip func(container podContainer) bool) *podAdmissionError {
+	for _, container := range podContainers(pod) {
+		credSpecName := effectiveCredSpecName(pod, container)
+		if credSpecName == "" || (skip != nil && skip(container)) {
+			continue
+		}
+
+		credSpec, code, err := credSpecs.get(ctx, credSpecName)
+		if err != nil {
+			if code >= http.StatusInternalServerError {
+				return &podAdmissionError{error: err, pod: pod, code: code}
+			}
+			// the cred spec's other checks, or inlining its contents, deny the pod in that case
+			continue
+		}
+
+		rawAllowedImages, present := credSpec.annotations[allowedImagesAnnotation]
+		if !present {
+			continue
+		}
+		allowedImages := splitList(rawAllowedImages)
+		for _, allowedImage := range allowedImages {
+			if _, valid := normalizeImagePrefix(allowedImage); !valid && !strings.Contains(allowedImage, "@") {
+				addWarnings(ctx, fmt.Sprintf("ignoring %q in the %s annotation of GMSA cred spec %q: tags aren't supported, use a repository or a digest instead",
+					allowedImage, allowedImagesAnnotation, credSpecName))
+			}
+		}
+		if isImageAllowed(container.image, allowedImages) {
+			continue
+		}
+
+		msg := fmt.Sprintf("%s %q runs image %q, which is not allowed to run with GMSA cred spec %q: its %s annotation only allows %s",
+			container.kind, container.name, container.image, credSpecName, allowedImagesAnnotation, strings.Join(allowedImages, ", "))
+		field := fieldPath(resourceSpecPath(container.kind, container.index) + "/image")
+		violations.check(&podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusForbidden, reason: imageNotAllowedReason, field: field})
+	}
+
+	return nil
+}
+
+// isImageAllowed returns true iff the image matches any of the allowed images, see allowedImagesAnnotation.
+// Repositories get normalized the same way on both sides, see normalizeImagePrefix; tagged ones never match.
+func isImageAllowed(image string, allowedImages []string) bool {
+	_, digest, _ := strings.Cut(image, "@")
+	for _, allowedImage := range allowedImages {
+		allowedRepository, allowedDigest, hasDigest := strings.Cut(allowedImage, "@")
+		switch {
+		case strings.HasPrefix(allowedImage, "sha256:"):
+			if digest == allowedImage {
+				return true
+			}
+		case hasDigest:
+			if digest == allowedDigest && imageRepository(image) == imageRepository(allowedRepository) {
+				return true
+			}
+		case isImageFromRegistries(image, []string{allowedImage}):
+			return true
+		}
+	}
+	return false
+}
+
+// splitList parses a comma-separated list, ignoring blank items.
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestIsImageAllowed(t *testing.T) {
+	digest := "sha256:0123456789abcdef"
+	allowedImages := []string{"mcr.microsoft.com/windows", "contoso.azurecr.io/web/app@" + digest, "sha256:fedcba9876543210"}
+
+	for image, expected := range map[string]bool{
+		"mcr.microsoft.com/windows/servercore:ltsc2022": true,
+		"mcr.microsoft.com/windowsfake:latest":          false,
+		"contoso.azurecr.io/web/app@" + digest:          true,
+		"contoso.azurecr.io/web/app:v1@" + digest:       true,
+		"contoso.azurecr.io/web/app:v1":                 false,
+		"contoso.azurecr.io/web/other@" + digest:        false,
+		"anything.io/at/all@sha256:fedcba9876543210":    true,
+		"nginx": false,
+	} {
+		assert.Equal(t, expected, isImageAllowed(image, allowedImages), image)
+	}
+
+	t.Run("allowed repositories get normalized", func(t *testing.T) {
+		for _, testCase := range []struct {
+			image        string
+			allowedImage string
+			expected     bool
+		}{
+			{image: "nginx:1.25", allowedImage: "nginx", expected: true},
+			{image: "docker.io/library/nginx@sha256:0123", allowedImage: "nginx", expected: true},
+			{image: "docker.io/nginx", allowedImage: "nginx", expected: true},
+			{image: "nginx-unprivileged", allowedImage: "nginx", expected: false},
+			{image: "contoso.azurecr.io/web/app:v1", allowedImage: "Contoso.azurecr.io/web", expected: true},
+			{image: "Contoso.azurecr.io/web/app:v1", allowedImage: "contoso.azurecr.io/web/", expected: true},
+			{image: "contoso.azurecr.io/web/app:v1", allowedImage: "contoso.azurecr.io", expected: true},
+			{image: "localhost:5000/app", allowedImage: "localhost:5000", expected: true},
+			{image: "repo:tag", allowedImage: "repo:tag", expected: false},
+			{image: "repo:other", allowedImage: "repo:tag", expected: false},
+			{image: "contoso.azurecr.io/web/app:v1", allowedImage: "contoso.azurecr.io/web/app:v1", expected: false},
+		} {
+			assert.Equal(t, testCase.expected, isImageAllowed(testCase.image, []string{testCase.allowedImage}), "image %q, allowed image %q", testCase.image, testCase.allowedImage)
+		}
+	})
+}
+
+func TestValidateCreateRequestAllowedImages(t *testing.T) {
+	const webCredSpecName = "web-cred-spec"
+
+	client := &dummyKubeClient{
+		retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+			credSpec := &gmsaCredSpec{name: credSpecName, contents: dummyCredSpecContents}
+			if credSpecName == webCredSpecName {
+				credSpec.annotations = map[string]string{allowedImagesAnnotation: "contoso.azurecr.io/web, mcr.microsoft.com/windows/servercore"}
+			}
+			return credSpec, http.StatusOK, nil
+		},
+	}
+
+	buildImagesPod := func(podCredSpecName, containerCredSpecName string) *corev1.Pod {
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(podCredSpecName, dummyCredSpecContents), map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions(containerCredSpecName, dummyCredSpecContents),
+		})
+		pod.Spec.Containers[0].Image = "contoso.azurecr.io/batch/job:v1"
+		pod.Spec.InitContainers = []corev1.Container{{Name: dummyInitContainerName, Image: "contoso.azurecr.io/web/init:v1"}}
+		return pod
+	}
+
+	t.Run("containers get checked against their own cred spec's allowlist", func(t *testing.T) {
+		pod := buildImagesPod(dummyCredSpecName, webCredSpecName)
+
+		response, err := newWebhook(client).validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, response)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden,
+			"container %q runs image %q, which is not allowed to run with GMSA cred spec %q: its %s annotation only allows contoso.azurecr.io/web, mcr.microsoft.com/windows/servercore",
+			dummyContainerName, "contoso.azurecr.io/batch/job:v1", webCredSpecName, allowedImagesAnnotation) {
+			assert.Equal(t, imageNotAllowedReason, err.reason)
+			assert.Equal(t, "spec.containers[0].image", err.field)
+		}
+	})
+
+	t.Run("containers without their own cred spec get checked against the pod's", func(t *testing.T) {
+		pod := buildImagesPod(webCredSpecName, dummyCredSpecName)
+
+		response, err := newWebhook(client).validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, err)
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed, "the init container's image is allowed, and the container has its own cred spec without any allowlist")
+
+		pod.Spec.InitContainers[0].Image = "busybox"
+		response, err = newWebhook(client).validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, response)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, "%s %q runs image %q", initContainerKind, dummyInitContainerName, "busybox")
+	})
+
+	t.Run("tagged allowed images get ignored, with a warning", func(t *testing.T) {
+		taggedClient := &dummyKubeClient{
+			retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+				return &gmsaCredSpec{name: credSpecName, contents: dummyCredSpecContents, annotations: map[string]string{
+					allowedImagesAnnotation: "contoso.azurecr.io/batch/job:v1, contoso.azurecr.io/web",
+				}}, http.StatusOK, nil
+			},
+		}
+		pod := buildImagesPod(dummyCredSpecName, dummyCredSpecName)
+		ctx, warnings := withWarnings(context.Background())
+
+		response, err := newWebhook(taggedClient).validateCreateRequest(ctx, pod, dummyNamespace)
+		assert.Nil(t, response)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, "%s %q runs image %q", containerKind, dummyContainerName, "contoso.azurecr.io/batch/job:v1")
+		assert.Equal(t, []string{fmt.Sprintf(`ignoring "contoso.azurecr.io/batch/job:v1" in the %s annotation of GMSA cred spec %q: tags aren't supported, use a repository or a digest instead`,
+			allowedImagesAnnotation, dummyCredSpecName)}, warnings.list())
+	})
+
+	t.Run("new ephemeral containers get checked on updates", func(t *testing.T) {
+		oldPod := buildImagesPod(webCredSpecName, dummyCredSpecName)
+		oldPod.Spec.EphemeralContainers = []corev1.EphemeralContainer{buildEphemeralContainer("existing-debugger", nil)}
+		oldPod.Spec.EphemeralContainers[0].Image = "busybox"
+
+		pod := oldPod.DeepCopy()
+		pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, buildEphemeralContainer(dummyEphemeralContainerName, nil))
+		pod.Spec.EphemeralContainers[1].Image = "busybox"
+
+		response, err := newWebhook(client).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
+		assert.Nil(t, response)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, "%s %q runs image %q", ephemeralContainerKind, dummyEphemeralContainerName, "busybox") {
+			assert.NotContains(t, err.Error(), "existing-debugger")
+		}
+	})
+}
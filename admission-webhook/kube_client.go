@@ -5,14 +5,29 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	authorizationv1 "k8s.io/api/authorization/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apiserver/pkg/authentication/serviceaccount"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 )
 
 const (
@@ -27,12 +42,32 @@ const (
 
 	// notFound is used in `isNotFoundError` below
 	notFound = "not found"
+
+	// informersResyncPeriod is how often informers re-list the objects they cache
+	informersResyncPeriod = 10 * time.Minute
+
+	// gmsaPolicyDiscoveryPeriod is how often the webhook checks whether the GMSAPolicy CRD has been installed,
+	// until it is
+	gmsaPolicyDiscoveryPeriod = 30 * time.Second
 )
 
 // kubeClient centralizes all the operations we need when talking to k8s
 type kubeClient struct {
 	coreClient    kubernetes.Interface
 	dynamicClient dynamic.Interface
+
+	// namespaces get read on most admission requests, so they're served from an informer's cache
+	informerFactory informers.SharedInformerFactory
+	namespaceLister corev1listers.NamespaceLister
+	namespaceSynced cache.InformerSynced
+
+	// GMSA policies get read on every request for a GMSA pod when enabled, so they're cached too; the lister
+	// is nil until their CRD gets discovered, see watchGMSAPolicies
+	dynamicInformerFactory dynamicinformer.DynamicSharedInformerFactory
+	gmsaPoliciesWatched    bool
+	gmsaPolicyMutex        sync.RWMutex
+	gmsaPolicyLister       cache.GenericLister
+	gmsaPolicySynced       cache.InformerSynced
 }
 
 func newKubeClient(config *rest.Config) (*kubeClient, error) {
@@ -46,12 +81,101 @@ func newKubeClient(config *rest.Config) (*kubeClient, error) {
 		return nil, err
 	}
 
+	informerFactory := informers.NewSharedInformerFactory(coreClient, informersResyncPeriod)
+	namespaceInformer := informerFactory.Core().V1().Namespaces()
+
 	return &kubeClient{
-		coreClient:    coreClient,
-		dynamicClient: dynamicClient,
+		coreClient:             coreClient,
+		dynamicClient:          dynamicClient,
+		informerFactory:        informerFactory,
+		namespaceLister:        namespaceInformer.Lister(),
+		namespaceSynced:        namespaceInformer.Informer().HasSynced,
+		dynamicInformerFactory: dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, informersResyncPeriod),
 	}, nil
 }
 
+// watchGMSAPolicies sets up the informer caching GMSA policies, provided their CRD is installed; if it isn't,
+// it keeps checking in the background until it is, and listGMSAPolicies fails in the meantime so that GMSA
+// pods get denied rather than escaping the policies.
+// It must be called before startInformers.
+func (kc *kubeClient) watchGMSAPolicies(stopCh <-chan struct{}) error {
+	kc.gmsaPoliciesWatched = true
+
+	served, err := kc.isGMSAPolicyCRDServed()
+	if err != nil {
+		return err
+	}
+	if served {
+		kc.setUpGMSAPolicyInformer()
+		return nil
+	}
+
+	logrus.Warnf("the %s CRD isn't installed, GMSA pods will be denied until it is", gmsaPolicyResourceName)
+	go func() {
+		_ = wait.PollUntilContextCancel(wait.ContextForChannel(stopCh), gmsaPolicyDiscoveryPeriod, false, func(ctx context.Context) (bool, error) {
+			served, err := kc.isGMSAPolicyCRDServed()
+			if err != nil {
+				logrus.Warn(err)
+				return false, nil
+			}
+			if !served {
+				return false, nil
+			}
+
+			logrus.Infof("the %s CRD has been installed, watching GMSA policies", gmsaPolicyResourceName)
+			kc.setUpGMSAPolicyInformer()
+			kc.dynamicInformerFactory.Start(stopCh)
+			return true, nil
+		})
+	}()
+	return nil
+}
+
+// isGMSAPolicyCRDServed returns true iff the API server serves the GMSAPolicy CRD.
+func (kc *kubeClient) isGMSAPolicyCRDServed() (bool, error) {
+	groupVersion := schema.GroupVersion{Group: crdAPIGroup, Version: crdAPIVersion}
+	resources, err := kc.coreClient.Discovery().ServerResourcesForGroupVersion(groupVersion.String())
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("unable to discover the resources of API group %s: %v", groupVersion, err)
+	}
+	if resources != nil {
+		for _, resource := range resources.APIResources {
+			if resource.Name == gmsaPolicyResourceName {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// setUpGMSAPolicyInformer registers the informer caching GMSA policies; it only runs once the informer
+// factory gets started.
+func (kc *kubeClient) setUpGMSAPolicyInformer() {
+	groupVersion := schema.GroupVersion{Group: crdAPIGroup, Version: crdAPIVersion}
+	informer := kc.dynamicInformerFactory.ForResource(groupVersion.WithResource(gmsaPolicyResourceName))
+
+	kc.gmsaPolicyMutex.Lock()
+	defer kc.gmsaPolicyMutex.Unlock()
+	kc.gmsaPolicyLister = informer.Lister()
+	kc.gmsaPolicySynced = informer.Informer().HasSynced
+}
+
+// startInformers starts the client's informers, and waits for their caches to be populated.
+func (kc *kubeClient) startInformers(stopCh <-chan struct{}) error {
+	kc.informerFactory.Start(stopCh)
+	kc.dynamicInformerFactory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, kc.namespaceSynced) {
+		return fmt.Errorf("unable to sync the namespaces cache")
+	}
+	kc.gmsaPolicyMutex.RLock()
+	gmsaPolicySynced := kc.gmsaPolicySynced
+	kc.gmsaPolicyMutex.RUnlock()
+	if gmsaPolicySynced != nil && !cache.WaitForCacheSync(stopCh, gmsaPolicySynced) {
+		return fmt.Errorf("unable to sync the GMSA policies cache")
+	}
+	return nil
+}
+
 // isAuthorizedToReadConfigMap checks whether a given service account is authorized to `use` a given cred spec.
 // If it denies the request, it also returns a string explaining why.
 func (kc *kubeClient) isAuthorizedToUseCredSpec(ctx context.Context, serviceAccountName, namespace, credSpecName string) (bool, string) {
@@ -90,9 +214,9 @@ func (kc *kubeClient) isAuthorizedToUseCredSpec(ctx context.Context, serviceAcco
 	return response.Status.Allowed && !response.Status.Denied, response.Status.Reason
 }
 
-// retrieveCredSpecContents fetches the actual contents of a cred spec.
+// retrieveCredSpec fetches a cred spec, along with its actual contents.
 // If it returns an error, it also returns the corresponding HTTP code.
-func (kc *kubeClient) retrieveCredSpecContents(ctx context.Context, credSpecName string) (string, int, error) {
+func (kc *kubeClient) retrieveCredSpec(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
 	resource := schema.GroupVersionResource{
 		Group:    crdAPIGroup,
 		Version:  crdAPIVersion,
@@ -101,21 +225,223 @@ func (kc *kubeClient) retrieveCredSpecContents(ctx context.Context, credSpecName
 	credSpec, err := kc.dynamicClient.Resource(resource).Get(ctx, credSpecName, metav1.GetOptions{})
 	if err != nil {
 		if isNotFoundError(err) {
-			return "", http.StatusNotFound, fmt.Errorf("cred spec %s does not exist", credSpecName)
+			return nil, http.StatusNotFound, fmt.Errorf("cred spec %s does not exist", credSpecName)
 		}
-		return "", http.StatusInternalServerError, fmt.Errorf("unable to retrieve the contents of cred spec %s: %v", credSpecName, err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to retrieve the contents of cred spec %s: %v", credSpecName, err)
 	}
 
 	if contents, present := credSpec.Object[crdContentsField]; !present || contents == "" {
-		return "", http.StatusExpectationFailed, fmt.Errorf("cred spec %s does not have a %s key", credSpecName, crdContentsField)
+		return nil, http.StatusExpectationFailed, fmt.Errorf("cred spec %s does not have a %s key", credSpecName, crdContentsField)
 	}
 
 	contentsBytes, err := json.Marshal(credSpec.Object[crdContentsField])
 	if err != nil {
-		return "", http.StatusInternalServerError, fmt.Errorf("unable to marshall cred spec %s into a JSON: %v", credSpecName, err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to marshall cred spec %s into a JSON: %v", credSpecName, err)
+	}
+
+	return &gmsaCredSpec{
+		name:            credSpec.GetName(),
+		resourceVersion: credSpec.GetResourceVersion(),
+		labels:          credSpec.GetLabels(),
+		annotations:     credSpec.GetAnnotations(),
+		contents:        string(contentsBytes),
+	}, http.StatusOK, nil
+}
+
+// retrieveServiceAccount fetches a service account.
+// If it returns an error, it also returns the corresponding HTTP code.
+func (kc *kubeClient) retrieveServiceAccount(ctx context.Context, namespace, name string) (*corev1.ServiceAccount, int, error) {
+	serviceAccount, err := kc.coreClient.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, http.StatusNotFound, fmt.Errorf("service account %s/%s does not exist", namespace, name)
+		}
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to retrieve service account %s/%s: %v", namespace, name, err)
+	}
+	return serviceAccount, http.StatusOK, nil
+}
+
+// retrieveNamespace fetches a namespace from the informer's cache; the returned object must not be modified.
+// If it returns an error, it also returns the corresponding HTTP code.
+func (kc *kubeClient) retrieveNamespace(ctx context.Context, name string) (*corev1.Namespace, int, error) {
+	namespace, err := kc.namespaceLister.Get(name)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, http.StatusNotFound, fmt.Errorf("namespace %s does not exist", name)
+		}
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to retrieve namespace %s: %v", name, err)
+	}
+	return namespace, http.StatusOK, nil
+}
+
+// retrievePod fetches a pod.
+// If it returns an error, it also returns the corresponding HTTP code.
+func (kc *kubeClient) retrievePod(ctx context.Context, namespace, name string) (*corev1.Pod, int, error) {
+	pod, err := kc.coreClient.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, http.StatusNotFound, fmt.Errorf("pod %s/%s does not exist", namespace, name)
+		}
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to retrieve pod %s/%s: %v", namespace, name, err)
+	}
+	return pod, http.StatusOK, nil
+}
+
+// retrieveLease fetches a lease.
+// If it returns an error, it also returns the corresponding HTTP code.
+func (kc *kubeClient) retrieveLease(ctx context.Context, namespace, name string) (*coordinationv1.Lease, int, error) {
+	lease, err := kc.coreClient.CoordinationV1().Leases(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, http.StatusNotFound, fmt.Errorf("lease %s/%s does not exist", namespace, name)
+		}
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to retrieve lease %s/%s: %v", namespace, name, err)
+	}
+	return lease, http.StatusOK, nil
+}
+
+// createLease creates a lease; it returns a 409 HTTP code if it already exists.
+// If it returns an error, it also returns the corresponding HTTP code.
+func (kc *kubeClient) createLease(ctx context.Context, lease *coordinationv1.Lease) (int, error) {
+	if _, err := kc.coreClient.CoordinationV1().Leases(lease.Namespace).Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+		return leaseErrorCode(err), fmt.Errorf("unable to create lease %s/%s: %v", lease.Namespace, lease.Name, err)
+	}
+	return http.StatusCreated, nil
+}
+
+// updateLease updates a lease; it returns a 409 HTTP code if it has been modified since `lease` was retrieved.
+// If it returns an error, it also returns the corresponding HTTP code.
+func (kc *kubeClient) updateLease(ctx context.Context, lease *coordinationv1.Lease) (int, error) {
+	if _, err := kc.coreClient.CoordinationV1().Leases(lease.Namespace).Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		return leaseErrorCode(err), fmt.Errorf("unable to update lease %s/%s: %v", lease.Namespace, lease.Name, err)
+	}
+	return http.StatusOK, nil
+}
+
+// deleteLease deletes a lease, provided it's still at the given resource version; it returns a 409 HTTP code
+// if it's not.
+// If it returns an error, it also returns the corresponding HTTP code.
+func (kc *kubeClient) deleteLease(ctx context.Context, namespace, name, resourceVersion string) (int, error) {
+	options := metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &resourceVersion}}
+	if err := kc.coreClient.CoordinationV1().Leases(namespace).Delete(ctx, name, options); err != nil {
+		return leaseErrorCode(err), fmt.Errorf("unable to delete lease %s/%s: %v", namespace, name, err)
+	}
+	return http.StatusOK, nil
+}
+
+// canListRoles checks whether a given user is authorized to list both cluster roles, and roles in the given
+// namespace.
+func (kc *kubeClient) canListRoles(ctx context.Context, userInfo authenticationv1.UserInfo, namespace string) bool {
+	// needed to cast `authenticationv1.ExtraValue` to `authorizationv1.ExtraValue`
+	extra := make(map[string]authorizationv1.ExtraValue, len(userInfo.Extra))
+	for k, v := range userInfo.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+
+	for _, attributes := range []authorizationv1.ResourceAttributes{
+		{Verb: "list", Group: rbacv1.GroupName, Resource: "clusterroles"},
+		{Verb: "list", Group: rbacv1.GroupName, Resource: "roles", Namespace: namespace},
+	} {
+		subjectAccessReview := authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				ResourceAttributes: &attributes,
+				User:               userInfo.Username,
+				Groups:             userInfo.Groups,
+				UID:                userInfo.UID,
+				Extra:              extra,
+			},
+		}
+
+		response, err := kc.coreClient.AuthorizationV1().SubjectAccessReviews().Create(ctx, &subjectAccessReview, metav1.CreateOptions{})
+		if err != nil {
+			logrus.Warnf("unable to check whether user %q can list %s: %v", userInfo.Username, attributes.Resource, err)
+			return false
+		}
+		if !response.Status.Allowed || response.Status.Denied {
+			return false
+		}
+	}
+	return true
+}
+
+// listRoles lists all cluster roles, as well as the roles in the given namespace.
+// If it returns an error, it also returns the corresponding HTTP code; in particular, a 403 if
+// the webhook isn't allowed to list them.
+func (kc *kubeClient) listRoles(ctx context.Context, namespace string) ([]rbacv1.ClusterRole, []rbacv1.Role, int, error) {
+	clusterRoles, err := kc.coreClient.RbacV1().ClusterRoles().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, rbacErrorCode(err), fmt.Errorf("unable to list cluster roles: %v", err)
+	}
+	roles, err := kc.coreClient.RbacV1().Roles(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, rbacErrorCode(err), fmt.Errorf("unable to list roles in namespace %s: %v", namespace, err)
+	}
+	return clusterRoles.Items, roles.Items, http.StatusOK, nil
+}
+
+// listGMSAPolicies lists all the GMSAPolicies from the informer's cache; if they're not watched, there aren't
+// any. It fails if they are, but the informer isn't running or hasn't synced yet, e.g. because their CRD isn't
+// installed yet.
+// If it returns an error, it also returns the corresponding HTTP code.
+func (kc *kubeClient) listGMSAPolicies(ctx context.Context) ([]gmsaPolicy, int, error) {
+	if !kc.gmsaPoliciesWatched {
+		return nil, http.StatusOK, nil
+	}
+	kc.gmsaPolicyMutex.RLock()
+	lister, synced := kc.gmsaPolicyLister, kc.gmsaPolicySynced
+	kc.gmsaPolicyMutex.RUnlock()
+	if lister == nil {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("GMSA policies are enabled, but the %s CRD isn't installed", gmsaPolicyResourceName)
+	}
+	if !synced() {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("GMSA policies are enabled, but they haven't been loaded yet")
 	}
 
-	return string(contentsBytes), http.StatusOK, nil
+	objects, err := lister.List(labels.Everything())
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to list GMSA policies: %v", err)
+	}
+
+	policies := make([]gmsaPolicy, 0, len(objects))
+	for _, object := range objects {
+		item, ok := object.(*unstructured.Unstructured)
+		if !ok {
+			return nil, http.StatusInternalServerError, fmt.Errorf("unexpected object of type %T in the GMSA policies cache", object)
+		}
+		policy := gmsaPolicy{name: item.GetName()}
+		if spec, present := item.Object["spec"]; present {
+			specBytes, err := json.Marshal(spec)
+			if err == nil {
+				err = json.Unmarshal(specBytes, &policy.spec)
+			}
+			if err != nil {
+				return nil, http.StatusInternalServerError, fmt.Errorf("unable to parse the spec of GMSA policy %s: %v", policy.name, err)
+			}
+		}
+		policies = append(policies, policy)
+	}
+	return policies, http.StatusOK, nil
+}
+
+// rbacErrorCode maps errors reading RBAC objects to HTTP codes.
+func rbacErrorCode(err error) int {
+	if apierrors.IsForbidden(err) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// leaseErrorCode maps errors writing leases to HTTP codes, keeping the distinction between conflicts,
+// which are expected when several webhook replicas compete for the same lease, and actual failures.
+func leaseErrorCode(err error) int {
+	switch {
+	case apierrors.IsAlreadyExists(err), apierrors.IsConflict(err):
+		return http.StatusConflict
+	case apierrors.IsNotFound(err):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
 }
 
 // isNotFoundError returns true if the error indicates "not found".  It parses
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// legacyPodAnnotationPrefix and legacyContainerAnnotationInfix make up the keys of the annotations
+	// that were used to configure GMSA's before the `windowsOptions` fields went GA: respectively
+	// `pod.alpha.windows.kubernetes.io/<field>` for pods, and
+	// `<container name>.container.alpha.windows.kubernetes.io/<field>` for containers
+	legacyPodAnnotationPrefix      = "pod.alpha.windows.kubernetes.io/"
+	legacyContainerAnnotationInfix = ".container.alpha.windows.kubernetes.io/"
+
+	legacyCredSpecNameAnnotationField = "gmsa-credential-spec-name"
+	legacyCredSpecAnnotationField     = "gmsa-credential-spec"
+)
+
+// translateLegacyAnnotations returns the JSON patches turning the pod's legacy alpha GMSA annotations
+// into the corresponding `windowsOptions` fields, along with a warning for each annotation.
+// Annotations for fields that are already set are ignored. The pod itself gets updated too, so that
+// the cred specs' contents get inlined afterwards.
+func translateLegacyAnnotations(pod *corev1.Pod) ([]jsonPatchOperation, []string) {
+	if len(pod.Annotations) == 0 {
+		return nil, nil
+	}
+
+	var (
+		patches  []jsonPatchOperation
+		warnings []string
+	)
+	translated := make(map[string]bool)
+
+	translate := func(annotationPrefix string, resourceKind gmsaResourceKind, resourceName string, containerIndex int) {
+		for _, field := range []string{legacyCredSpecNameAnnotationField, legacyCredSpecAnnotationField} {
+			key := annotationPrefix + field
+			if _, present := pod.Annotations[key]; !present {
+				continue
+			}
+			translated[key] = true
+
+			fieldPatches, warning := translateLegacyAnnotation(pod, key, field, resourceKind, resourceName, containerIndex)
+			patches = append(patches, fieldPatches...)
+			warnings = append(warnings, warning)
+		}
+	}
+
+	translate(legacyPodAnnotationPrefix, podKind, pod.Name, -1)
+	for i, container := range pod.Spec.InitContainers {
+		translate(container.Name+legacyContainerAnnotationInfix, initContainerKind, container.Name, i)
+	}
+	for i, container := range pod.Spec.Containers {
+		translate(container.Name+legacyContainerAnnotationInfix, containerKind, container.Name, i)
+	}
+
+	// warn about the annotations that don't match any container
+	var unmatchedKeys []string
+	for key := range pod.Annotations {
+		if !translated[key] && strings.Contains(key, legacyContainerAnnotationInfix) {
+			unmatchedKeys = append(unmatchedKeys, key)
+		}
+	}
+	sort.Strings(unmatchedKeys)
+	for _, key := range unmatchedKeys {
+		containerName := key[:strings.Index(key, legacyContainerAnnotationInfix)]
+		warnings = append(warnings, fmt.Sprintf("ignoring deprecated annotation %q: there is no container named %q", key, containerName))
+	}
+
+	return patches, warnings
+}
+
+// translateLegacyAnnotation translates a single legacy annotation into the `windowsOptions` field of
+// the pod or container it applies to.
+func translateLegacyAnnotation(pod *corev1.Pod, key, field string, resourceKind gmsaResourceKind, resourceName string, containerIndex int) ([]jsonPatchOperation, string) {
+	value := pod.Annotations[key]
+
+	// no patches get created here if the field is already set, since then `windowsOptions` already exists
+	windowsOptions, patches := ensureWindowsOptions(pod, resourceKind, containerIndex)
+
+	target, jsonField := &windowsOptions.GMSACredentialSpecName, "gmsaCredentialSpecName"
+	if field == legacyCredSpecAnnotationField {
+		target, jsonField = &windowsOptions.GMSACredentialSpec, "gmsaCredentialSpec"
+	}
+	path := fmt.Sprintf("%s/securityContext/windowsOptions/%s", resourceSpecPath(resourceKind, containerIndex), jsonField)
+
+	if *target != nil {
+		if **target == value {
+			return nil, fmt.Sprintf("deprecated annotation %q is redundant with %s and should be removed", key, fieldPath(path))
+		}
+		return nil, fmt.Sprintf("ignoring deprecated annotation %q on %s %q: %s is already set to a different value", key, resourceKind, resourceName, fieldPath(path))
+	}
+
+	*target = &value
+	patches = append(patches, jsonPatchOperation{Op: "add", Path: path, Value: value})
+
+	return patches, fmt.Sprintf("deprecated annotation %q was translated into %s", key, fieldPath(path))
+}
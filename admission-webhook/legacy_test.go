@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestMutateCreateRequestWithLegacyAnnotations(t *testing.T) {
+	client := &dummyKubeClient{
+		retrieveCredSpecContentsFunc: func(ctx context.Context, credSpecName string) (contents string, httpCode int, err error) {
+			contents = credSpecName + "-contents"
+			return
+		},
+	}
+
+	buildLegacyPod := func(annotations map[string]string, containerWindowsOptions *corev1.WindowsSecurityContextOptions) *corev1.Pod {
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: containerWindowsOptions})
+		pod.Annotations = annotations
+		return pod
+	}
+
+	mutate := func(t *testing.T, webhook *webhook, pod *corev1.Pod) ([]jsonPatchOperation, []string) {
+		ctx, warnings := withWarnings(context.Background())
+		response, err := webhook.mutateCreateRequest(ctx, pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+
+		var patches []jsonPatchOperation
+		if response.Patch != nil {
+			require.Nil(t, json.Unmarshal(response.Patch, &patches))
+		}
+		return patches, warnings.list()
+	}
+
+	t.Run("it translates the pod annotation and inlines the cred spec's contents", func(t *testing.T) {
+		webhook := newWebhookWithOptions(client, WithLegacyAnnotationsMigration(true))
+		pod := buildLegacyPod(map[string]string{legacyPodAnnotationPrefix + legacyCredSpecNameAnnotationField: dummyCredSpecName}, nil)
+
+		patches, warnings := mutate(t, webhook, pod)
+
+		assert.Equal(t, []jsonPatchOperation{
+			{Op: "add", Path: "/spec/securityContext", Value: map[string]interface{}{}},
+			{Op: "add", Path: "/spec/securityContext/windowsOptions", Value: map[string]interface{}{}},
+			{Op: "add", Path: "/spec/securityContext/windowsOptions/gmsaCredentialSpecName", Value: dummyCredSpecName},
+			{Op: "add", Path: "/spec/securityContext/windowsOptions/gmsaCredentialSpec", Value: dummyCredSpecName + "-contents"},
+		}, patches)
+		assert.Equal(t, []string{
+			`deprecated annotation "pod.alpha.windows.kubernetes.io/gmsa-credential-spec-name" was translated into spec.securityContext.windowsOptions.gmsaCredentialSpecName`,
+		}, warnings)
+	})
+
+	t.Run("it translates the container annotations, including the contents", func(t *testing.T) {
+		webhook := newWebhookWithOptions(client, WithLegacyAnnotationsMigration(true))
+		pod := buildLegacyPod(map[string]string{
+			dummyContainerName + legacyContainerAnnotationInfix + legacyCredSpecNameAnnotationField: dummyCredSpecName,
+			dummyContainerName + legacyContainerAnnotationInfix + legacyCredSpecAnnotationField:     dummyCredSpecContents,
+		}, nil)
+
+		patches, warnings := mutate(t, webhook, pod)
+
+		assert.Equal(t, []jsonPatchOperation{
+			{Op: "add", Path: "/spec/containers/0/securityContext", Value: map[string]interface{}{}},
+			{Op: "add", Path: "/spec/containers/0/securityContext/windowsOptions", Value: map[string]interface{}{}},
+			{Op: "add", Path: "/spec/containers/0/securityContext/windowsOptions/gmsaCredentialSpecName", Value: dummyCredSpecName},
+			{Op: "add", Path: "/spec/containers/0/securityContext/windowsOptions/gmsaCredentialSpec", Value: dummyCredSpecContents},
+		}, patches)
+		if assert.Equal(t, 2, len(warnings)) {
+			assert.Contains(t, warnings[0], "spec.containers[0].securityContext.windowsOptions.gmsaCredentialSpecName")
+			assert.Contains(t, warnings[1], "spec.containers[0].securityContext.windowsOptions.gmsaCredentialSpec")
+		}
+	})
+
+	t.Run("it does not override fields that are already set", func(t *testing.T) {
+		webhook := newWebhookWithOptions(client, WithLegacyAnnotationsMigration(true))
+		pod := buildLegacyPod(map[string]string{
+			dummyContainerName + legacyContainerAnnotationInfix + legacyCredSpecNameAnnotationField: "other-cred-spec",
+		}, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents))
+
+		patches, warnings := mutate(t, webhook, pod)
+
+		assert.Empty(t, patches)
+		if assert.Equal(t, 1, len(warnings)) {
+			assert.Contains(t, warnings[0], "is already set to a different value")
+		}
+		assert.Equal(t, dummyCredSpecName, *pod.Spec.Containers[0].SecurityContext.WindowsOptions.GMSACredentialSpecName)
+	})
+
+	t.Run("it warns about annotations for unknown containers", func(t *testing.T) {
+		webhook := newWebhookWithOptions(client, WithLegacyAnnotationsMigration(true))
+		pod := buildLegacyPod(map[string]string{
+			"unknown" + legacyContainerAnnotationInfix + legacyCredSpecNameAnnotationField: dummyCredSpecName,
+		}, nil)
+
+		patches, warnings := mutate(t, webhook, pod)
+
+		assert.Empty(t, patches)
+		assert.Equal(t, []string{
+			`ignoring deprecated annotation "unknown.container.alpha.windows.kubernetes.io/gmsa-credential-spec-name": there is no container named "unknown"`,
+		}, warnings)
+	})
+
+	t.Run("it does nothing when not enabled", func(t *testing.T) {
+		webhook := newWebhook(client)
+		pod := buildLegacyPod(map[string]string{legacyPodAnnotationPrefix + legacyCredSpecNameAnnotationField: dummyCredSpecName}, nil)
+
+		patches, warnings := mutate(t, webhook, pod)
+
+		assert.Empty(t, patches)
+		assert.Empty(t, warnings)
+	})
+}
+
+func TestFieldPath(t *testing.T) {
+	assert.Equal(t, "spec.hostname", fieldPath("/spec/hostname"))
+	assert.Equal(t, "spec.initContainers[2].securityContext.windowsOptions", fieldPath("/spec/initContainers/2/securityContext/windowsOptions"))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/rest"
 )
 
@@ -27,12 +29,95 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	stopCh := make(chan struct{})
+	gmsaPolicies := env_bool("GMSA_POLICIES")
+	if gmsaPolicies {
+		if err = kubeClient.watchGMSAPolicies(stopCh); err != nil {
+			panic(err)
+		}
+	}
+	if err = kubeClient.startInformers(stopCh); err != nil {
+		panic(err)
+	}
 
 	randomHostname := env_bool("RANDOM_HOSTNAME")
 
 	options := []WebhookOption{WithCertReload(*enableCertReload)}
 	options = append(options, WithRandomHostname(randomHostname))
 
+	hostnameStrategy := RandomHostnameStrategy
+	if rawHostnameStrategy, found := os.LookupEnv("HOSTNAME_STRATEGY"); found && rawHostnameStrategy != "" {
+		if hostnameStrategy, err = parseHostnameStrategy(rawHostnameStrategy); err != nil {
+			panic(err)
+		}
+	}
+	options = append(options, WithHostnameStrategy(hostnameStrategy, os.Getenv("HOSTNAME_PREFIX")))
+
+	invalidHostnameMode := DenyInvalidHostnames
+	if rawInvalidHostnameMode, found := os.LookupEnv("INVALID_HOSTNAME_MODE"); found && rawInvalidHostnameMode != "" {
+		if invalidHostnameMode, err = parseInvalidHostnameMode(rawInvalidHostnameMode); err != nil {
+			panic(err)
+		}
+	}
+	options = append(options, WithInvalidHostnameMode(invalidHostnameMode))
+
+	policyMode := EnforcePolicyMode
+	if rawPolicyMode, found := os.LookupEnv("POLICY_MODE"); found && rawPolicyMode != "" {
+		if policyMode, err = parsePolicyMode(rawPolicyMode); err != nil {
+			panic(err)
+		}
+	}
+	options = append(options, WithPolicyMode(policyMode))
+
+	profile := PrivilegedGMSAProfile
+	if rawProfile, found := os.LookupEnv("GMSA_PROFILE"); found && rawProfile != "" {
+		if profile, err = parseGMSAProfile(rawProfile); err != nil {
+			panic(err)
+		}
+	}
+	options = append(options, WithGMSAProfile(profile))
+
+	if env_bool("UNIQUE_HOSTNAMES") {
+		options = append(options, WithUniqueHostnames(true, env("HOSTNAME_LEASES_NAMESPACE")))
+	}
+
+	options = append(options, WithDefaultCredSpec(env_bool("DEFAULT_CRED_SPEC")))
+	options = append(options, WithLegacyAnnotationsMigration(env_bool("MIGRATE_LEGACY_ANNOTATIONS")))
+	options = append(options, WithPodOS(env_bool("SET_GMSA_POD_OS")))
+	options = append(options, WithWindowsNodeSelector(env_bool("SET_WINDOWS_NODE_SELECTOR")))
+
+	if rawTolerations, found := os.LookupEnv("WINDOWS_TOLERATIONS"); found && rawTolerations != "" {
+		var tolerations []corev1.Toleration
+		if err := json.Unmarshal([]byte(rawTolerations), &tolerations); err != nil {
+			panic(fmt.Errorf("unable to parse environment variable WINDOWS_TOLERATIONS with value %s: %v", rawTolerations, err))
+		}
+		options = append(options, WithWindowsTolerations(tolerations))
+	}
+
+	options = append(options, WithRuntimeClassInjection(env_bool("INJECT_RUNTIME_CLASS")))
+	options = append(options, WithAllowedRuntimeClasses(env_list("ALLOWED_RUNTIME_CLASSES")))
+	options = append(options, WithCredSpecNodeSelectors(env_bool("CREDSPEC_NODE_SELECTORS")))
+	options = append(options, WithCredSpecMetadata(env_bool("CREDSPEC_METADATA")))
+	options = append(options, WithCredSpecContentsRepair(env_bool("REPAIR_CREDSPEC_CONTENTS")))
+	options = append(options, WithGMSAPolicies(gmsaPolicies))
+	options = append(options, WithRoleSuggestions(env_bool("SUGGEST_EXISTING_ROLES")))
+
+	if podTemplatePathsFile, found := os.LookupEnv("POD_TEMPLATE_PATHS_CONFIG"); found {
+		podTemplatePaths, err := loadPodTemplatePaths(podTemplatePathsFile)
+		if err != nil {
+			panic(err)
+		}
+		options = append(options, WithPodTemplatePaths(podTemplatePaths))
+	}
+
+	if customRulesFile, found := os.LookupEnv("CUSTOM_RULES_CONFIG"); found {
+		customRules, err := loadCustomRules(customRulesFile)
+		if err != nil {
+			panic(err)
+		}
+		options = append(options, WithCustomRules(customRules))
+	}
+
 	webhook := newWebhookWithOptions(kubeClient, options...)
 
 	tlsConfig := &tlsConfig{
@@ -134,6 +219,14 @@ func env_int(key string, defaultInt int) int {
 	return defaultInt
 }
 
+// env_list parses a comma-separated list, ignoring blank items.
+func env_list(key string) []string {
+	if v, found := os.LookupEnv(key); found {
+		return splitList(v)
+	}
+	return nil
+}
+
 func env(key string) string {
 	if value, found := os.LookupEnv(key); found {
 		return value
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// credSpecLabelPrefix prefixes the labels set to `true` on pods using GMSA's, one per cred spec they use,
+	// e.g. `credspec.gmsa.windows.k8s.io/webapp1`, so that pods using a given cred spec can be selected.
+	// Only the webhook may set them: other labels with that prefix get stripped from pods on creation,
+	// and updates can't change them.
+	credSpecLabelPrefix = "credspec.gmsa.windows.k8s.io/"
+
+	// these annotations get set on pods using GMSA's to JSON objects mapping the names of the cred specs
+	// whose contents got inlined to, respectively, their contents' hashes (see credSpecContentsHash) and
+	// the resource versions they were inlined from
+	credSpecContentHashesAnnotation    = "windows.k8s.io/gmsa-credspec-content-hashes"
+	credSpecResourceVersionsAnnotation = "windows.k8s.io/gmsa-credspec-resource-versions"
+
+	// webhookVersionAnnotation is the version of the webhook that inlined the cred specs' contents.
+	webhookVersionAnnotation = "windows.k8s.io/gmsa-webhook-version"
+
+	// maxLabelNameLength is the maximum length of the name part of a label's key
+	maxLabelNameLength = 63
+)
+
+// credSpecLabelKey returns the key of the label marking pods using the given cred spec. Label names being
+// limited to 63 characters, longer cred spec names get truncated and suffixed with a hash of the full name.
+func credSpecLabelKey(credSpecName string) string {
+	if len(credSpecName) <= maxLabelNameLength {
+		return credSpecLabelPrefix + credSpecName
+	}
+	digest := sha256.Sum256([]byte(credSpecName))
+	suffix := "-" + hex.EncodeToString(digest[:])[:10]
+	return credSpecLabelPrefix + credSpecName[:maxLabelNameLength-len(suffix)] + suffix
+}
+
+// credSpecMetadataPatches returns the JSON patches labelling the pod with the cred specs it uses, and
+// annotating it with the hashes and resource versions of the ones whose contents got inlined, as well as
+// with the webhook's version. The pod itself gets updated too.
+func (webhook *webhook) credSpecMetadataPatches(ctx context.Context, pod *corev1.Pod, credSpecs *credSpecCache, inlined map[string]bool) ([]jsonPatchOperation, *podAdmissionError) {
+	var patches []jsonPatchOperation
+	hashes := make(map[string]string)
+	resourceVersions := make(map[string]string)
+
+	for _, credSpecName := range credSpecNames(pod) {
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+			patches = append(patches, jsonPatchOperation{Op: "add", Path: "/metadata/labels", Value: struct{}{}})
+		}
+		key := credSpecLabelKey(credSpecName)
+		pod.Labels[key] = "true"
+		patches = append(patches, jsonPatchOperation{Op: "add", Path: "/metadata/labels/" + escapeJSONPointer(key), Value: "true"})
+
+		if inlined[credSpecName] {
+			credSpec, code, err := credSpecs.get(ctx, credSpecName)
+			if err != nil {
+				return nil, &podAdmissionError{error: err, pod: pod, code: code}
+			}
+			hashes[credSpecName] = credSpecContentsHash(credSpec.contents)
+			resourceVersions[credSpecName] = credSpec.resourceVersion
+		}
+	}
+
+	if len(hashes) == 0 {
+		return patches, nil
+	}
+
+	annotations := map[string]string{webhookVersionAnnotation: getVersion()}
+	for key, value := range map[string]map[string]string{
+		credSpecContentHashesAnnotation:    hashes,
+		credSpecResourceVersionsAnnotation: resourceVersions,
+	} {
+		rawValue, err := json.Marshal(value)
+		if err != nil {
+			return nil, &podAdmissionError{error: fmt.Errorf("unable to marshall annotation %s: %v", key, err), pod: pod, code: http.StatusInternalServerError}
+		}
+		annotations[key] = string(rawValue)
+	}
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+			patches = append(patches, jsonPatchOperation{Op: "add", Path: "/metadata/annotations", Value: struct{}{}})
+		}
+		pod.Annotations[key] = annotations[key]
+		patches = append(patches, jsonPatchOperation{Op: "add", Path: "/metadata/annotations/" + escapeJSONPointer(key), Value: annotations[key]})
+	}
+
+	return patches, nil
+}
+
+// credSpecLabels returns the keys of the labels prefixed with credSpecLabelPrefix, sorted.
+func credSpecLabels(labels map[string]string) []string {
+	var keys []string
+	for key := range labels {
+		if strings.HasPrefix(key, credSpecLabelPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expectedCredSpecLabels returns the set of keys of the labels marking the cred specs the pod uses.
+func expectedCredSpecLabels(pod *corev1.Pod) map[string]bool {
+	expected := make(map[string]bool)
+	for _, credSpecName := range credSpecNames(pod) {
+		expected[credSpecLabelKey(credSpecName)] = true
+	}
+	return expected
+}
+
+// spoofedCredSpecLabelPatches returns the JSON patches removing the labels prefixed with credSpecLabelPrefix
+// that don't match any of the cred specs the pod uses, along with a warning for each of them, so that pods
+// can't get selected as using cred specs they don't. The pod itself gets updated too.
+func spoofedCredSpecLabelPatches(pod *corev1.Pod) ([]jsonPatchOperation, []string) {
+	var patches []jsonPatchOperation
+	var warnings []string
+
+	expected := expectedCredSpecLabels(pod)
+	for _, key := range credSpecLabels(pod.Labels) {
+		if expected[key] {
+			continue
+		}
+		delete(pod.Labels, key)
+		patches = append(patches, jsonPatchOperation{Op: "remove", Path: "/metadata/labels/" + escapeJSONPointer(key)})
+		warnings = append(warnings, fmt.Sprintf("removed label %q, which doesn't match any of the GMSA cred specs the pod uses", key))
+	}
+
+	return patches, warnings
+}
+
+// checkCredSpecLabels returns an error if the labels prefixed with credSpecLabelPrefix aren't exactly those
+// marking the cred specs the pod uses, e.g. if they got changed after the mutating webhook set them.
+// These labels are what the webhook vouches for, so mismatches get denied whatever the pod's policy modes.
+func checkCredSpecLabels(pod *corev1.Pod) *podAdmissionError {
+	expected := expectedCredSpecLabels(pod)
+	var msgs []string
+
+	for _, key := range credSpecLabels(pod.Labels) {
+		if expected[key] {
+			delete(expected, key)
+		} else {
+			msgs = append(msgs, fmt.Sprintf("label %q doesn't match any of the GMSA cred specs the pod uses", key))
+		}
+	}
+	missing := make([]string, 0, len(expected))
+	for key := range expected {
+		missing = append(missing, key)
+	}
+	sort.Strings(missing)
+	for _, key := range missing {
+		msgs = append(msgs, fmt.Sprintf("label %q is missing for a GMSA cred spec the pod uses", key))
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	return credSpecLabelsError(pod, strings.Join(msgs, "; "))
+}
+
+// checkCredSpecLabelsUpdate returns an error if an update adds, removes or changes any of the labels
+// prefixed with credSpecLabelPrefix.
+func checkCredSpecLabelsUpdate(pod, oldPod *corev1.Pod) *podAdmissionError {
+	keys := credSpecLabels(pod.Labels)
+	oldKeys := credSpecLabels(oldPod.Labels)
+
+	var msgs []string
+	for _, key := range keys {
+		if oldValue, present := oldPod.Labels[key]; !present {
+			msgs = append(msgs, fmt.Sprintf("label %q added", key))
+		} else if oldValue != pod.Labels[key] {
+			msgs = append(msgs, fmt.Sprintf("label %q modified", key))
+		}
+	}
+	for _, key := range oldKeys {
+		if _, present := pod.Labels[key]; !present {
+			msgs = append(msgs, fmt.Sprintf("label %q removed", key))
+		}
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	return credSpecLabelsError(pod, "cannot update an existing pod's GMSA cred spec labels: "+strings.Join(msgs, "; "))
+}
+
+// checkNewContainersCredSpecLabels returns an error if any of the pod's containers for which `isExisting`
+// returns false, i.e. new ephemeral containers, runs with a cred spec that the pod isn't labelled with, whether
+// it's its own or inherited from the pod. Labels can't be updated along with ephemeral containers, so the pod
+// couldn't be selected as using that cred spec.
+func checkNewContainersCredSpecLabels(pod *corev1.Pod, isExisting func(container podContainer) bool) *podAdmissionError {
+	var msgs []string
+	for _, container := range podContainers(pod) {
+		credSpecName := effectiveCredSpecName(pod, container)
+		if credSpecName == "" || isExisting(container) {
+			continue
+		}
+		if key := credSpecLabelKey(credSpecName); pod.Labels[key] != "true" {
+			msgs = append(msgs, fmt.Sprintf("%s %q uses GMSA cred spec %q, but the pod doesn't have the %q label", container.kind, container.name, credSpecName, key))
+		}
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	return credSpecLabelsError(pod, "cannot add containers using GMSA cred specs the pod isn't labelled with: "+strings.Join(msgs, "; "))
+}
+
+func credSpecLabelsError(pod *corev1.Pod, msg string) *podAdmissionError {
+	err := &podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusForbidden, reason: credSpecLabelMismatchReason, field: "metadata.labels"}
+	err.causes = []metav1.StatusCause{err.cause()}
+	return err
+}
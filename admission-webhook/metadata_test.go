@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionV1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestCredSpecLabelKey(t *testing.T) {
+	assert.Equal(t, "credspec.gmsa.windows.k8s.io/webapp1", credSpecLabelKey("webapp1"))
+
+	longName := strings.Repeat("a", 60) + ".example.com"
+	key := credSpecLabelKey(longName)
+	name := strings.TrimPrefix(key, credSpecLabelPrefix)
+	assert.Equal(t, maxLabelNameLength, len(name))
+	assert.True(t, strings.HasPrefix(name, strings.Repeat("a", 52)+"-"), name)
+	assert.NotEqual(t, key, credSpecLabelKey(longName+"x"))
+}
+
+func TestMutateCreateRequestCredSpecMetadata(t *testing.T) {
+	client := &dummyKubeClient{
+		retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+			return &gmsaCredSpec{name: credSpecName, resourceVersion: "42", contents: credSpecName + "-contents"}, http.StatusOK, nil
+		},
+	}
+
+	buildMetadataPod := func() *corev1.Pod {
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""), map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions("preset-cred-spec", "preset-cred-spec-contents"),
+		})
+		pod.Labels = map[string]string{"app": "web"}
+		return pod
+	}
+
+	t.Run("pods get labelled with their cred specs, and annotated with the inlined ones", func(t *testing.T) {
+		pod := buildMetadataPod()
+
+		response, err := newWebhookWithOptions(client, WithCredSpecMetadata(true)).mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+
+		assert.Equal(t, map[string]string{
+			"app":                                "web",
+			credSpecLabelKey(dummyCredSpecName):  "true",
+			credSpecLabelKey("preset-cred-spec"): "true",
+		}, pod.Labels)
+		assert.Equal(t, map[string]string{
+			credSpecContentHashesAnnotation:    `{"dummy-cred-spec-name":"` + credSpecContentsHash(dummyCredSpecName+"-contents") + `"}`,
+			credSpecResourceVersionsAnnotation: `{"dummy-cred-spec-name":"42"}`,
+			webhookVersionAnnotation:           getVersion(),
+		}, pod.Annotations)
+
+		patch := string(response.Patch)
+		assert.Contains(t, patch, `{"op":"add","path":"/metadata/labels/credspec.gmsa.windows.k8s.io~1dummy-cred-spec-name","value":"true"}`)
+		assert.Contains(t, patch, `{"op":"add","path":"/metadata/annotations","value":{}}`)
+		assert.Contains(t, patch, `{"op":"add","path":"/metadata/annotations/windows.k8s.io~1gmsa-webhook-version","value":"`+getVersion()+`"}`)
+		assert.NotContains(t, patch, `{"op":"add","path":"/metadata/labels","value":{}}`)
+	})
+
+	t.Run("nothing gets added when disabled", func(t *testing.T) {
+		pod := buildMetadataPod()
+
+		_, err := newWebhook(client).mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		assert.Equal(t, map[string]string{"app": "web"}, pod.Labels)
+		assert.Empty(t, pod.Annotations)
+	})
+}
+
+func TestCredSpecLabelsCannotBeSpoofed(t *testing.T) {
+	buildLabelledPod := func(labels map[string]string) *corev1.Pod {
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), nil)
+		pod.Labels = labels
+		return pod
+	}
+	buildCreateRequest := func(t *testing.T, pod *corev1.Pod) *admissionV1.AdmissionRequest {
+		podJSON, err := json.Marshal(pod)
+		require.Nil(t, err)
+		return &admissionV1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: dummyNamespace,
+			Operation: admissionV1.Create,
+			Object:    runtime.RawExtension{Raw: podJSON},
+		}
+	}
+	spoofedLabel := credSpecLabelKey("other-cred-spec")
+
+	t.Run("labels not matching the pod's cred specs get stripped on creation", func(t *testing.T) {
+		pod := buildLabelledPod(map[string]string{"app": "web", spoofedLabel: "true"})
+		ctx, warnings := withWarnings(context.Background())
+
+		response, err := newWebhookWithOptions(&dummyKubeClient{}, WithCredSpecMetadata(true)).mutateCreateRequest(ctx, pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+
+		assert.Equal(t, map[string]string{"app": "web", credSpecLabelKey(dummyCredSpecName): "true"}, pod.Labels)
+		assert.Contains(t, string(response.Patch), `{"op":"remove","path":"/metadata/labels/credspec.gmsa.windows.k8s.io~1other-cred-spec"}`)
+		assert.Equal(t, []string{`removed label "credspec.gmsa.windows.k8s.io/other-cred-spec", which doesn't match any of the GMSA cred specs the pod uses`}, warnings.list())
+	})
+
+	t.Run("pods not using GMSA's get them stripped too", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, nil, nil)
+		pod.Labels = map[string]string{spoofedLabel: "true"}
+
+		response, err := newWebhookWithOptions(&dummyKubeClient{}, WithCredSpecMetadata(true)).mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+		assert.Empty(t, pod.Labels)
+	})
+
+	t.Run("creating pods with mismatching labels gets denied, whatever the policy mode", func(t *testing.T) {
+		for _, labels := range []map[string]string{
+			{credSpecLabelKey(dummyCredSpecName): "true", spoofedLabel: "true"},
+			{"app": "web"},
+		} {
+			for _, mode := range policyModes {
+				_, err := newWebhookWithOptions(&dummyKubeClient{}, WithCredSpecMetadata(true), WithPolicyMode(mode)).validateOrMutate(context.Background(), buildCreateRequest(t, buildLabelledPod(labels)), validate)
+				if assert.NotNil(t, err, "labels: %v, mode: %s", labels, mode) {
+					assert.Equal(t, http.StatusForbidden, err.code)
+					assert.Equal(t, credSpecLabelMismatchReason, err.reason)
+					assert.Equal(t, 1, len(err.causes))
+				}
+			}
+		}
+
+		response, err := newWebhookWithOptions(&dummyKubeClient{}, WithCredSpecMetadata(true)).validateOrMutate(context.Background(), buildCreateRequest(t, buildLabelledPod(map[string]string{credSpecLabelKey(dummyCredSpecName): "true"})), validate)
+		assert.Nil(t, err)
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+	})
+
+	t.Run("updates can't add, remove or modify them", func(t *testing.T) {
+		oldLabels := map[string]string{credSpecLabelKey(dummyCredSpecName): "true"}
+
+		for _, labels := range []map[string]string{
+			{credSpecLabelKey(dummyCredSpecName): "true", spoofedLabel: "true"},
+			{},
+			{credSpecLabelKey(dummyCredSpecName): "false"},
+		} {
+			_, err := newWebhookWithOptions(&dummyKubeClient{}, WithCredSpecMetadata(true)).validateUpdateRequest(context.Background(), buildLabelledPod(labels), buildLabelledPod(oldLabels), dummyNamespace)
+			if assert.NotNil(t, err, "labels: %v", labels) {
+				assert.Contains(t, err.Error(), "cannot update an existing pod's GMSA cred spec labels")
+				assert.Equal(t, credSpecLabelMismatchReason, err.reason)
+			}
+		}
+
+		response, err := newWebhookWithOptions(&dummyKubeClient{}, WithCredSpecMetadata(true)).validateUpdateRequest(context.Background(), buildLabelledPod(map[string]string{"app": "web", credSpecLabelKey(dummyCredSpecName): "true"}), buildLabelledPod(oldLabels), dummyNamespace)
+		assert.Nil(t, err)
+		require.NotNil(t, response)
+	})
+
+	t.Run("new ephemeral containers can't use cred specs the pod isn't labelled with", func(t *testing.T) {
+		labels := map[string]string{credSpecLabelKey(dummyCredSpecName): "true"}
+		client := &dummyKubeClient{
+			retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+				return &gmsaCredSpec{name: credSpecName, contents: dummyCredSpecContents}, http.StatusOK, nil
+			},
+		}
+
+		for name, testCase := range map[string]struct {
+			windowsOptions *corev1.WindowsSecurityContextOptions
+			labels         map[string]string
+			expectedError  string
+		}{
+			"inheriting the pod's labelled cred spec": {labels: labels},
+			"using the pod's labelled cred spec":      {windowsOptions: buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), labels: labels},
+			"using another cred spec": {
+				windowsOptions: buildWindowsOptions("other-cred-spec", dummyCredSpecContents),
+				labels:         labels,
+				expectedError:  fmt.Sprintf(`ephemeral container %q uses GMSA cred spec "other-cred-spec", but the pod doesn't have the %q label`, dummyEphemeralContainerName, credSpecLabelKey("other-cred-spec")),
+			},
+			"inheriting a cred spec the pod isn't labelled with": {
+				expectedError: fmt.Sprintf(`ephemeral container %q uses GMSA cred spec %q, but the pod doesn't have the %q label`, dummyEphemeralContainerName, dummyCredSpecName, credSpecLabelKey(dummyCredSpecName)),
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				oldPod := buildLabelledPod(testCase.labels)
+				pod := oldPod.DeepCopy()
+				pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{buildEphemeralContainer(dummyEphemeralContainerName, testCase.windowsOptions)}
+
+				response, err := newWebhookWithOptions(client, WithCredSpecMetadata(true)).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
+				if testCase.expectedError == "" {
+					assert.Nil(t, err)
+					require.NotNil(t, response)
+					assert.True(t, response.Allowed)
+					return
+				}
+
+				assert.Nil(t, response)
+				if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, testCase.expectedError) {
+					assert.Equal(t, credSpecLabelMismatchReason, err.reason)
+					assert.Equal(t, "metadata.labels", err.field)
+				}
+			})
+		}
+	})
+
+	t.Run("they're left alone when disabled", func(t *testing.T) {
+		pod := buildLabelledPod(map[string]string{spoofedLabel: "true"})
+
+		_, err := newWebhook(&dummyKubeClient{}).mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		assert.Equal(t, map[string]string{spoofedLabel: "true"}, pod.Labels)
+
+		_, err = newWebhook(&dummyKubeClient{}).validateOrMutate(context.Background(), buildCreateRequest(t, pod), validate)
+		assert.Nil(t, err)
+		_, err = newWebhook(&dummyKubeClient{}).validateUpdateRequest(context.Background(), buildLabelledPod(nil), pod, dummyNamespace)
+		assert.Nil(t, err)
+	})
+}
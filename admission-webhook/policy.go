@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	admissionV1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PolicyMode is what the validating webhook does with pods violating GMSA policies, similarly to
+// Pod Security Admission's modes; several of them can apply to the same pod.
+type PolicyMode string
+
+const (
+	// EnforcePolicyMode denies pods violating policies.
+	EnforcePolicyMode PolicyMode = "enforce"
+	// AuditPolicyMode admits pods violating policies, recording their violations as an audit annotation.
+	AuditPolicyMode PolicyMode = "audit"
+	// WarnPolicyMode admits pods violating policies, returning their violations as warnings to the user.
+	WarnPolicyMode PolicyMode = "warn"
+)
+
+var policyModes = []PolicyMode{EnforcePolicyMode, AuditPolicyMode, WarnPolicyMode}
+
+const (
+	// policyModeLabelPrefix followed by a policy mode is the label that namespaces can set to `true` or `false`
+	// to turn that mode on or off for their pods, independently of the other modes, e.g.
+	// `windows.k8s.io/gmsa-policy-warn: "true"`; modes whose label isn't set are on iff they're the global policy
+	// mode. Pods can also set these labels as annotations if their namespace allows it, see podOverridesAnnotation.
+	policyModeLabelPrefix = "windows.k8s.io/gmsa-policy-"
+
+	// policyViolationsAuditAnnotation is the audit annotation listing the policy violations of pods admitted in
+	// audit mode; the API server prefixes it with the webhook's name.
+	policyViolationsAuditAnnotation = "policy-violations"
+)
+
+// These are the reasons set on each cause of a denial's details; they're part of the webhook's API, and as such
+// must not be changed.
+const (
+	gmsaOnLinuxReason                   metav1.CauseType = "GMSAOnLinux"
+	runtimeClassNotAllowedReason        metav1.CauseType = "RuntimeClassNotAllowed"
+	credSpecUseNotAuthorizedReason      metav1.CauseType = "CredSpecUseNotAuthorized"
+	credSpecUseNotAllowedByPolicyReason metav1.CauseType = "CredSpecUseNotAllowedByPolicy"
+	credSpecNotFoundReason              metav1.CauseType = "CredSpecNotFound"
+	credSpecInvalidReason               metav1.CauseType = "CredSpecInvalid"
+	credSpecContentsMismatchReason      metav1.CauseType = "CredSpecContentsMismatch"
+	credSpecContentsWithoutNameReason   metav1.CauseType = "CredSpecContentsWithoutName"
+	gmsaSettingsUpdatedReason           metav1.CauseType = "GMSASettingsUpdated"
+	invalidNetBIOSHostnameReason        metav1.CauseType = "InvalidNetBIOSHostname"
+	imageNotAllowedReason               metav1.CauseType = "ImageNotAllowed"
+	multipleCredSpecsReason             metav1.CauseType = "MultipleCredSpecs"
+	containerLevelGMSAReason            metav1.CauseType = "ContainerLevelGMSA"
+	gmsaWithHostProcessReason           metav1.CauseType = "GMSAWithHostProcess"
+	incompatibleRunAsUserNameReason     metav1.CauseType = "IncompatibleRunAsUserName"
+	customRuleViolationReason           metav1.CauseType = "CustomRuleViolation"
+	credSpecLabelMismatchReason         metav1.CauseType = "CredSpecLabelMismatch"
+)
+
+// parsePolicyMode returns an error if `mode` is not a known policy mode.
+func parsePolicyMode(mode string) (PolicyMode, error) {
+	modes := make([]string, len(policyModes))
+	for i, known := range policyModes {
+		if PolicyMode(mode) == known {
+			return known, nil
+		}
+		modes[i] = string(known)
+	}
+	return "", fmt.Errorf("unknown policy mode %q, known modes are: %s", mode, strings.Join(modes, ", "))
+}
+
+// policyModeLabel returns the label turning the given policy mode on or off, see policyModeLabelPrefix.
+func policyModeLabel(mode PolicyMode) string {
+	return policyModeLabelPrefix + string(mode)
+}
+
+// policyViolations collects the policy violations found when validating a pod, so that they can all be reported
+// at once, according to each of the pod's policy modes.
+type policyViolations struct {
+	// modes are the policy modes that are on for the pod; if nil, violations get enforced
+	modes      map[PolicyMode]bool
+	violations []*podAdmissionError
+}
+
+// check returns `err` if it must be returned as is: because it's nil, or because it's not a policy violation
+// but an internal error. Otherwise it records it, unless the same field already has a violation for the same
+// reason (e.g. pod-level violations found when checking each container), and returns nil.
+func (violations *policyViolations) check(err *podAdmissionError) *podAdmissionError {
+	if err == nil || err.code >= http.StatusInternalServerError {
+		return err
+	}
+	for _, violation := range violations.violations {
+		if err.reason != "" && violation.reason == err.reason && violation.field == err.field {
+			return nil
+		}
+	}
+	violations.violations = append(violations.violations, err)
+	return nil
+}
+
+// admissionResponse returns the response admitting a pod whose violations, if any, were recorded; or, in
+// enforce mode, the error denying it if it has any violation. Either way, violations are recorded as an audit
+// annotation in audit mode, and returned as warnings in warn mode.
+func (violations *policyViolations) admissionResponse() (*admissionV1.AdmissionResponse, *podAdmissionError) {
+	response := &admissionV1.AdmissionResponse{Allowed: true}
+	if len(violations.violations) == 0 {
+		return response, nil
+	}
+
+	messages := make([]string, len(violations.violations))
+	for i, violation := range violations.violations {
+		messages[i] = violation.Error()
+	}
+	var auditAnnotations map[string]string
+	if violations.modes[AuditPolicyMode] {
+		auditAnnotations = map[string]string{policyViolationsAuditAnnotation: strings.Join(messages, "; ")}
+	}
+	var warnings []string
+	if violations.modes[WarnPolicyMode] {
+		for _, message := range messages {
+			warnings = append(warnings, "GMSA policy violation: "+message)
+		}
+	}
+
+	if violations.enforced() {
+		err := violations.aggregatedError()
+		err.auditAnnotations = auditAnnotations
+		err.warnings = warnings
+		return nil, err
+	}
+
+	for _, violation := range violations.violations {
+		logrus.Infof("admitting pod %+v despite GMSA policy violation: %v", violation.pod, violation)
+	}
+	response.AuditAnnotations = auditAnnotations
+	response.Warnings = warnings
+	return response, nil
+}
+
+// enforced returns true iff violations must be denied.
+func (violations *policyViolations) enforced() bool {
+	return violations.modes == nil || violations.modes[EnforcePolicyMode]
+}
+
+// aggregatedError returns a single error covering all the recorded violations, with one cause per violation.
+// Its code is that of the first violation; so is its message if there's only one violation, otherwise it
+// summarizes all of them. Either way, the message ends with the violations' hints, if any.
+func (violations *policyViolations) aggregatedError() *podAdmissionError {
+	first := violations.violations[0]
+	aggregated := &podAdmissionError{error: first.error, code: first.code, pod: first.pod, reason: first.reason, field: first.field}
+
+	var hints []string
+	seenHints := make(map[string]bool)
+	messages := make([]string, len(violations.violations))
+	for i, violation := range violations.violations {
+		messages[i] = violation.Error()
+		aggregated.causes = append(aggregated.causes, violation.cause())
+		if violation.hint != "" && !seenHints[violation.hint] {
+			hints = append(hints, violation.hint)
+			seenHints[violation.hint] = true
+		}
+	}
+
+	message := first.Error()
+	if len(messages) > 1 {
+		message = fmt.Sprintf("%d GMSA policy violations: %s", len(messages), strings.Join(messages, "; "))
+	}
+	if len(hints) != 0 {
+		message += "\n\n" + strings.TrimSpace(strings.Join(hints, "\n"))
+	}
+	aggregated.error = errors.New(message)
+
+	return aggregated
+}
+
+// cause returns the status cause describing a single policy violation.
+func (err *podAdmissionError) cause() metav1.StatusCause {
+	return metav1.StatusCause{Type: err.reason, Field: err.field, Message: err.Error()}
+}
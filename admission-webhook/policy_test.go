@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateCreateRequestPolicyModes(t *testing.T) {
+	kubeClientFactory := func(namespaceLabels, namespaceAnnotations map[string]string) *dummyKubeClient {
+		return &dummyKubeClient{
+			isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (bool, string) {
+				return false, "no role binding"
+			},
+			retrieveNamespaceFunc: func(ctx context.Context, name string) (*corev1.Namespace, int, error) {
+				return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: namespaceLabels, Annotations: namespaceAnnotations}}, http.StatusOK, nil
+			},
+		}
+	}
+
+	// two violations: an unauthorized cred spec, and a hostname that's too long
+	buildViolatingPod := func() *corev1.Pod {
+		hostname := "a-very-long-hostname"
+		return buildPodWithHostName(dummyServiceAccoutName, &hostname, buildWindowsOptions(dummyCredSpecName, ""), nil)
+	}
+
+	t.Run("enforce mode denies violations", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(nil, nil), WithInvalidHostnameMode(DenyInvalidHostnames))
+		pod := buildViolatingPod()
+
+		response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, response)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, "not authorized to `use` GMSA cred spec %q", dummyCredSpecName)
+	})
+
+	t.Run("audit mode admits pods, recording violations as an audit annotation", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(nil, nil), WithPolicyMode(AuditPolicyMode), WithInvalidHostnameMode(DenyInvalidHostnames))
+
+		response, err := webhook.validateCreateRequest(context.Background(), buildViolatingPod(), dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+
+		assert.True(t, response.Allowed)
+		assert.Empty(t, response.Warnings)
+		annotation := response.AuditAnnotations[policyViolationsAuditAnnotation]
+		assert.Contains(t, annotation, fmt.Sprintf("not authorized to `use` GMSA cred spec %q", dummyCredSpecName))
+		assert.Contains(t, annotation, `hostname "a-very-long-hostname" can't be used`)
+	})
+
+	t.Run("warn mode admits pods, returning violations as warnings", func(t *testing.T) {
+		namespaceLabels := map[string]string{policyModeLabel(EnforcePolicyMode): "false", policyModeLabel(WarnPolicyMode): "true"}
+		webhook := newWebhookWithOptions(kubeClientFactory(namespaceLabels, nil), WithInvalidHostnameMode(DenyInvalidHostnames))
+
+		response, err := webhook.validateCreateRequest(context.Background(), buildViolatingPod(), dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+
+		assert.True(t, response.Allowed)
+		assert.Empty(t, response.AuditAnnotations)
+		if assert.Equal(t, 2, len(response.Warnings)) {
+			assert.Contains(t, response.Warnings[0], "GMSA policy violation: ")
+			assert.Contains(t, response.Warnings[0], "not authorized to `use` GMSA cred spec")
+			assert.Contains(t, response.Warnings[1], `hostname "a-very-long-hostname" can't be used`)
+		}
+	})
+
+	t.Run("modes are independent of each other", func(t *testing.T) {
+		namespaceLabels := map[string]string{policyModeLabel(AuditPolicyMode): "true", policyModeLabel(WarnPolicyMode): "true"}
+		webhook := newWebhookWithOptions(kubeClientFactory(namespaceLabels, nil), WithInvalidHostnameMode(DenyInvalidHostnames))
+		pod := buildViolatingPod()
+
+		response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, response)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, "not authorized to `use` GMSA cred spec %q", dummyCredSpecName) {
+			assert.Contains(t, err.auditAnnotations[policyViolationsAuditAnnotation], `hostname "a-very-long-hostname" can't be used`)
+			assert.Equal(t, 2, len(err.warnings))
+		}
+
+		// the audit and warn modes also apply without enforcing
+		namespaceLabels[policyModeLabel(EnforcePolicyMode)] = "false"
+		response, err = webhook.validateCreateRequest(context.Background(), buildViolatingPod(), dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+		assert.Contains(t, response.AuditAnnotations[policyViolationsAuditAnnotation], "not authorized to `use` GMSA cred spec")
+		assert.Equal(t, 2, len(response.Warnings))
+	})
+
+	t.Run("namespaces' labels override the global mode", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(map[string]string{policyModeLabel(EnforcePolicyMode): "true"}, nil), WithPolicyMode(WarnPolicyMode), WithInvalidHostnameMode(DenyInvalidHostnames))
+		pod := buildViolatingPod()
+
+		response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, response)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, "not authorized") {
+			// the global mode stays on
+			assert.Equal(t, 2, len(err.warnings))
+		}
+	})
+
+	t.Run("invalid labels get ignored", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(map[string]string{policyModeLabel(EnforcePolicyMode): "audit"}, nil))
+
+		settings, warnings, err := webhook.podSettings(context.Background(), buildViolatingPod(), dummyNamespace)
+		require.Nil(t, err)
+		assert.True(t, settings.policyModes[EnforcePolicyMode])
+		if assert.Equal(t, 1, len(warnings)) {
+			assert.Contains(t, warnings[0], `ignoring the windows.k8s.io/gmsa-policy-enforce label on namespace "dummy-namespace": "audit" is not a boolean`)
+		}
+	})
+
+	t.Run("pods can turn modes on if their namespace explicitly allows it", func(t *testing.T) {
+		for allowed, expectDenied := range map[string]bool{policyModeLabel(EnforcePolicyMode): true, "*": false, randomHostnameAnnotation: false} {
+			namespaceLabels := map[string]string{policyModeLabel(EnforcePolicyMode): "false", policyModeLabel(WarnPolicyMode): "true"}
+			webhook := newWebhookWithOptions(kubeClientFactory(namespaceLabels, map[string]string{podOverridesAnnotation: allowed}), WithInvalidHostnameMode(DenyInvalidHostnames))
+			pod := buildViolatingPod()
+			pod.Annotations = map[string]string{policyModeLabel(EnforcePolicyMode): "true"}
+
+			response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+			assert.Equal(t, expectDenied, err != nil, "pod overrides: %s", allowed)
+			assert.Equal(t, expectDenied, response == nil, "pod overrides: %s", allowed)
+		}
+	})
+
+	t.Run("pods can't turn modes off", func(t *testing.T) {
+		for _, allowed := range []string{policyModeLabel(EnforcePolicyMode), "*"} {
+			webhook := newWebhookWithOptions(kubeClientFactory(nil, map[string]string{podOverridesAnnotation: allowed}), WithInvalidHostnameMode(DenyInvalidHostnames))
+			pod := buildViolatingPod()
+			pod.Annotations = map[string]string{policyModeLabel(EnforcePolicyMode): "false"}
+
+			response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+			assert.Nil(t, response, "pod overrides: %s", allowed)
+			assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, "not authorized")
+
+			_, warnings, _ := webhook.podSettings(context.Background(), pod, dummyNamespace)
+			if allowed == policyModeLabel(EnforcePolicyMode) && assert.Equal(t, 1, len(warnings)) {
+				assert.Contains(t, warnings[0], "pods can only turn on policy modes that their namespace doesn't")
+			}
+		}
+	})
+
+	t.Run("internal errors get returned regardless of the mode", func(t *testing.T) {
+		client := kubeClientFactory(nil, nil)
+		client.isAuthorizedToUseCredSpecFunc = nil
+		client.retrieveCredSpecContentsFunc = func(ctx context.Context, credSpecName string) (string, int, error) {
+			return "", http.StatusInternalServerError, fmt.Errorf("API server unavailable")
+		}
+		webhook := newWebhookWithOptions(client, WithPolicyMode(AuditPolicyMode))
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), nil)
+
+		response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, response)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusInternalServerError, "API server unavailable")
+	})
+}
+
+func TestValidateCreateRequestAggregatesViolations(t *testing.T) {
+	client := &dummyKubeClient{
+		isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (bool, string) {
+			return credSpecName != "unauthorized-cred-spec", ""
+		},
+	}
+	webhook := newWebhookWithOptions(client, WithAllowedRuntimeClasses([]string{"windows-gmsa"}), WithInvalidHostnameMode(DenyInvalidHostnames))
+
+	hostname := "a-very-long-hostname"
+	pod := buildPodWithHostName(dummyServiceAccoutName, &hostname, nil, nil)
+	pod.Spec.Containers = []corev1.Container{
+		{Name: "fine", SecurityContext: &corev1.SecurityContext{WindowsOptions: buildWindowsOptions(dummyCredSpecName, "")}},
+		{Name: "no-name", SecurityContext: &corev1.SecurityContext{WindowsOptions: buildWindowsOptions("", dummyCredSpecContents)}},
+		{Name: "unauthorized", SecurityContext: &corev1.SecurityContext{WindowsOptions: buildWindowsOptions("unauthorized-cred-spec", "")}},
+	}
+
+	response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+	assert.Nil(t, response)
+	require.NotNil(t, err)
+
+	// the code is that of the first violation
+	assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, "4 GMSA policy violations: ")
+	assert.Equal(t, []metav1.StatusCause{
+		{Type: runtimeClassNotAllowedReason, Field: "spec.runtimeClassName"},
+		{Type: credSpecContentsWithoutNameReason, Field: "spec.containers[1].securityContext.windowsOptions.gmsaCredentialSpecName"},
+		{Type: credSpecUseNotAuthorizedReason, Field: "spec.containers[2].securityContext.windowsOptions.gmsaCredentialSpecName"},
+		{Type: invalidNetBIOSHostnameReason, Field: "spec.hostname"},
+	}, causesWithoutMessages(err.causes))
+	for _, cause := range err.causes {
+		assert.Contains(t, err.Error(), cause.Message)
+	}
+
+	admissionResponse := deniedAdmissionResponse(err)
+	if assert.NotNil(t, admissionResponse.Result.Details) {
+		assert.Equal(t, dummyPodName, admissionResponse.Result.Details.Name)
+		assert.Equal(t, err.causes, admissionResponse.Result.Details.Causes)
+	}
+
+	t.Run("a single violation keeps its own message", func(t *testing.T) {
+		pod.Spec.Hostname = ""
+		pod.Spec.RuntimeClassName = &[]string{"windows-gmsa"}[0]
+		pod.Spec.Containers = pod.Spec.Containers[1:2]
+
+		_, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.NotNil(t, err)
+		assert.Equal(t, `container "no-name" has a GMSA cred spec set, but does not define the name of the corresponding resource`, err.Error())
+		assert.Equal(t, 1, len(err.causes))
+	})
+}
+
+func causesWithoutMessages(causes []metav1.StatusCause) []metav1.StatusCause {
+	result := make([]metav1.StatusCause, len(causes))
+	for i, cause := range causes {
+		result[i] = metav1.StatusCause{Type: cause.Type, Field: cause.Field}
+	}
+	return result
+}
+
+func TestParsePolicyMode(t *testing.T) {
+	mode, err := parsePolicyMode("audit")
+	assert.Nil(t, err)
+	assert.Equal(t, AuditPolicyMode, mode)
+
+	_, err = parsePolicyMode("dryrun")
+	assert.EqualError(t, err, `unknown policy mode "dryrun", known modes are: enforce, audit, warn`)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// GMSAProfile is how strictly the validating webhook restricts how pods spread GMSA's among their containers,
+// similarly to Pod Security Standards' levels.
+type GMSAProfile string
+
+const (
+	// PrivilegedGMSAProfile doesn't restrict anything.
+	PrivilegedGMSAProfile GMSAProfile = "privileged"
+	// BaselineGMSAProfile denies pods whose containers use different GMSA's.
+	BaselineGMSAProfile GMSAProfile = "baseline"
+	// RestrictedGMSAProfile also denies GMSA settings at the container level: only the pod's may name a GMSA.
+	RestrictedGMSAProfile GMSAProfile = "restricted"
+)
+
+var gmsaProfiles = []GMSAProfile{PrivilegedGMSAProfile, BaselineGMSAProfile, RestrictedGMSAProfile}
+
+// gmsaProfileLabel can be set on namespaces to override the global GMSA profile for pods in these namespaces.
+const gmsaProfileLabel = "windows.k8s.io/gmsa-profile"
+
+func parseGMSAProfile(profile string) (GMSAProfile, error) {
+	profiles := make([]string, len(gmsaProfiles))
+	for i, known := range gmsaProfiles {
+		if GMSAProfile(profile) == known {
+			return known, nil
+		}
+		profiles[i] = string(known)
+	}
+	return "", fmt.Errorf("unknown GMSA profile %q, known profiles are: %s", profile, strings.Join(profiles, ", "))
+}
+
+// checkGMSAProfile records a violation for each of the pod's GMSA settings that its profile forbids: with the
+// baseline profile, those naming a different cred spec than the first one the pod names; with the restricted
+// profile, also those set at the container level. Resources for which `skip` returns true still count towards
+// the pod's cred spec, but don't get checked.
+func checkGMSAProfile(pod *corev1.Pod, profile GMSAProfile, violations *policyViolations, skip func(resourceKind gmsaResourceKind, resourceName string) bool) {
+	if profile != BaselineGMSAProfile && profile != RestrictedGMSAProfile {
+		return
+	}
+
+	podCredSpecName := ""
+	iterateOverWindowsSecurityOptions(pod, func(windowsOptions *corev1.WindowsSecurityContextOptions, resourceKind gmsaResourceKind, resourceName string, containerIndex int) *podAdmissionError {
+		check := skip == nil || !skip(resourceKind, resourceName)
+		windowsOptionsPath := resourceSpecPath(resourceKind, containerIndex) + "/securityContext/windowsOptions"
+
+		if check && profile == RestrictedGMSAProfile && resourceKind != podKind &&
+			(windowsOptions.GMSACredentialSpecName != nil || windowsOptions.GMSACredentialSpec != nil) {
+			msg := fmt.Sprintf("%s %q has GMSA settings, but the %s GMSA profile only allows them at the pod level", resourceKind, resourceName, profile)
+			violations.check(&podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusForbidden, reason: containerLevelGMSAReason, field: fieldPath(windowsOptionsPath)})
+		}
+
+		if windowsOptions.GMSACredentialSpecName == nil {
+			return nil
+		}
+		credSpecName := *windowsOptions.GMSACredentialSpecName
+		if podCredSpecName == "" {
+			podCredSpecName = credSpecName
+		} else if check && credSpecName != podCredSpecName {
+			msg := fmt.Sprintf("%s %q uses GMSA cred spec %q, but its pod already uses %q; the %s GMSA profile only allows a single GMSA per pod",
+				resourceKind, resourceName, credSpecName, podCredSpecName, profile)
+			violations.check(&podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusForbidden, reason: multipleCredSpecsReason, field: fieldPath(windowsOptionsPath + "/gmsaCredentialSpecName")})
+		}
+		return nil
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateCreateRequestGMSAProfiles(t *testing.T) {
+	kubeClientFactory := func(namespaceLabels map[string]string) *dummyKubeClient {
+		return &dummyKubeClient{
+			retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+				return &gmsaCredSpec{name: credSpecName, contents: dummyCredSpecContents}, http.StatusOK, nil
+			},
+			retrieveNamespaceFunc: func(ctx context.Context, name string) (*corev1.Namespace, int, error) {
+				return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: namespaceLabels}}, http.StatusOK, nil
+			},
+		}
+	}
+
+	podLevelPod := func() *corev1.Pod {
+		return buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+	}
+	sameCredSpecPod := func() *corev1.Pod {
+		return buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents),
+		})
+	}
+	mixedCredSpecsPod := func() *corev1.Pod {
+		return buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions("other-cred-spec", dummyCredSpecContents),
+		})
+	}
+
+	validate := func(pod *corev1.Pod, profile GMSAProfile, namespaceLabels map[string]string) (bool, *podAdmissionError) {
+		response, err := newWebhookWithOptions(kubeClientFactory(namespaceLabels), WithGMSAProfile(profile)).validateCreateRequest(context.Background(), pod, dummyNamespace)
+		return response != nil && response.Allowed, err
+	}
+
+	t.Run("the privileged profile allows anything", func(t *testing.T) {
+		for _, profile := range []GMSAProfile{"", PrivilegedGMSAProfile} {
+			allowed, err := validate(mixedCredSpecsPod(), profile, nil)
+			assert.Nil(t, err)
+			assert.True(t, allowed)
+		}
+	})
+
+	t.Run("the baseline profile denies pods using different cred specs", func(t *testing.T) {
+		allowed, err := validate(sameCredSpecPod(), BaselineGMSAProfile, nil)
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+
+		pod := mixedCredSpecsPod()
+		allowed, err = validate(pod, BaselineGMSAProfile, nil)
+		assert.False(t, allowed)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden,
+			`container %q uses GMSA cred spec "other-cred-spec", but its pod already uses %q; the baseline GMSA profile only allows a single GMSA per pod`,
+			dummyContainerName, dummyCredSpecName) {
+			assert.Equal(t, multipleCredSpecsReason, err.reason)
+			assert.Equal(t, "spec.containers[0].securityContext.windowsOptions.gmsaCredentialSpecName", err.field)
+		}
+	})
+
+	t.Run("the restricted profile only allows pod-level GMSA settings", func(t *testing.T) {
+		allowed, err := validate(podLevelPod(), RestrictedGMSAProfile, nil)
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+
+		pod := sameCredSpecPod()
+		allowed, err = validate(pod, RestrictedGMSAProfile, nil)
+		assert.False(t, allowed)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden,
+			"container %q has GMSA settings, but the restricted GMSA profile only allows them at the pod level", dummyContainerName) {
+			assert.Equal(t, containerLevelGMSAReason, err.reason)
+			assert.Equal(t, "spec.containers[0].securityContext.windowsOptions", err.field)
+		}
+
+		pod = mixedCredSpecsPod()
+		_, err = validate(pod, RestrictedGMSAProfile, nil)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, 2, len(err.causes))
+		}
+	})
+
+	t.Run("namespaces can override the profile", func(t *testing.T) {
+		allowed, err := validate(mixedCredSpecsPod(), PrivilegedGMSAProfile, map[string]string{gmsaProfileLabel: "baseline"})
+		assert.False(t, allowed)
+		assert.NotNil(t, err)
+
+		allowed, err = validate(mixedCredSpecsPod(), RestrictedGMSAProfile, map[string]string{gmsaProfileLabel: "privileged"})
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	})
+
+	t.Run("invalid namespace labels are ignored with a warning", func(t *testing.T) {
+		settings, warnings, err := newWebhookWithOptions(kubeClientFactory(map[string]string{gmsaProfileLabel: "lax"}), WithGMSAProfile(BaselineGMSAProfile)).
+			podSettings(context.Background(), podLevelPod(), dummyNamespace)
+		require.Nil(t, err)
+		assert.Equal(t, BaselineGMSAProfile, settings.profile)
+		assert.Equal(t, []string{`ignoring the windows.k8s.io/gmsa-profile label on namespace "dummy-namespace": ` +
+			`unknown GMSA profile "lax", known profiles are: privileged, baseline, restricted`}, warnings)
+	})
+
+	t.Run("on updates, only new ephemeral containers get checked", func(t *testing.T) {
+		oldPod := mixedCredSpecsPod()
+		oldPod.Spec.EphemeralContainers = []corev1.EphemeralContainer{buildEphemeralContainer("existing-debugger", buildWindowsOptions("debug-cred-spec", dummyCredSpecContents))}
+
+		pod := oldPod.DeepCopy()
+		pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, buildEphemeralContainer(dummyEphemeralContainerName, buildWindowsOptions("debug-cred-spec", dummyCredSpecContents)))
+
+		response, err := newWebhookWithOptions(kubeClientFactory(nil), WithGMSAProfile(BaselineGMSAProfile)).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
+		assert.Nil(t, response)
+		if assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden,
+			`%s %q uses GMSA cred spec "debug-cred-spec", but its pod already uses %q`, ephemeralContainerKind, dummyEphemeralContainerName, dummyCredSpecName) {
+			assert.Equal(t, 1, len(err.causes))
+		}
+	})
+}
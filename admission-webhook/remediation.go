@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// credSpecUseClusterRoleTemplate is the minimal cluster role granting `use` on a single cred spec;
+// its arguments are the cred spec's name and the cluster role's name.
+const credSpecUseClusterRoleTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: %[2]s
+rules:
+- apiGroups: ["windows.k8s.io"]
+  resources: ["gmsacredentialspecs"]
+  verbs: ["use"]
+  resourceNames: ["%[1]s"]
+`
+
+// credSpecUseRoleBindingTemplate binds a role to a service account in its namespace; its arguments are the
+// service account's name and namespace, and the bound role's kind and name.
+const credSpecUseRoleBindingTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: %[1]s-%[4]s
+  namespace: %[2]s
+subjects:
+- kind: ServiceAccount
+  name: %[1]s
+  namespace: %[2]s
+roleRef:
+  kind: %[3]s
+  name: %[4]s
+  apiGroup: rbac.authorization.k8s.io
+`
+
+type userInfoContextKey struct{}
+
+// withUserInfo returns a context recording the user making the admission request being handled.
+func withUserInfo(ctx context.Context, userInfo authenticationv1.UserInfo) context.Context {
+	return context.WithValue(ctx, userInfoContextKey{}, userInfo)
+}
+
+func requestUserInfo(ctx context.Context) (authenticationv1.UserInfo, bool) {
+	userInfo, found := ctx.Value(userInfoContextKey{}).(authenticationv1.UserInfo)
+	return userInfo, found
+}
+
+// credSpecUseRemediation returns a hint on how to authorize a service account to `use` a cred spec: the YAML of
+// the minimal cluster role and role binding granting it. If role suggestions are enabled, and the user making the
+// request can list roles themselves, it also lists the existing roles that come close, and if one of them already
+// grants `use` on the cred spec, the YAML only binds that role to the service account.
+func (webhook *webhook) credSpecUseRemediation(ctx context.Context, serviceAccountName, namespace, credSpecName string) string {
+	var granting *roleDescription
+	var nearMatches []string
+
+	if webhook.canSuggestRoles(ctx, namespace) {
+		clusterRoles, roles, code, err := webhook.client.listRoles(ctx, namespace)
+		if err != nil {
+			if code == http.StatusForbidden {
+				logrus.Debugf("not suggesting existing roles granting access to GMSA cred spec %q: %v", credSpecName, err)
+			} else {
+				logrus.Warnf("unable to list roles to suggest ones granting access to GMSA cred spec %q: %v", credSpecName, err)
+			}
+		} else {
+			granting, nearMatches = closeCredSpecRoles(credSpecName, clusterRoles, roles)
+		}
+	}
+
+	var yaml string
+	if granting != nil {
+		yaml = fmt.Sprintf(credSpecUseRoleBindingTemplate, serviceAccountName, namespace, granting.kind, granting.name)
+	} else {
+		roleName := "gmsa-use-" + credSpecName
+		yaml = fmt.Sprintf(credSpecUseClusterRoleTemplate, credSpecName, roleName) + "---\n" +
+			fmt.Sprintf(credSpecUseRoleBindingTemplate, serviceAccountName, namespace, "ClusterRole", roleName)
+	}
+
+	hint := fmt.Sprintf("to authorize service account %q to `use` GMSA cred spec %q, apply:\n%s", serviceAccountName, credSpecName, yaml)
+	if len(nearMatches) != 0 {
+		hint += "existing roles that come close:\n  - " + strings.Join(nearMatches, "\n  - ") + "\n"
+	}
+	return hint
+}
+
+// canSuggestRoles returns true iff role suggestions are enabled, and the user making the request is allowed
+// to list roles, so that denial messages don't disclose roles to users who couldn't see them otherwise.
+func (webhook *webhook) canSuggestRoles(ctx context.Context, namespace string) bool {
+	if !webhook.config.EnableRoleSuggestions {
+		return false
+	}
+	userInfo, found := requestUserInfo(ctx)
+	return found && webhook.client.canListRoles(ctx, userInfo, namespace)
+}
+
+// roleDescription identifies a cluster role or a role.
+type roleDescription struct {
+	kind string
+	name string
+}
+
+func (role roleDescription) String() string {
+	return fmt.Sprintf("%s %q", role.kind, role.name)
+}
+
+// closeCredSpecRoles looks for roles that grant `use` on the given cred spec, and returns the first one it finds,
+// if any. It also returns descriptions of the roles that come close: those granting `use` on other cred specs,
+// or other verbs on that specific cred spec.
+// Rules granting access to all cred specs, or using wildcards for verbs, are ignored, as they grant much more
+// than needed.
+func closeCredSpecRoles(credSpecName string, clusterRoles []rbacv1.ClusterRole, roles []rbacv1.Role) (*roleDescription, []string) {
+	var granting *roleDescription
+	var nearMatches []string
+
+	check := func(role roleDescription, rules []rbacv1.PolicyRule) {
+		for _, rule := range rules {
+			if !containsString(rule.APIGroups, crdAPIGroup) || !containsString(rule.Resources, crdResourceName) ||
+				len(rule.ResourceNames) == 0 || containsString(rule.Verbs, rbacv1.VerbAll) {
+				continue
+			}
+
+			grantsUse := containsString(rule.Verbs, "use")
+			coversCredSpec := containsString(rule.ResourceNames, credSpecName)
+
+			switch {
+			case grantsUse && coversCredSpec:
+				if granting == nil {
+					granting = &role
+				}
+				nearMatches = append(nearMatches, fmt.Sprintf("%v already grants `use` on it", role))
+			case grantsUse:
+				resourceNames := append([]string(nil), rule.ResourceNames...)
+				sort.Strings(resourceNames)
+				nearMatches = append(nearMatches, fmt.Sprintf("%v grants `use` on other cred specs: %s", role, strings.Join(resourceNames, ", ")))
+			case coversCredSpec:
+				nearMatches = append(nearMatches, fmt.Sprintf("%v grants %s on it, but not `use`", role, strings.Join(rule.Verbs, ", ")))
+			default:
+				continue
+			}
+			return
+		}
+	}
+
+	for _, clusterRole := range clusterRoles {
+		check(roleDescription{kind: "ClusterRole", name: clusterRole.Name}, clusterRole.Rules)
+	}
+	for _, role := range roles {
+		check(roleDescription{kind: "Role", name: role.Name}, role.Rules)
+	}
+
+	return granting, nearMatches
+}
+
+// containsString returns true iff `values` contains `value`.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func buildCredSpecRule(verbs []string, credSpecNames ...string) rbacv1.PolicyRule {
+	return rbacv1.PolicyRule{APIGroups: []string{crdAPIGroup}, Resources: []string{crdResourceName}, Verbs: verbs, ResourceNames: credSpecNames}
+}
+
+func TestCloseCredSpecRoles(t *testing.T) {
+	clusterRoles := []rbacv1.ClusterRole{
+		{ObjectMeta: metav1.ObjectMeta{Name: "all-cred-specs"}, Rules: []rbacv1.PolicyRule{buildCredSpecRule([]string{"use"})}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "wildcard"}, Rules: []rbacv1.PolicyRule{buildCredSpecRule([]string{"*"}, dummyCredSpecName)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "unrelated"}, Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "other-cred-specs"}, Rules: []rbacv1.PolicyRule{buildCredSpecRule([]string{"use"}, "b-cred-spec", "a-cred-spec")}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "reader"}, Rules: []rbacv1.PolicyRule{buildCredSpecRule([]string{"get", "list"}, dummyCredSpecName)}},
+	}
+
+	t.Run("without any role granting `use` on the cred spec", func(t *testing.T) {
+		granting, nearMatches := closeCredSpecRoles(dummyCredSpecName, clusterRoles, nil)
+		assert.Nil(t, granting)
+		assert.Equal(t, []string{
+			`ClusterRole "other-cred-specs" grants ` + "`use`" + ` on other cred specs: a-cred-spec, b-cred-spec`,
+			`ClusterRole "reader" grants get, list on it, but not ` + "`use`",
+		}, nearMatches)
+	})
+
+	t.Run("with a role granting `use` on the cred spec", func(t *testing.T) {
+		roles := []rbacv1.Role{{ObjectMeta: metav1.ObjectMeta{Name: "granting", Namespace: dummyNamespace}, Rules: []rbacv1.PolicyRule{buildCredSpecRule([]string{"use"}, dummyCredSpecName)}}}
+
+		granting, nearMatches := closeCredSpecRoles(dummyCredSpecName, clusterRoles, roles)
+		if assert.NotNil(t, granting) {
+			assert.Equal(t, roleDescription{kind: "Role", name: "granting"}, *granting)
+		}
+		assert.Contains(t, nearMatches, `Role "granting" already grants `+"`use`"+` on it`)
+	})
+}
+
+func TestValidateCreateRequestRemediationHints(t *testing.T) {
+	buildClient := func(listRolesFunc func(ctx context.Context, namespace string) ([]rbacv1.ClusterRole, []rbacv1.Role, int, error)) *dummyKubeClient {
+		return &dummyKubeClient{
+			isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (bool, string) {
+				return false, ""
+			},
+			listRolesFunc: listRolesFunc,
+		}
+	}
+	dummyUserInfo := authenticationv1.UserInfo{Username: "dummy-user", Groups: []string{"dummy-group"}}
+	validate := func(t *testing.T, client *dummyKubeClient, options ...WebhookOption) (string, *podAdmissionError) {
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""), map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions(dummyCredSpecName, ""),
+		})
+		ctx := withUserInfo(context.Background(), dummyUserInfo)
+		response, err := newWebhookWithOptions(client, options...).validateCreateRequest(ctx, pod, dummyNamespace)
+		if err == nil {
+			require.NotNil(t, response)
+			return "", nil
+		}
+		return err.Error(), err
+	}
+
+	t.Run("denials include the minimal cluster role and role binding, once", func(t *testing.T) {
+		message, err := validate(t, buildClient(nil))
+		require.NotNil(t, err)
+
+		assert.Contains(t, message, fmt.Sprintf("to authorize service account %q to `use` GMSA cred spec %q, apply:\n", dummyServiceAccoutName, dummyCredSpecName))
+		assert.Contains(t, message, "kind: ClusterRole\nmetadata:\n  name: gmsa-use-"+dummyCredSpecName+"\n")
+		assert.Contains(t, message, fmt.Sprintf("  resourceNames: [%q]\n", dummyCredSpecName))
+		assert.Contains(t, message, fmt.Sprintf("subjects:\n- kind: ServiceAccount\n  name: %s\n  namespace: %s\n", dummyServiceAccoutName, dummyNamespace))
+		assert.Equal(t, 2, len(err.causes))
+		assert.Equal(t, 1, strings.Count(message, "to authorize service account"))
+		assert.NotContains(t, message, "existing roles that come close")
+	})
+
+	t.Run("existing roles granting `use` get bound instead", func(t *testing.T) {
+		message, err := validate(t, buildClient(func(ctx context.Context, namespace string) ([]rbacv1.ClusterRole, []rbacv1.Role, int, error) {
+			return []rbacv1.ClusterRole{{ObjectMeta: metav1.ObjectMeta{Name: "granting"}, Rules: []rbacv1.PolicyRule{buildCredSpecRule([]string{"use"}, dummyCredSpecName)}}}, nil, http.StatusOK, nil
+		}), WithRoleSuggestions(true))
+		require.NotNil(t, err)
+
+		assert.NotContains(t, message, "kind: ClusterRole\nmetadata:")
+		assert.Contains(t, message, "roleRef:\n  kind: ClusterRole\n  name: granting\n")
+		assert.Contains(t, message, "existing roles that come close:\n  - ClusterRole \"granting\" already grants `use` on it")
+	})
+
+	t.Run("not being allowed to list roles is fine", func(t *testing.T) {
+		message, err := validate(t, buildClient(func(ctx context.Context, namespace string) ([]rbacv1.ClusterRole, []rbacv1.Role, int, error) {
+			return nil, nil, http.StatusForbidden, fmt.Errorf("forbidden")
+		}), WithRoleSuggestions(true))
+		require.NotNil(t, err)
+
+		assert.Contains(t, message, "name: gmsa-use-"+dummyCredSpecName)
+	})
+
+	t.Run("hints are only computed when denying pods", func(t *testing.T) {
+		listed := false
+		_, err := validate(t, buildClient(func(ctx context.Context, namespace string) ([]rbacv1.ClusterRole, []rbacv1.Role, int, error) {
+			listed = true
+			return nil, nil, http.StatusOK, nil
+		}), WithPolicyMode(WarnPolicyMode), WithRoleSuggestions(true))
+		assert.Nil(t, err)
+		assert.False(t, listed)
+	})
+
+	t.Run("existing roles are only suggested if enabled", func(t *testing.T) {
+		listed := false
+		message, err := validate(t, buildClient(func(ctx context.Context, namespace string) ([]rbacv1.ClusterRole, []rbacv1.Role, int, error) {
+			listed = true
+			return nil, nil, http.StatusOK, nil
+		}))
+		require.NotNil(t, err)
+
+		assert.Contains(t, message, "name: gmsa-use-"+dummyCredSpecName)
+		assert.False(t, listed)
+	})
+
+	t.Run("existing roles are only suggested to users allowed to list them", func(t *testing.T) {
+		var checkedUserInfo authenticationv1.UserInfo
+		var checkedNamespace string
+		client := buildClient(func(ctx context.Context, namespace string) ([]rbacv1.ClusterRole, []rbacv1.Role, int, error) {
+			return []rbacv1.ClusterRole{{ObjectMeta: metav1.ObjectMeta{Name: "granting"}, Rules: []rbacv1.PolicyRule{buildCredSpecRule([]string{"use"}, dummyCredSpecName)}}}, nil, http.StatusOK, nil
+		})
+		client.canListRolesFunc = func(ctx context.Context, userInfo authenticationv1.UserInfo, namespace string) bool {
+			checkedUserInfo = userInfo
+			checkedNamespace = namespace
+			return false
+		}
+
+		message, err := validate(t, client, WithRoleSuggestions(true))
+		require.NotNil(t, err)
+
+		assert.Equal(t, dummyUserInfo, checkedUserInfo)
+		assert.Equal(t, dummyNamespace, checkedNamespace)
+		assert.Contains(t, message, "kind: ClusterRole\nmetadata:\n  name: gmsa-use-"+dummyCredSpecName+"\n")
+		assert.NotContains(t, message, "granting")
+		assert.NotContains(t, message, "existing roles that come close")
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// repairCredSpecContentsPatch returns the JSON patch replacing the GMSA contents pre-set in `windowsOptions` with
+// the current contents of the GMSA resource it names, if they don't match them, e.g. because they got copied from
+// an old manifest; it also warns about it. It returns nil if the contents aren't pre-set, or if they match.
+func (webhook *webhook) repairCredSpecContentsPatch(ctx context.Context, pod *corev1.Pod, credSpecs *credSpecCache, windowsOptions *corev1.WindowsSecurityContextOptions, resourceKind gmsaResourceKind, resourceName string, containerIndex int) (*jsonPatchOperation, *podAdmissionError) {
+	if windowsOptions.GMSACredentialSpecName == nil || windowsOptions.GMSACredentialSpec == nil {
+		return nil, nil
+	}
+	credSpecName := *windowsOptions.GMSACredentialSpecName
+
+	credSpec, code, retrieveErr := credSpecs.get(ctx, credSpecName)
+	if retrieveErr != nil {
+		return nil, &podAdmissionError{error: retrieveErr, pod: pod, code: code}
+	}
+
+	difference, compareErr := compareCredSpecContents(*windowsOptions.GMSACredentialSpec, credSpec.contents)
+	if difference == nil && compareErr == nil {
+		return nil, nil
+	}
+	auditCredSpec(ctx, credSpec)
+
+	reason := fmt.Sprint(difference)
+	if compareErr != nil {
+		reason = compareErr.Error()
+	}
+	addWarnings(ctx, fmt.Sprintf("the GMSA cred spec contents for %s %q did not match the contents of GMSA resource %q (%s), "+
+		"and got replaced with them", resourceKind, resourceName, credSpecName, reason))
+
+	windowsOptions.GMSACredentialSpec = &credSpec.contents
+	return &jsonPatchOperation{
+		Op:    "replace",
+		Path:  fmt.Sprintf("%s/securityContext/windowsOptions/gmsaCredentialSpec", resourceSpecPath(resourceKind, containerIndex)),
+		Value: credSpec.contents,
+	}, nil
+}
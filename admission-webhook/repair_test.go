@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutateCreateRequestRepairsCredSpecContents(t *testing.T) {
+	staleContents := `{"We don't need no": ["money"], "All in all you're just another": {"brick": "in", "the": "wall"}}`
+
+	kubeClientFactory := func(namespaceAnnotations map[string]string) *dummyKubeClient {
+		return &dummyKubeClient{
+			retrieveNamespaceFunc: func(ctx context.Context, name string) (*corev1.Namespace, int, error) {
+				return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: namespaceAnnotations}}, http.StatusOK, nil
+			},
+		}
+	}
+
+	buildStalePod := func() *corev1.Pod {
+		return buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions(dummyCredSpecName, staleContents),
+		})
+	}
+
+	t.Run("when enabled, stale contents get replaced with a warning", func(t *testing.T) {
+		pod := buildStalePod()
+		ctx, warnings := withWarnings(context.Background())
+
+		response, err := newWebhookWithOptions(kubeClientFactory(nil), WithCredSpecContentsRepair(true)).mutateCreateRequest(ctx, pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+
+		var patches []jsonPatchOperation
+		require.Nil(t, json.Unmarshal(response.Patch, &patches))
+		assert.Equal(t, []jsonPatchOperation{{
+			Op:    "replace",
+			Path:  "/spec/containers/0/securityContext/windowsOptions/gmsaCredentialSpec",
+			Value: dummyCredSpecContents,
+		}}, patches)
+		assert.Equal(t, []string{`the GMSA cred spec contents for container "dummy-container-name" did not match the contents of GMSA resource "dummy-cred-spec-name" ` +
+			`(field We don't need no[0] differs), and got replaced with them`}, warnings.list())
+
+		validationResponse, validationErr := newWebhook(&dummyKubeClient{}).validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, validationErr)
+		require.NotNil(t, validationResponse)
+		assert.True(t, validationResponse.Allowed)
+	})
+
+	t.Run("contents that are not even JSON get replaced too", func(t *testing.T) {
+		pod := buildStalePod()
+		setWindowsOptions(pod.Spec.Containers[0].SecurityContext.WindowsOptions, dummyCredSpecName, "i ain't no JSON object")
+
+		response, err := newWebhookWithOptions(kubeClientFactory(nil), WithCredSpecContentsRepair(true)).mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+		assert.Contains(t, string(response.Patch), `"op":"replace"`)
+	})
+
+	t.Run("namespaces can enable it", func(t *testing.T) {
+		pod := buildStalePod()
+
+		response, err := newWebhook(kubeClientFactory(map[string]string{repairCredSpecContentsAnnotation: "true"})).mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+		assert.Contains(t, string(response.Patch), `"op":"replace"`)
+	})
+
+	t.Run("by default, stale contents are left for the validation to deny", func(t *testing.T) {
+		pod := buildStalePod()
+
+		response, err := newWebhook(kubeClientFactory(nil)).mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+		assert.Nil(t, response.Patch)
+
+		response, err = newWebhookWithOptions(kubeClientFactory(map[string]string{repairCredSpecContentsAnnotation: "false"}), WithCredSpecContentsRepair(true)).mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+		assert.Nil(t, response.Patch)
+	})
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+const (
+	// runtimeClassAnnotation can be set on GMSA cred specs and namespaces to the name of the runtime class
+	// that pods using these cred specs, respectively in these namespaces, should get when they don't set one.
+	runtimeClassAnnotation = "windows.k8s.io/gmsa-runtime-class"
+
+	// nodeSelectorAnnotation can be set on GMSA cred specs to a label selector, e.g. `gmsa-domain=contoso.com`,
+	// restricting the nodes that pods using these cred specs can be scheduled on, typically to the ones joined
+	// to the right domain.
+	nodeSelectorAnnotation = "windows.k8s.io/gmsa-node-selector"
+)
+
+// nodeSelectorOperators maps label selector operators to their node selector equivalent.
+var nodeSelectorOperators = map[selection.Operator]corev1.NodeSelectorOperator{
+	selection.Equals:       corev1.NodeSelectorOpIn,
+	selection.DoubleEquals: corev1.NodeSelectorOpIn,
+	selection.In:           corev1.NodeSelectorOpIn,
+	selection.NotEquals:    corev1.NodeSelectorOpNotIn,
+	selection.NotIn:        corev1.NodeSelectorOpNotIn,
+	selection.Exists:       corev1.NodeSelectorOpExists,
+	selection.DoesNotExist: corev1.NodeSelectorOpDoesNotExist,
+	selection.GreaterThan:  corev1.NodeSelectorOpGt,
+	selection.LessThan:     corev1.NodeSelectorOpLt,
+}
+
+// schedulingPatches returns the JSON patches making sure that a pod using GMSA's gets scheduled on Windows
+// nodes, as configured: setting its OS field, its `kubernetes.io/os` node selector, and adding tolerations.
+// The pod itself gets updated too.
+func (webhook *webhook) schedulingPatches(pod *corev1.Pod, settings *podSettings) []jsonPatchOperation {
+	var patches []jsonPatchOperation
+
+	if settings.podOS && pod.Spec.OS == nil {
+		pod.Spec.OS = &corev1.PodOS{Name: corev1.Windows}
+		patches = append(patches, jsonPatchOperation{Op: "add", Path: "/spec/os", Value: pod.Spec.OS})
+	}
+
+	if webhook.config.EnableWindowsNodeSelector {
+		if _, present := pod.Spec.NodeSelector[corev1.LabelOSStable]; !present {
+			if pod.Spec.NodeSelector == nil {
+				pod.Spec.NodeSelector = map[string]string{}
+				patches = append(patches, jsonPatchOperation{Op: "add", Path: "/spec/nodeSelector", Value: struct{}{}})
+			}
+			pod.Spec.NodeSelector[corev1.LabelOSStable] = string(corev1.Windows)
+			patches = append(patches, jsonPatchOperation{Op: "add", Path: "/spec/nodeSelector/" + escapeJSONPointer(corev1.LabelOSStable), Value: string(corev1.Windows)})
+		}
+	}
+
+	for _, toleration := range webhook.config.WindowsTolerations {
+		if hasToleration(pod, toleration) {
+			continue
+		}
+		if pod.Spec.Tolerations == nil {
+			patches = append(patches, jsonPatchOperation{Op: "add", Path: "/spec/tolerations", Value: []corev1.Toleration{}})
+		}
+		pod.Spec.Tolerations = append(pod.Spec.Tolerations, toleration)
+		patches = append(patches, jsonPatchOperation{Op: "add", Path: "/spec/tolerations/-", Value: toleration})
+	}
+
+	return patches
+}
+
+// hasToleration returns true iff the pod already has the given toleration.
+func hasToleration(pod *corev1.Pod, toleration corev1.Toleration) bool {
+	for i := range pod.Spec.Tolerations {
+		if pod.Spec.Tolerations[i].MatchToleration(&toleration) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeJSONPointer escapes a map key so that it can be used as a segment of a JSON patch path,
+// see https://tools.ietf.org/html/rfc6901#section-3
+func escapeJSONPointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// runtimeClassPatches returns the JSON patch setting the runtime class of a pod that doesn't set one itself,
+// to the one requested by the `runtimeClassAnnotation` of the GMSA cred specs it uses, or failing that
+// to its namespace's default one.
+// The pod itself gets updated too.
+func (webhook *webhook) runtimeClassPatches(ctx context.Context, pod *corev1.Pod, namespace string, credSpecs *credSpecCache) ([]jsonPatchOperation, *podAdmissionError) {
+	if !webhook.config.EnableRuntimeClassInjection || pod.Spec.RuntimeClassName != nil {
+		return nil, nil
+	}
+
+	var runtimeClassName, source string
+	for _, credSpecName := range credSpecNames(pod) {
+		credSpec, code, err := credSpecs.get(ctx, credSpecName)
+		if err != nil {
+			return nil, &podAdmissionError{error: err, pod: pod, code: code}
+		}
+
+		name := strings.TrimSpace(credSpec.annotations[runtimeClassAnnotation])
+		if name == "" {
+			continue
+		}
+		if runtimeClassName != "" && name != runtimeClassName {
+			msg := fmt.Errorf("GMSA cred specs %q and %q require different runtime classes, respectively %q and %q", source, credSpecName, runtimeClassName, name)
+			return nil, &podAdmissionError{error: msg, pod: pod, code: http.StatusUnprocessableEntity}
+		}
+		runtimeClassName, source = name, credSpecName
+	}
+
+	if runtimeClassName == "" {
+		ns, code, err := webhook.client.retrieveNamespace(ctx, namespace)
+		if err != nil && code != http.StatusNotFound {
+			return nil, &podAdmissionError{error: err, pod: pod, code: code}
+		}
+		if ns != nil {
+			runtimeClassName = strings.TrimSpace(ns.Annotations[runtimeClassAnnotation])
+		}
+		if runtimeClassName == "" {
+			return nil, nil
+		}
+	}
+
+	pod.Spec.RuntimeClassName = &runtimeClassName
+	return []jsonPatchOperation{{Op: "add", Path: "/spec/runtimeClassName", Value: runtimeClassName}}, nil
+}
+
+// isAllowedRuntimeClass returns true iff no allowed runtime classes are configured, or the pod uses one of them.
+func (webhook *webhook) isAllowedRuntimeClass(pod *corev1.Pod) bool {
+	if len(webhook.config.AllowedRuntimeClasses) == 0 {
+		return true
+	}
+	if pod.Spec.RuntimeClassName == nil {
+		return false
+	}
+	for _, allowed := range webhook.config.AllowedRuntimeClasses {
+		if *pod.Spec.RuntimeClassName == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// runtimeClassDescription describes the pod's runtime class for error messages.
+func runtimeClassDescription(pod *corev1.Pod) string {
+	if pod.Spec.RuntimeClassName == nil {
+		return "(none)"
+	}
+	return fmt.Sprintf("%q", *pod.Spec.RuntimeClassName)
+}
+
+// nodeAffinityPatches returns the JSON patch merging the node selectors carried by the `nodeSelectorAnnotation`
+// of the GMSA cred specs that the pod uses into its required node affinity, so that it only gets scheduled on
+// nodes matching all of them on top of its own constraints.
+// The pod itself gets updated too.
+func (webhook *webhook) nodeAffinityPatches(ctx context.Context, pod *corev1.Pod, credSpecs *credSpecCache) ([]jsonPatchOperation, *podAdmissionError) {
+	if !webhook.config.EnableCredSpecNodeSelectors {
+		return nil, nil
+	}
+
+	var requirements []corev1.NodeSelectorRequirement
+	for _, credSpecName := range credSpecNames(pod) {
+		credSpec, code, err := credSpecs.get(ctx, credSpecName)
+		if err != nil {
+			return nil, &podAdmissionError{error: err, pod: pod, code: code}
+		}
+
+		credSpecRequirements, err := parseNodeSelectorAnnotation(credSpec.annotations[nodeSelectorAnnotation])
+		if err != nil {
+			msg := fmt.Errorf("GMSA cred spec %q has an invalid %s annotation: %v", credSpecName, nodeSelectorAnnotation, err)
+			return nil, &podAdmissionError{error: msg, pod: pod, code: http.StatusUnprocessableEntity}
+		}
+		requirements = append(requirements, credSpecRequirements...)
+	}
+	if len(requirements) == 0 {
+		return nil, nil
+	}
+
+	var existing *corev1.NodeSelector
+	if pod.Spec.Affinity != nil && pod.Spec.Affinity.NodeAffinity != nil {
+		existing = pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	}
+	required, changed := mergeNodeSelectorRequirements(existing, requirements)
+	if !changed {
+		return nil, nil
+	}
+
+	// patch the deepest object that already exists
+	switch {
+	case pod.Spec.Affinity == nil:
+		pod.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required}}
+		return []jsonPatchOperation{{Op: "add", Path: "/spec/affinity", Value: pod.Spec.Affinity}}, nil
+	case pod.Spec.Affinity.NodeAffinity == nil:
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required}
+		return []jsonPatchOperation{{Op: "add", Path: "/spec/affinity/nodeAffinity", Value: pod.Spec.Affinity.NodeAffinity}}, nil
+	default:
+		pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = required
+		return []jsonPatchOperation{{Op: "add", Path: "/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution", Value: required}}, nil
+	}
+}
+
+// parseNodeSelectorAnnotation parses a label selector, and turns it into node selector requirements.
+func parseNodeSelectorAnnotation(annotation string) ([]corev1.NodeSelectorRequirement, error) {
+	if strings.TrimSpace(annotation) == "" {
+		return nil, nil
+	}
+
+	selector, err := labels.Parse(annotation)
+	if err != nil {
+		return nil, err
+	}
+	labelRequirements, _ := selector.Requirements()
+
+	requirements := make([]corev1.NodeSelectorRequirement, 0, len(labelRequirements))
+	for _, labelRequirement := range labelRequirements {
+		operator, supported := nodeSelectorOperators[labelRequirement.Operator()]
+		if !supported {
+			return nil, fmt.Errorf("unsupported operator %q", labelRequirement.Operator())
+		}
+
+		requirement := corev1.NodeSelectorRequirement{Key: labelRequirement.Key(), Operator: operator}
+		if operator != corev1.NodeSelectorOpExists && operator != corev1.NodeSelectorOpDoesNotExist {
+			requirement.Values = labelRequirement.Values().List()
+		}
+		requirements = append(requirements, requirement)
+	}
+
+	return requirements, nil
+}
+
+// mergeNodeSelectorRequirements returns a copy of `nodeSelector` in which every term also requires `requirements`,
+// since terms are ORed while the expressions within a term are ANDed. It also returns whether that adds anything
+// to `nodeSelector`.
+func mergeNodeSelectorRequirements(nodeSelector *corev1.NodeSelector, requirements []corev1.NodeSelectorRequirement) (*corev1.NodeSelector, bool) {
+	if nodeSelector == nil || len(nodeSelector.NodeSelectorTerms) == 0 {
+		return &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: requirements}}}, true
+	}
+
+	merged := nodeSelector.DeepCopy()
+	changed := false
+	for i := range merged.NodeSelectorTerms {
+		term := &merged.NodeSelectorTerms[i]
+		for _, requirement := range requirements {
+			if !hasNodeSelectorRequirement(term, requirement) {
+				term.MatchExpressions = append(term.MatchExpressions, requirement)
+				changed = true
+			}
+		}
+	}
+
+	return merged, changed
+}
+
+// hasNodeSelectorRequirement returns true iff the term already contains the exact same requirement.
+func hasNodeSelectorRequirement(term *corev1.NodeSelectorTerm, requirement corev1.NodeSelectorRequirement) bool {
+	for _, existing := range term.MatchExpressions {
+		if reflect.DeepEqual(existing, requirement) {
+			return true
+		}
+	}
+	return false
+}
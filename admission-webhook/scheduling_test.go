@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestMutateCreateRequestSchedulingOnWindows(t *testing.T) {
+	toleration := corev1.Toleration{Key: "os", Operator: corev1.TolerationOpEqual, Value: "windows", Effect: corev1.TaintEffectNoSchedule}
+	allOptions := []WebhookOption{WithPodOS(true), WithWindowsNodeSelector(true), WithWindowsTolerations([]corev1.Toleration{toleration})}
+
+	mutate := func(t *testing.T, pod *corev1.Pod, options ...WebhookOption) []map[string]interface{} {
+		webhook := newWebhookWithOptions(&dummyKubeClient{}, options...)
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+
+		var patches []map[string]interface{}
+		if response.Patch != nil {
+			require.Nil(t, json.Unmarshal(response.Patch, &patches))
+		}
+		return patches
+	}
+
+	t.Run("it steers pods using GMSA's towards Windows nodes", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), nil)
+
+		patches := mutate(t, pod, allOptions...)
+
+		assert.Equal(t, []map[string]interface{}{
+			{"op": "add", "path": "/spec/os", "value": map[string]interface{}{"name": "windows"}},
+			{"op": "add", "path": "/spec/nodeSelector", "value": map[string]interface{}{}},
+			{"op": "add", "path": "/spec/nodeSelector/kubernetes.io~1os", "value": "windows"},
+			{"op": "add", "path": "/spec/tolerations", "value": []interface{}{}},
+			{"op": "add", "path": "/spec/tolerations/-", "value": map[string]interface{}{"key": "os", "operator": "Equal", "value": "windows", "effect": "NoSchedule"}},
+		}, patches)
+
+		assert.Equal(t, corev1.Windows, pod.Spec.OS.Name)
+		assert.Equal(t, map[string]string{corev1.LabelOSStable: "windows"}, pod.Spec.NodeSelector)
+		assert.Equal(t, []corev1.Toleration{toleration}, pod.Spec.Tolerations)
+	})
+
+	t.Run("it leaves the pod's own settings alone", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), nil)
+		pod.Spec.OS = &corev1.PodOS{Name: corev1.Windows}
+		pod.Spec.NodeSelector = map[string]string{corev1.LabelOSStable: "windows", "pool": "gmsa"}
+		pod.Spec.Tolerations = []corev1.Toleration{toleration}
+
+		assert.Empty(t, mutate(t, pod, allOptions...))
+	})
+
+	t.Run("it adds to existing node selectors and tolerations", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), nil)
+		pod.Spec.NodeSelector = map[string]string{"pool": "gmsa"}
+		pod.Spec.Tolerations = []corev1.Toleration{{Key: "other", Operator: corev1.TolerationOpExists}}
+
+		patches := mutate(t, pod, WithWindowsNodeSelector(true), WithWindowsTolerations([]corev1.Toleration{toleration}))
+
+		if assert.Equal(t, 2, len(patches)) {
+			assert.Equal(t, "/spec/nodeSelector/kubernetes.io~1os", patches[0]["path"])
+			assert.Equal(t, "/spec/tolerations/-", patches[1]["path"])
+		}
+	})
+
+	t.Run("it does nothing for pods without GMSA's", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+
+		assert.Empty(t, mutate(t, pod, allOptions...))
+	})
+
+	t.Run("it does nothing when not enabled", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), nil)
+
+		assert.Empty(t, mutate(t, pod))
+	})
+}
+
+func TestValidateCreateRequestDeniesGMSAOnLinuxPods(t *testing.T) {
+	webhook := newWebhook(&dummyKubeClient{})
+
+	pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: buildWindowsOptions(dummyCredSpecName, "")})
+	pod.Spec.OS = &corev1.PodOS{Name: corev1.Linux}
+
+	response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+	assert.Nil(t, response)
+	assertPodAdmissionErrorContains(t, err, pod, http.StatusUnprocessableEntity, "container %q has GMSA settings, but its pod declares spec.os.name=linux", dummyContainerName)
+
+	// but Linux pods without GMSA settings are fine
+	pod.Spec.Containers[0].SecurityContext.WindowsOptions = &corev1.WindowsSecurityContextOptions{}
+	response, err = webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+	assert.Nil(t, err)
+	require.NotNil(t, response)
+	assert.True(t, response.Allowed)
+}
+
+func TestMutateCreateRequestRuntimeClass(t *testing.T) {
+	kubeClientFactory := func(credSpecRuntimeClasses map[string]string, namespaceRuntimeClass string) *dummyKubeClient {
+		return &dummyKubeClient{
+			retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+				credSpec := &gmsaCredSpec{name: credSpecName, contents: credSpecName + "-contents"}
+				if runtimeClass := credSpecRuntimeClasses[credSpecName]; runtimeClass != "" {
+					credSpec.annotations = map[string]string{runtimeClassAnnotation: runtimeClass}
+				}
+				return credSpec, http.StatusOK, nil
+			},
+			retrieveNamespaceFunc: func(ctx context.Context, name string) (*corev1.Namespace, int, error) {
+				namespace := &corev1.Namespace{}
+				if namespaceRuntimeClass != "" {
+					namespace.Annotations = map[string]string{runtimeClassAnnotation: namespaceRuntimeClass}
+				}
+				return namespace, http.StatusOK, nil
+			},
+		}
+	}
+
+	buildGMSAPod := func() *corev1.Pod {
+		return buildPod(dummyServiceAccoutName, buildWindowsOptions("cred-spec-1", ""), map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions("cred-spec-2", ""),
+		})
+	}
+
+	runtimeClassPatches := func(t *testing.T, response []byte) []map[string]interface{} {
+		var patches, runtimeClassPatches []map[string]interface{}
+		require.Nil(t, json.Unmarshal(response, &patches))
+		for _, patch := range patches {
+			if patch["path"] == "/spec/runtimeClassName" {
+				runtimeClassPatches = append(runtimeClassPatches, patch)
+			}
+		}
+		return runtimeClassPatches
+	}
+
+	t.Run("it injects the cred specs' runtime class, fetching each cred spec only once", func(t *testing.T) {
+		client := kubeClientFactory(map[string]string{"cred-spec-2": "gmsa-runtime"}, "namespace-runtime")
+		retrievedCredSpecs := make(map[string]int)
+		retrieveCredSpec := client.retrieveCredSpecFunc
+		client.retrieveCredSpecFunc = func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+			retrievedCredSpecs[credSpecName]++
+			return retrieveCredSpec(ctx, credSpecName)
+		}
+		webhook := newWebhookWithOptions(client, WithRuntimeClassInjection(true))
+		pod := buildGMSAPod()
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+
+		assert.Equal(t, []map[string]interface{}{{"op": "add", "path": "/spec/runtimeClassName", "value": "gmsa-runtime"}}, runtimeClassPatches(t, response.Patch))
+		assert.Equal(t, "gmsa-runtime", *pod.Spec.RuntimeClassName)
+		assert.Equal(t, map[string]int{"cred-spec-1": 1, "cred-spec-2": 1}, retrievedCredSpecs)
+	})
+
+	t.Run("it falls back to the namespace's runtime class", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(nil, "namespace-runtime"), WithRuntimeClassInjection(true))
+
+		response, err := webhook.mutateCreateRequest(context.Background(), buildGMSAPod(), dummyNamespace)
+		require.Nil(t, err)
+
+		assert.Equal(t, []map[string]interface{}{{"op": "add", "path": "/spec/runtimeClassName", "value": "namespace-runtime"}}, runtimeClassPatches(t, response.Patch))
+	})
+
+	t.Run("it leaves the pod's own runtime class alone", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(map[string]string{"cred-spec-1": "gmsa-runtime"}, ""), WithRuntimeClassInjection(true))
+		pod := buildGMSAPod()
+		podRuntimeClass := "pod-runtime"
+		pod.Spec.RuntimeClassName = &podRuntimeClass
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+
+		assert.Empty(t, runtimeClassPatches(t, response.Patch))
+		assert.Equal(t, podRuntimeClass, *pod.Spec.RuntimeClassName)
+	})
+
+	t.Run("it fails if the cred specs require different runtime classes", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(map[string]string{"cred-spec-1": "runtime-1", "cred-spec-2": "runtime-2"}, ""), WithRuntimeClassInjection(true))
+		pod := buildGMSAPod()
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, response)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusUnprocessableEntity, `GMSA cred specs "cred-spec-1" and "cred-spec-2" require different runtime classes`)
+	})
+
+	t.Run("it does nothing when not enabled", func(t *testing.T) {
+		webhook := newWebhook(kubeClientFactory(map[string]string{"cred-spec-1": "gmsa-runtime"}, "namespace-runtime"))
+
+		response, err := webhook.mutateCreateRequest(context.Background(), buildGMSAPod(), dummyNamespace)
+		require.Nil(t, err)
+
+		assert.Empty(t, runtimeClassPatches(t, response.Patch))
+	})
+}
+
+func TestValidateCreateRequestAllowedRuntimeClasses(t *testing.T) {
+	webhook := newWebhookWithOptions(&dummyKubeClient{}, WithAllowedRuntimeClasses([]string{"gmsa-runtime-1", "gmsa-runtime-2"}))
+
+	for testCaseName, runtimeClassName := range map[string]string{
+		"it denies GMSA pods without a runtime class":          "",
+		"it denies GMSA pods with a runtime class not allowed": "other-runtime",
+	} {
+		t.Run(testCaseName, func(t *testing.T) {
+			pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""), nil)
+			if runtimeClassName != "" {
+				pod.Spec.RuntimeClassName = &runtimeClassName
+			}
+
+			response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+			assert.Nil(t, response)
+			assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden, "is not one of the runtime classes allowed for GMSA's: gmsa-runtime-1, gmsa-runtime-2")
+		})
+	}
+
+	t.Run("it allows GMSA pods with an allowed runtime class", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""), nil)
+		runtimeClassName := "gmsa-runtime-2"
+		pod.Spec.RuntimeClassName = &runtimeClassName
+
+		response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, err)
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+	})
+
+	t.Run("it allows pods without GMSA's regardless of their runtime class", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+
+		response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, err)
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+	})
+}
+
+func TestMutateCreateRequestCredSpecNodeSelectors(t *testing.T) {
+	client := &dummyKubeClient{
+		retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+			credSpec := &gmsaCredSpec{name: credSpecName, contents: credSpecName + "-contents"}
+			switch credSpecName {
+			case "domain-a":
+				credSpec.annotations = map[string]string{nodeSelectorAnnotation: "gmsa-domain=a.contoso.com"}
+			case "forest-b":
+				credSpec.annotations = map[string]string{nodeSelectorAnnotation: "gmsa-forest in (b1, b2),!legacy"}
+			case "invalid":
+				credSpec.annotations = map[string]string{nodeSelectorAnnotation: "in valid"}
+			}
+			return credSpec, http.StatusOK, nil
+		},
+	}
+
+	domainRequirement := corev1.NodeSelectorRequirement{Key: "gmsa-domain", Operator: corev1.NodeSelectorOpIn, Values: []string{"a.contoso.com"}}
+
+	nodeAffinityPatches := func(t *testing.T, response []byte) []jsonPatchOperation {
+		var patches, nodeAffinityPatches []jsonPatchOperation
+		require.Nil(t, json.Unmarshal(response, &patches))
+		for _, patch := range patches {
+			if strings.HasPrefix(patch.Path, "/spec/affinity") {
+				nodeAffinityPatches = append(nodeAffinityPatches, patch)
+			}
+		}
+		return nodeAffinityPatches
+	}
+
+	t.Run("it adds the node affinity of all the cred specs", func(t *testing.T) {
+		webhook := newWebhookWithOptions(client, WithCredSpecNodeSelectors(true))
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions("domain-a", ""), map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions("forest-b", ""),
+		})
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+
+		patches := nodeAffinityPatches(t, response.Patch)
+		if assert.Equal(t, 1, len(patches)) {
+			assert.Equal(t, "/spec/affinity", patches[0].Path)
+		}
+		assert.Equal(t, &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+			domainRequirement,
+			{Key: "gmsa-forest", Operator: corev1.NodeSelectorOpIn, Values: []string{"b1", "b2"}},
+			{Key: "legacy", Operator: corev1.NodeSelectorOpDoesNotExist},
+		}}}}, pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+	})
+
+	t.Run("it merges into each of the pod's own node selector terms", func(t *testing.T) {
+		webhook := newWebhookWithOptions(client, WithCredSpecNodeSelectors(true))
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions("domain-a", ""), nil)
+		poolRequirement := func(pool string) corev1.NodeSelectorRequirement {
+			return corev1.NodeSelectorRequirement{Key: "pool", Operator: corev1.NodeSelectorOpIn, Values: []string{pool}}
+		}
+		pod.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{poolRequirement("1")}},
+				{MatchExpressions: []corev1.NodeSelectorRequirement{poolRequirement("2"), domainRequirement}},
+			},
+		}}}
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+
+		patches := nodeAffinityPatches(t, response.Patch)
+		if assert.Equal(t, 1, len(patches)) {
+			assert.Equal(t, "/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution", patches[0].Path)
+		}
+		assert.Equal(t, []corev1.NodeSelectorTerm{
+			{MatchExpressions: []corev1.NodeSelectorRequirement{poolRequirement("1"), domainRequirement}},
+			{MatchExpressions: []corev1.NodeSelectorRequirement{poolRequirement("2"), domainRequirement}},
+		}, pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms)
+	})
+
+	t.Run("it does not patch pods that already require the cred spec's node selector", func(t *testing.T) {
+		webhook := newWebhookWithOptions(client, WithCredSpecNodeSelectors(true))
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions("domain-a", ""), nil)
+		pod.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{domainRequirement}}},
+		}}}
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+
+		assert.Empty(t, nodeAffinityPatches(t, response.Patch))
+	})
+
+	t.Run("it fails on invalid node selectors", func(t *testing.T) {
+		webhook := newWebhookWithOptions(client, WithCredSpecNodeSelectors(true))
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions("invalid", ""), nil)
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		assert.Nil(t, response)
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusUnprocessableEntity, "GMSA cred spec %q has an invalid %s annotation", "invalid", nodeSelectorAnnotation)
+	})
+
+	t.Run("it does nothing when not enabled", func(t *testing.T) {
+		webhook := newWebhook(client)
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions("domain-a", ""), nil)
+
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+		require.Nil(t, err)
+
+		assert.Empty(t, nodeAffinityPatches(t, response.Patch))
+		assert.Nil(t, pod.Spec.Affinity)
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// these annotations can be set on namespaces to override the corresponding global settings for pods
+	// in these namespaces, and on pods themselves if their namespace allows it
+	randomHostnameAnnotation         = "windows.k8s.io/gmsa-random-hostname"
+	defaultCredSpecEnabledAnnotation = "windows.k8s.io/gmsa-default-credential-spec-enabled"
+	podOSAnnotation                  = "windows.k8s.io/gmsa-set-pod-os"
+	repairCredSpecContentsAnnotation = "windows.k8s.io/gmsa-repair-credspec-contents"
+
+	// podOverridesAnnotation can be set on namespaces to a comma-separated list of the annotations above,
+	// `hostnameStrategyAnnotation` and `hostnamePrefixAnnotation` included, that pods in these namespaces
+	// are allowed to set to override the namespace's settings, or to `*` to allow all of them. Pods may only
+	// set the policy mode labels as annotations if they're listed explicitly, and then only to turn modes on.
+	podOverridesAnnotation = "windows.k8s.io/gmsa-allow-pod-overrides"
+)
+
+// podSettings are the settings that apply to a given pod: the global ones, overridden by the pod's namespace's
+// annotations (or labels, for the policy modes and the GMSA profile), and in turn by the pod's own annotations when
+// its namespace allows it.
+type podSettings struct {
+	randomHostname         bool
+	defaultCredSpec        bool
+	podOS                  bool
+	policyModes            map[PolicyMode]bool
+	repairCredSpecContents bool
+	profile                GMSAProfile
+
+	namespace    *corev1.Namespace
+	podOverrides map[string]bool
+}
+
+// podSettings computes the settings that apply to a pod. It also returns warnings about invalid annotations.
+// Namespaces come from the client's cache, so this doesn't make any API call.
+func (webhook *webhook) podSettings(ctx context.Context, pod *corev1.Pod, namespace string) (*podSettings, []string, *podAdmissionError) {
+	settings := &podSettings{
+		randomHostname:         webhook.config.EnableRandomHostName,
+		defaultCredSpec:        webhook.config.EnableDefaultCredSpec,
+		podOS:                  webhook.config.EnablePodOS,
+		policyModes:            make(map[PolicyMode]bool),
+		repairCredSpecContents: webhook.config.EnableCredSpecContentsRepair,
+		profile:                webhook.config.Profile,
+		podOverrides:           make(map[string]bool),
+	}
+
+	ns, code, err := webhook.client.retrieveNamespace(ctx, namespace)
+	if err != nil && code != http.StatusNotFound {
+		return nil, nil, &podAdmissionError{error: err, pod: pod, code: code}
+	}
+	settings.namespace = ns
+
+	if ns != nil {
+		for _, item := range strings.Split(ns.Annotations[podOverridesAnnotation], ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				settings.podOverrides[item] = true
+			}
+		}
+	}
+
+	var warnings []string
+	for _, boolSetting := range []struct {
+		annotation string
+		value      *bool
+	}{
+		{annotation: randomHostnameAnnotation, value: &settings.randomHostname},
+		{annotation: defaultCredSpecEnabledAnnotation, value: &settings.defaultCredSpec},
+		{annotation: podOSAnnotation, value: &settings.podOS},
+		{annotation: repairCredSpecContentsAnnotation, value: &settings.repairCredSpecContents},
+	} {
+		value, source, found := settings.annotation(pod, boolSetting.annotation)
+		if !found {
+			continue
+		}
+		if parsed, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+			*boolSetting.value = parsed
+		} else {
+			warnings = append(warnings, fmt.Sprintf("ignoring the %s annotation on %s: %q is not a boolean", boolSetting.annotation, source, value))
+		}
+	}
+
+	// like Pod Security Admission's, each mode is turned on or off independently of the others
+	globalMode := webhook.config.PolicyMode
+	if globalMode == "" {
+		globalMode = EnforcePolicyMode
+	}
+	for _, mode := range policyModes {
+		label := policyModeLabel(mode)
+		settings.policyModes[mode] = mode == globalMode
+		if ns != nil {
+			if value, found := ns.Labels[label]; found {
+				if enabled, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+					settings.policyModes[mode] = enabled
+				} else {
+					warnings = append(warnings, fmt.Sprintf("ignoring the %s label on namespace %q: %q is not a boolean", label, ns.Name, value))
+				}
+			}
+		}
+
+		// otherwise anyone allowed to create pods could turn off the checks for their own pods
+		if value, found := pod.Annotations[label]; found && settings.podOverrides[label] {
+			if enabled, err := strconv.ParseBool(strings.TrimSpace(value)); err != nil {
+				warnings = append(warnings, fmt.Sprintf("ignoring the %s annotation on the pod: %q is not a boolean", label, value))
+			} else if enabled {
+				settings.policyModes[mode] = true
+			} else if settings.policyModes[mode] {
+				warnings = append(warnings, fmt.Sprintf("ignoring the %s annotation on the pod: pods can only turn on policy modes that their namespace doesn't", label))
+			}
+		}
+	}
+
+	// unlike the policy modes, pods can't loosen their own profile
+	if ns != nil {
+		if value, found := ns.Labels[gmsaProfileLabel]; found {
+			if profile, err := parseGMSAProfile(strings.TrimSpace(value)); err == nil {
+				settings.profile = profile
+			} else {
+				warnings = append(warnings, fmt.Sprintf("ignoring the %s label on namespace %q: %v", gmsaProfileLabel, ns.Name, err))
+			}
+		}
+	}
+	if settings.profile == "" {
+		settings.profile = PrivilegedGMSAProfile
+	}
+
+	return settings, warnings, nil
+}
+
+// annotation returns the value of the given annotation on the pod if its namespace allows pods to override it,
+// or else on the namespace, along with a description of where it was found.
+func (settings *podSettings) annotation(pod *corev1.Pod, annotation string) (value, source string, found bool) {
+	if settings.allowsPodOverride(annotation) {
+		if value, found = pod.Annotations[annotation]; found {
+			return value, "the pod", true
+		}
+	}
+	if settings.namespace != nil {
+		if value, found = settings.namespace.Annotations[annotation]; found {
+			return value, fmt.Sprintf("namespace %q", settings.namespace.Name), true
+		}
+	}
+	return "", "", false
+}
+
+// allowsPodOverride returns true iff the pod's namespace allows pods to set the given annotation.
+func (settings *podSettings) allowsPodOverride(annotation string) bool {
+	return settings.podOverrides["*"] || settings.podOverrides[annotation]
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodSettings(t *testing.T) {
+	kubeClientFactory := func(namespaceAnnotations map[string]string) *dummyKubeClient {
+		return &dummyKubeClient{
+			retrieveNamespaceFunc: func(ctx context.Context, name string) (*corev1.Namespace, int, error) {
+				return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: namespaceAnnotations}}, http.StatusOK, nil
+			},
+		}
+	}
+
+	buildAnnotatedPod := func(annotations map[string]string) *corev1.Pod {
+		pod := buildPod(dummyServiceAccoutName, nil, nil)
+		pod.Annotations = annotations
+		return pod
+	}
+
+	t.Run("without any annotation, the global settings apply", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(nil), WithRandomHostname(true), WithPodOS(true))
+
+		settings, warnings, err := webhook.podSettings(context.Background(), buildAnnotatedPod(nil), dummyNamespace)
+		require.Nil(t, err)
+		assert.Empty(t, warnings)
+		assert.True(t, settings.randomHostname)
+		assert.False(t, settings.defaultCredSpec)
+		assert.True(t, settings.podOS)
+	})
+
+	t.Run("namespaces override the global settings", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(map[string]string{
+			randomHostnameAnnotation:         "false",
+			defaultCredSpecEnabledAnnotation: "true",
+		}), WithRandomHostname(true))
+
+		settings, warnings, err := webhook.podSettings(context.Background(), buildAnnotatedPod(map[string]string{defaultCredSpecEnabledAnnotation: "false"}), dummyNamespace)
+		require.Nil(t, err)
+		assert.Empty(t, warnings)
+		assert.False(t, settings.randomHostname)
+		assert.True(t, settings.defaultCredSpec, "pods should not override settings unless their namespace allows it")
+	})
+
+	t.Run("pods override the settings their namespace allows them to", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(map[string]string{
+			randomHostnameAnnotation: "false",
+			podOSAnnotation:          "false",
+			podOverridesAnnotation:   randomHostnameAnnotation + ", " + hostnameStrategyAnnotation,
+		}))
+
+		settings, warnings, err := webhook.podSettings(context.Background(), buildAnnotatedPod(map[string]string{
+			randomHostnameAnnotation: "true",
+			podOSAnnotation:          "true",
+		}), dummyNamespace)
+		require.Nil(t, err)
+		assert.Empty(t, warnings)
+		assert.True(t, settings.randomHostname)
+		assert.False(t, settings.podOS)
+		assert.True(t, settings.allowsPodOverride(hostnameStrategyAnnotation))
+		assert.False(t, settings.allowsPodOverride(hostnamePrefixAnnotation))
+	})
+
+	t.Run("namespaces can allow pods to override all settings", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(map[string]string{podOverridesAnnotation: "*"}))
+
+		settings, _, err := webhook.podSettings(context.Background(), buildAnnotatedPod(map[string]string{podOSAnnotation: "true"}), dummyNamespace)
+		require.Nil(t, err)
+		assert.True(t, settings.podOS)
+	})
+
+	t.Run("invalid values get ignored with a warning", func(t *testing.T) {
+		webhook := newWebhookWithOptions(kubeClientFactory(map[string]string{randomHostnameAnnotation: "maybe"}), WithRandomHostname(true))
+
+		settings, warnings, err := webhook.podSettings(context.Background(), buildAnnotatedPod(nil), dummyNamespace)
+		require.Nil(t, err)
+		assert.True(t, settings.randomHostname)
+		if assert.Equal(t, 1, len(warnings)) {
+			assert.Equal(t, `ignoring the windows.k8s.io/gmsa-random-hostname annotation on namespace "dummy-namespace": "maybe" is not a boolean`, warnings[0])
+		}
+	})
+
+	t.Run("missing namespaces are fine, other errors are not", func(t *testing.T) {
+		for code, expectError := range map[int]bool{http.StatusNotFound: false, http.StatusInternalServerError: true} {
+			client := &dummyKubeClient{
+				retrieveNamespaceFunc: func(ctx context.Context, name string) (*corev1.Namespace, int, error) {
+					return nil, code, assert.AnError
+				},
+			}
+
+			_, _, err := newWebhook(client).podSettings(context.Background(), buildAnnotatedPod(nil), dummyNamespace)
+			assert.Equal(t, expectError, err != nil, "code %d", code)
+		}
+	})
+}
+
+func TestMutateCreateRequestWithOverrides(t *testing.T) {
+	client := &dummyKubeClient{
+		retrieveNamespaceFunc: func(ctx context.Context, name string) (*corev1.Namespace, int, error) {
+			return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{
+				randomHostnameAnnotation: "true",
+				podOverridesAnnotation:   hostnameStrategyAnnotation + "," + hostnamePrefixAnnotation + "," + podOSAnnotation,
+			}}}, http.StatusOK, nil
+		},
+		retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+			return &gmsaCredSpec{name: credSpecName, contents: dummyCredSpecContents, annotations: map[string]string{
+				hostnameStrategyAnnotation: string(PodNameHashHostnameStrategy),
+			}}, http.StatusOK, nil
+		},
+	}
+	webhook := newWebhookWithOptions(client)
+
+	pod := buildOwnedPod("db-1", "StatefulSet", "db")
+	pod.Annotations = map[string]string{
+		hostnameStrategyAnnotation: string(StatefulSetOrdinalHostnameStrategy),
+		hostnamePrefixAnnotation:   "win-",
+		podOSAnnotation:            "true",
+	}
+	pod.Spec.SecurityContext = &corev1.PodSecurityContext{WindowsOptions: buildWindowsOptions(dummyCredSpecName, "")}
+
+	response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
+	require.Nil(t, err)
+	require.NotNil(t, response)
+
+	assert.Equal(t, "win-db-1", pod.Spec.Hostname)
+	if assert.NotNil(t, pod.Spec.OS) {
+		assert.Equal(t, corev1.Windows, pod.Spec.OS.Name)
+	}
+}
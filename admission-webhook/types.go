@@ -1,6 +1,13 @@
 package main
 
-import "context"
+import (
+	"context"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
 
 type tlsConfig struct {
 	crtPath string
@@ -9,5 +16,15 @@ type tlsConfig struct {
 
 type kubeClientInterface interface {
 	isAuthorizedToUseCredSpec(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string)
-	retrieveCredSpecContents(ctx context.Context, credSpecName string) (contents string, httpCode int, err error)
+	retrieveCredSpec(ctx context.Context, credSpecName string) (credSpec *gmsaCredSpec, httpCode int, err error)
+	retrieveServiceAccount(ctx context.Context, namespace, name string) (serviceAccount *corev1.ServiceAccount, httpCode int, err error)
+	retrieveNamespace(ctx context.Context, name string) (namespace *corev1.Namespace, httpCode int, err error)
+	retrievePod(ctx context.Context, namespace, name string) (pod *corev1.Pod, httpCode int, err error)
+	retrieveLease(ctx context.Context, namespace, name string) (lease *coordinationv1.Lease, httpCode int, err error)
+	createLease(ctx context.Context, lease *coordinationv1.Lease) (httpCode int, err error)
+	updateLease(ctx context.Context, lease *coordinationv1.Lease) (httpCode int, err error)
+	deleteLease(ctx context.Context, namespace, name, resourceVersion string) (httpCode int, err error)
+	canListRoles(ctx context.Context, userInfo authenticationv1.UserInfo, namespace string) bool
+	listRoles(ctx context.Context, namespace string) (clusterRoles []rbacv1.ClusterRole, roles []rbacv1.Role, httpCode int, err error)
+	listGMSAPolicies(ctx context.Context) (policies []gmsaPolicy, httpCode int, err error)
 }
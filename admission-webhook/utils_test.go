@@ -7,12 +7,18 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"math/big"
 	"math/rand"
+	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	authenticationv1 "k8s.io/api/authentication/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -23,10 +29,22 @@ const dummyServiceAccoutName = "dummy-service-account-name"
 const dummyNamespace = "dummy-namespace"
 const dummyPodName = "dummy-pod-name"
 const dummyContainerName = "dummy-container-name"
+const dummyInitContainerName = "dummy-init-container-name"
+const dummyEphemeralContainerName = "dummy-ephemeral-container-name"
 
 type dummyKubeClient struct {
 	isAuthorizedToUseCredSpecFunc func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string)
 	retrieveCredSpecContentsFunc  func(ctx context.Context, credSpecName string) (contents string, httpCode int, err error)
+	retrieveCredSpecFunc          func(ctx context.Context, credSpecName string) (credSpec *gmsaCredSpec, httpCode int, err error)
+	retrieveServiceAccountFunc    func(ctx context.Context, namespace, name string) (serviceAccount *corev1.ServiceAccount, httpCode int, err error)
+	retrieveNamespaceFunc         func(ctx context.Context, name string) (namespace *corev1.Namespace, httpCode int, err error)
+	retrievePodFunc               func(ctx context.Context, namespace, name string) (pod *corev1.Pod, httpCode int, err error)
+	canListRolesFunc              func(ctx context.Context, userInfo authenticationv1.UserInfo, namespace string) bool
+	listRolesFunc                 func(ctx context.Context, namespace string) (clusterRoles []rbacv1.ClusterRole, roles []rbacv1.Role, httpCode int, err error)
+	listGMSAPoliciesFunc          func(ctx context.Context) (policies []gmsaPolicy, httpCode int, err error)
+
+	// leases get stored in memory, keyed by namespace and name
+	leases map[string]*coordinationv1.Lease
 }
 
 func (dkc *dummyKubeClient) isAuthorizedToUseCredSpec(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string) {
@@ -45,6 +63,113 @@ func (dkc *dummyKubeClient) retrieveCredSpecContents(ctx context.Context, credSp
 	return
 }
 
+// retrieveCredSpec defaults to building a cred spec without any metadata from retrieveCredSpecContents,
+// which is enough for tests that only care about contents.
+func (dkc *dummyKubeClient) retrieveCredSpec(ctx context.Context, credSpecName string) (credSpec *gmsaCredSpec, httpCode int, err error) {
+	if dkc.retrieveCredSpecFunc != nil {
+		return dkc.retrieveCredSpecFunc(ctx, credSpecName)
+	}
+	contents, httpCode, err := dkc.retrieveCredSpecContents(ctx, credSpecName)
+	if err != nil {
+		return nil, httpCode, err
+	}
+	return &gmsaCredSpec{name: credSpecName, contents: contents}, httpCode, nil
+}
+
+func (dkc *dummyKubeClient) retrieveServiceAccount(ctx context.Context, namespace, name string) (serviceAccount *corev1.ServiceAccount, httpCode int, err error) {
+	if dkc.retrieveServiceAccountFunc != nil {
+		return dkc.retrieveServiceAccountFunc(ctx, namespace, name)
+	}
+	serviceAccount = &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	return
+}
+
+func (dkc *dummyKubeClient) retrieveNamespace(ctx context.Context, name string) (namespace *corev1.Namespace, httpCode int, err error) {
+	if dkc.retrieveNamespaceFunc != nil {
+		return dkc.retrieveNamespaceFunc(ctx, name)
+	}
+	namespace = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	return
+}
+
+func (dkc *dummyKubeClient) retrievePod(ctx context.Context, namespace, name string) (pod *corev1.Pod, httpCode int, err error) {
+	if dkc.retrievePodFunc != nil {
+		return dkc.retrievePodFunc(ctx, namespace, name)
+	}
+	return nil, http.StatusNotFound, fmt.Errorf("pod %s/%s does not exist", namespace, name)
+}
+
+func (dkc *dummyKubeClient) canListRoles(ctx context.Context, userInfo authenticationv1.UserInfo, namespace string) bool {
+	if dkc.canListRolesFunc != nil {
+		return dkc.canListRolesFunc(ctx, userInfo, namespace)
+	}
+	return true
+}
+
+func (dkc *dummyKubeClient) listRoles(ctx context.Context, namespace string) (clusterRoles []rbacv1.ClusterRole, roles []rbacv1.Role, httpCode int, err error) {
+	if dkc.listRolesFunc != nil {
+		return dkc.listRolesFunc(ctx, namespace)
+	}
+	return nil, nil, http.StatusOK, nil
+}
+
+func (dkc *dummyKubeClient) listGMSAPolicies(ctx context.Context) (policies []gmsaPolicy, httpCode int, err error) {
+	if dkc.listGMSAPoliciesFunc != nil {
+		return dkc.listGMSAPoliciesFunc(ctx)
+	}
+	return nil, http.StatusOK, nil
+}
+
+func (dkc *dummyKubeClient) retrieveLease(ctx context.Context, namespace, name string) (lease *coordinationv1.Lease, httpCode int, err error) {
+	if lease, present := dkc.leases[namespace+"/"+name]; present {
+		return lease.DeepCopy(), http.StatusOK, nil
+	}
+	return nil, http.StatusNotFound, fmt.Errorf("lease %s/%s does not exist", namespace, name)
+}
+
+func (dkc *dummyKubeClient) createLease(ctx context.Context, lease *coordinationv1.Lease) (httpCode int, err error) {
+	key := lease.Namespace + "/" + lease.Name
+	if _, present := dkc.leases[key]; present {
+		return http.StatusConflict, fmt.Errorf("lease %s already exists", key)
+	}
+	if dkc.leases == nil {
+		dkc.leases = make(map[string]*coordinationv1.Lease)
+	}
+	lease = lease.DeepCopy()
+	lease.ResourceVersion = "1"
+	dkc.leases[key] = lease
+	return http.StatusCreated, nil
+}
+
+func (dkc *dummyKubeClient) updateLease(ctx context.Context, lease *coordinationv1.Lease) (httpCode int, err error) {
+	key := lease.Namespace + "/" + lease.Name
+	existing, present := dkc.leases[key]
+	if !present {
+		return http.StatusNotFound, fmt.Errorf("lease %s does not exist", key)
+	}
+	if existing.ResourceVersion != lease.ResourceVersion {
+		return http.StatusConflict, fmt.Errorf("lease %s has been modified", key)
+	}
+	resourceVersion, _ := strconv.Atoi(existing.ResourceVersion)
+	lease = lease.DeepCopy()
+	lease.ResourceVersion = strconv.Itoa(resourceVersion + 1)
+	dkc.leases[key] = lease
+	return http.StatusOK, nil
+}
+
+func (dkc *dummyKubeClient) deleteLease(ctx context.Context, namespace, name, resourceVersion string) (httpCode int, err error) {
+	key := namespace + "/" + name
+	existing, present := dkc.leases[key]
+	if !present {
+		return http.StatusNotFound, fmt.Errorf("lease %s does not exist", key)
+	}
+	if existing.ResourceVersion != resourceVersion {
+		return http.StatusConflict, fmt.Errorf("lease %s has been modified", key)
+	}
+	delete(dkc.leases, key)
+	return http.StatusOK, nil
+}
+
 func buildWindowsOptions(credSpecName, credSpecContents string) *corev1.WindowsSecurityContextOptions {
 	winOptions := &corev1.WindowsSecurityContextOptions{}
 	setWindowsOptions(winOptions, credSpecName, credSpecContents)
@@ -104,6 +229,14 @@ func buildPodWithHostName(serviceAccountName string, hostname *string, podWindow
 	}
 }
 
+func buildEphemeralContainer(name string, winOptions *corev1.WindowsSecurityContextOptions) corev1.EphemeralContainer {
+	container := corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: name}}
+	if winOptions != nil {
+		container.SecurityContext = &corev1.SecurityContext{WindowsOptions: winOptions}
+	}
+	return container
+}
+
 func shuffleContainers(a []corev1.Container) {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	for i := len(a) - 1; i > 0; i-- {
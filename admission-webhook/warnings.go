@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+)
+
+// admissionWarnings collects the warnings returned to the user along with the response to an admission request,
+// e.g. for kubectl to display them. It gets threaded through the request's context, so that any step of the
+// validation or of the mutation can add warnings without being denied for that.
+type admissionWarnings struct {
+	warnings []string
+	seen     map[string]bool
+}
+
+type warningsContextKey struct{}
+
+// withWarnings returns a context carrying a new warnings collector, along with that collector.
+func withWarnings(ctx context.Context) (context.Context, *admissionWarnings) {
+	warnings := &admissionWarnings{seen: make(map[string]bool)}
+	return context.WithValue(ctx, warningsContextKey{}, warnings), warnings
+}
+
+// addWarnings adds warnings to the context's collector, ignoring duplicates, e.g. when several containers
+// trigger the same warning. It's a no-op if the context doesn't carry a collector.
+func addWarnings(ctx context.Context, warnings ...string) {
+	collector, _ := ctx.Value(warningsContextKey{}).(*admissionWarnings)
+	if collector == nil {
+		return
+	}
+	for _, warning := range warnings {
+		if !collector.seen[warning] {
+			collector.seen[warning] = true
+			collector.warnings = append(collector.warnings, warning)
+		}
+	}
+}
+
+// list returns the collected warnings, in the order they were added.
+func (warnings *admissionWarnings) list() []string {
+	return warnings.warnings
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionV1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestValidateOrMutateWarnings(t *testing.T) {
+	createRequest := func(t *testing.T, pod *corev1.Pod) *admissionV1.AdmissionRequest {
+		podJSON, err := json.Marshal(pod)
+		require.Nil(t, err)
+
+		return &admissionV1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: dummyNamespace,
+			Operation: admissionV1.Create,
+			Object:    runtime.RawExtension{Raw: podJSON},
+		}
+	}
+
+	run := func(t *testing.T, client *dummyKubeClient, pod *corev1.Pod, operation webhookOperation, options ...WebhookOption) []string {
+		response, err := newWebhookWithOptions(client, options...).validateOrMutate(context.Background(), createRequest(t, pod), operation)
+		require.Nil(t, err)
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+		return response.Warnings
+	}
+
+	deprecatedCredSpecClient := func(deprecation string) *dummyKubeClient {
+		return &dummyKubeClient{
+			retrieveCredSpecFunc: func(ctx context.Context, credSpecName string) (*gmsaCredSpec, int, error) {
+				return &gmsaCredSpec{name: credSpecName, contents: dummyCredSpecContents, annotations: map[string]string{
+					deprecatedCredSpecAnnotation: deprecation,
+				}}, http.StatusOK, nil
+			},
+		}
+	}
+
+	t.Run("explicit hostnames get a warning when random hostnames are enabled", func(t *testing.T) {
+		warnings := run(t, &dummyKubeClient{}, buildGMSAPod("my-host"), mutate, WithRandomHostname(true))
+		assert.Equal(t, []string{`hostname "my-host" is set explicitly and will be honored instead of being randomized`}, warnings)
+
+		assert.Empty(t, run(t, &dummyKubeClient{}, buildGMSAPod("my-host"), mutate))
+	})
+
+	t.Run("cred spec contents that only match once normalized get a warning", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, nil, map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions(dummyCredSpecName, `{"All in all you're just another": {"the": "wall", "brick": "in"}, "We don't need no": ["education", "thought control", "dark sarcasm in the classroom"]}`),
+		})
+
+		warnings := run(t, &dummyKubeClient{}, pod, validate)
+		if assert.Equal(t, 1, len(warnings)) {
+			assert.Contains(t, warnings[0], `the GMSA cred spec contents for container "dummy-container-name" are not identical to the contents of GMSA resource "dummy-cred-spec-name"`)
+		}
+
+		setWindowsOptions(pod.Spec.Containers[0].SecurityContext.WindowsOptions, dummyCredSpecName, dummyCredSpecContents)
+		assert.Empty(t, run(t, &dummyKubeClient{}, pod, validate))
+	})
+
+	t.Run("deprecated cred specs get a single warning", func(t *testing.T) {
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), map[string]*corev1.WindowsSecurityContextOptions{
+			dummyContainerName: buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents),
+		})
+
+		for deprecation, expectedWarnings := range map[string][]string{
+			"true":                      {`GMSA cred spec "dummy-cred-spec-name" is deprecated`},
+			"use new-cred-spec instead": {`GMSA cred spec "dummy-cred-spec-name" is deprecated: use new-cred-spec instead`},
+			"false":                     nil,
+		} {
+			assert.Equal(t, expectedWarnings, run(t, deprecatedCredSpecClient(deprecation), pod, validate), "deprecation: %q", deprecation)
+		}
+	})
+
+	t.Run("warnings get added to the policy violations returned in warn mode", func(t *testing.T) {
+		client := deprecatedCredSpecClient("true")
+		client.isAuthorizedToUseCredSpecFunc = func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (bool, string) {
+			return false, ""
+		}
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), nil)
+
+		warnings := run(t, client, pod, validate, WithPolicyMode(WarnPolicyMode))
+		if assert.Equal(t, 2, len(warnings)) {
+			assert.Contains(t, warnings[0], "GMSA policy violation: ")
+			assert.Equal(t, `GMSA cred spec "dummy-cred-spec-name" is deprecated`, warnings[1])
+		}
+	})
+
+	t.Run("warnings also get returned along with denials", func(t *testing.T) {
+		client := deprecatedCredSpecClient("true")
+		client.isAuthorizedToUseCredSpecFunc = func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (bool, string) {
+			return false, ""
+		}
+		pod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), nil)
+
+		response, err := newWebhook(client).validateOrMutate(context.Background(), createRequest(t, pod), validate)
+		assert.Nil(t, response)
+		require.NotNil(t, err)
+
+		denial := deniedAdmissionResponse(err)
+		assert.False(t, denial.Allowed)
+		assert.Equal(t, []string{`GMSA cred spec "dummy-cred-spec-name" is deprecated`}, denial.Warnings)
+	})
+}
@@ -4,17 +4,15 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/google/uuid"
-
 	"github.com/sirupsen/logrus"
 	admissionV1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -33,10 +31,23 @@ const (
 	validate webhookOperation = "VALIDATE"
 	mutate   webhookOperation = "MUTATE"
 
-	podKind       gmsaResourceKind = "pod"
-	containerKind gmsaResourceKind = "container"
+	podKind                gmsaResourceKind = "pod"
+	containerKind          gmsaResourceKind = "container"
+	initContainerKind      gmsaResourceKind = "init container"
+	ephemeralContainerKind gmsaResourceKind = "ephemeral container"
+
+	// ephemeralContainersSubResource is the pod subresource used to attach ephemeral containers,
+	// e.g. with `kubectl debug`
+	ephemeralContainersSubResource = "ephemeralcontainers"
 )
 
+// containerListFields maps each container kind to the name of the corresponding list in a pod's spec.
+var containerListFields = map[gmsaResourceKind]string{
+	containerKind:          "containers",
+	initContainerKind:      "initContainers",
+	ephemeralContainerKind: "ephemeralContainers",
+}
+
 type webhook struct {
 	server *http.Server
 	client kubeClientInterface
@@ -47,11 +58,43 @@ type podAdmissionError struct {
 	error
 	code int
 	pod  *corev1.Pod
+
+	// for policy violations, the stable reason code and the path of the offending field
+	reason metav1.CauseType
+	field  string
+	// causes are set on errors aggregating several policy violations, one per violation
+	causes []metav1.StatusCause
+	// hint explains how to fix a policy violation; it only gets shown when denying the pod
+	hint string
+	// warnings and auditAnnotations are those collected while handling the request before denying it
+	warnings         []string
+	auditAnnotations map[string]string
 }
 
 type WebhookConfig struct {
-	EnableCertReload     bool
-	EnableRandomHostName bool
+	EnableCertReload                 bool
+	EnableRandomHostName             bool
+	EnableDefaultCredSpec            bool
+	EnableLegacyAnnotationsMigration bool
+	EnablePodOS                      bool
+	EnableWindowsNodeSelector        bool
+	WindowsTolerations               []corev1.Toleration
+	EnableRuntimeClassInjection      bool
+	AllowedRuntimeClasses            []string
+	EnableCredSpecNodeSelectors      bool
+	EnableCredSpecMetadata           bool
+	EnableCredSpecContentsRepair     bool
+	EnableGMSAPolicies               bool
+	EnableRoleSuggestions            bool
+	HostnameStrategy                 HostnameStrategy
+	HostnamePrefix                   string
+	InvalidHostnameMode              InvalidHostnameMode
+	EnableUniqueHostnames            bool
+	PolicyMode                       PolicyMode
+	Profile                          GMSAProfile
+	HostnameLeaseNamespace           string
+	PodTemplatePaths                 []PodTemplatePathConfig
+	CustomRules                      []customRule
 }
 
 type WebhookOption func(*WebhookConfig)
@@ -68,6 +111,122 @@ func WithRandomHostname(enabled bool) WebhookOption {
 	}
 }
 
+func WithDefaultCredSpec(enabled bool) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.EnableDefaultCredSpec = enabled
+	}
+}
+
+func WithLegacyAnnotationsMigration(enabled bool) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.EnableLegacyAnnotationsMigration = enabled
+	}
+}
+
+func WithPodOS(enabled bool) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.EnablePodOS = enabled
+	}
+}
+
+func WithWindowsNodeSelector(enabled bool) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.EnableWindowsNodeSelector = enabled
+	}
+}
+
+func WithWindowsTolerations(tolerations []corev1.Toleration) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.WindowsTolerations = tolerations
+	}
+}
+
+func WithRuntimeClassInjection(enabled bool) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.EnableRuntimeClassInjection = enabled
+	}
+}
+
+func WithAllowedRuntimeClasses(runtimeClassNames []string) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.AllowedRuntimeClasses = runtimeClassNames
+	}
+}
+
+func WithCredSpecNodeSelectors(enabled bool) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.EnableCredSpecNodeSelectors = enabled
+	}
+}
+
+func WithCredSpecMetadata(enabled bool) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.EnableCredSpecMetadata = enabled
+	}
+}
+
+func WithCredSpecContentsRepair(enabled bool) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.EnableCredSpecContentsRepair = enabled
+	}
+}
+
+func WithGMSAPolicies(enabled bool) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.EnableGMSAPolicies = enabled
+	}
+}
+
+func WithRoleSuggestions(enabled bool) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.EnableRoleSuggestions = enabled
+	}
+}
+
+func WithHostnameStrategy(strategy HostnameStrategy, prefix string) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.HostnameStrategy = strategy
+		cfg.HostnamePrefix = prefix
+	}
+}
+
+func WithInvalidHostnameMode(mode InvalidHostnameMode) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.InvalidHostnameMode = mode
+	}
+}
+
+func WithUniqueHostnames(enabled bool, leaseNamespace string) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.EnableUniqueHostnames = enabled
+		cfg.HostnameLeaseNamespace = leaseNamespace
+	}
+}
+
+func WithPolicyMode(mode PolicyMode) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.PolicyMode = mode
+	}
+}
+
+func WithGMSAProfile(profile GMSAProfile) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.Profile = profile
+	}
+}
+
+func WithPodTemplatePaths(paths []PodTemplatePathConfig) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.PodTemplatePaths = paths
+	}
+}
+
+func WithCustomRules(rules []customRule) WebhookOption {
+	return func(cfg *WebhookConfig) {
+		cfg.CustomRules = rules
+	}
+}
+
 func newWebhook(client kubeClientInterface) *webhook {
 	return newWebhookWithOptions(client)
 }
@@ -251,11 +410,68 @@ func (webhook *webhook) httpRequestToAdmissionResponse(request *http.Request, op
 }
 
 // validateOrMutate is where the non-HTTP-related work happens.
-func (webhook *webhook) validateOrMutate(ctx context.Context, request *admissionV1.AdmissionRequest, operation webhookOperation) (*admissionV1.AdmissionResponse, *podAdmissionError) {
+// Warnings and audit annotations added to the context by any of the steps below get returned along with
+// the response, or recorded on the error denying the request, so that denials carry them too.
+func (webhook *webhook) validateOrMutate(ctx context.Context, request *admissionV1.AdmissionRequest, operation webhookOperation) (response *admissionV1.AdmissionResponse, admissionErr *podAdmissionError) {
+	ctx, warnings := withWarnings(ctx)
+	ctx, auditAnnotations := withAuditAnnotations(ctx)
+	defer func() {
+		if response == nil {
+			if admissionErr != nil {
+				admissionErr.warnings = append(admissionErr.warnings, warnings.list()...)
+				for key, value := range auditAnnotations.annotations() {
+					if admissionErr.auditAnnotations == nil {
+						admissionErr.auditAnnotations = make(map[string]string)
+					}
+					if _, present := admissionErr.auditAnnotations[key]; !present {
+						admissionErr.auditAnnotations[key] = value
+					}
+				}
+			}
+			return
+		}
+		response.Warnings = append(response.Warnings, warnings.list()...)
+		for key, value := range auditAnnotations.annotations() {
+			if response.AuditAnnotations == nil {
+				response.AuditAnnotations = make(map[string]string)
+			}
+			if _, present := response.AuditAnnotations[key]; !present {
+				response.AuditAnnotations[key] = value
+			}
+		}
+	}()
+
+	ctx = withDryRun(ctx, request.DryRun != nil && *request.DryRun)
+	ctx = withUserInfo(ctx, request.UserInfo)
+
 	if request.Kind.Kind != "Pod" {
+		// workload objects embedding a pod template only get validated, their pods get mutated when created
+		if operation == validate {
+			if templatePath, supported := webhook.podTemplatePath(request.Kind); supported {
+				return webhook.validateWorkloadRequest(ctx, request, templatePath)
+			}
+		}
 		return nil, &podAdmissionError{error: fmt.Errorf("expected a Pod object, got a %v", request.Kind.Kind), code: http.StatusBadRequest}
 	}
 
+	if request.Operation == admissionV1.Delete {
+		// deletions only come with the old object; we never deny them, only release the pod's hostname
+		if operation == validate {
+			oldPod, err := unmarshallPod(request.OldObject)
+			if err != nil {
+				return nil, err
+			}
+			options := &metav1.DeleteOptions{}
+			if len(request.Options.Raw) != 0 {
+				if err := json.Unmarshal(request.Options.Raw, options); err != nil {
+					logrus.Warnf("unable to unmarshall delete options %s: %v", request.Options.Raw, err)
+				}
+			}
+			webhook.releaseHostname(ctx, oldPod, request.Namespace, options)
+		}
+		return &admissionV1.AdmissionResponse{Allowed: true}, nil
+	}
+
 	pod, err := unmarshallPod(request.Object)
 	if err != nil {
 		return nil, err
@@ -267,23 +483,33 @@ func (webhook *webhook) validateOrMutate(ctx context.Context, request *admission
 		case validate:
 			return webhook.validateCreateRequest(ctx, pod, request.Namespace)
 		case mutate:
-			return webhook.mutateCreateRequest(ctx, pod)
+			return webhook.mutateCreateRequest(ctx, pod, request.Namespace)
 		default:
 			// shouldn't happen, but needed so that all paths in the function have a return value
 			panic(fmt.Errorf("unexpected webhook operation: %v", operation))
 		}
 
 	case admissionV1.Update:
-		if operation == validate {
+		switch operation {
+		case validate:
 			oldPod, err := unmarshallPod(request.OldObject)
 			if err != nil {
 				return nil, err
 			}
-			return validateUpdateRequest(pod, oldPod)
+			return webhook.validateUpdateRequest(ctx, pod, oldPod, request.Namespace)
+		case mutate:
+			// the only updates we mutate are ephemeral containers being attached to a running pod
+			if request.SubResource == ephemeralContainersSubResource {
+				oldPod, err := unmarshallPod(request.OldObject)
+				if err != nil {
+					return nil, err
+				}
+				return webhook.mutateEphemeralContainersUpdateRequest(ctx, pod, oldPod)
+			}
+			return &admissionV1.AdmissionResponse{Allowed: true}, nil
+		default:
+			panic(fmt.Errorf("unexpected webhook operation: %v", operation))
 		}
-
-		// we only do validation on updates, no mutation
-		return &admissionV1.AdmissionResponse{Allowed: true}, nil
 	default:
 		return nil, &podAdmissionError{error: fmt.Errorf("unpexpected operation %s", request.Operation), pod: pod, code: http.StatusBadRequest}
 	}
@@ -299,124 +525,351 @@ func unmarshallPod(object runtime.RawExtension) (*corev1.Pod, *podAdmissionError
 	return pod, nil
 }
 
-// validateCreateRequest ensures that the GMSA contents set in the pod's spec
-// match the corresponding GMSA names, and that the pod's service account
-// is authorized to `use` the requested GMSA's.
+// validateCreateRequest runs the checks from validatePodSpec on a pod being created. If cred spec metadata
+// is enabled, the pod's cred spec labels must also match the cred specs it uses, whatever its policy modes.
+// Only once the pod passes all of them does its hostname get reserved, if the hostname registry is enabled;
+// if it doesn't, the reservation that the mutating webhook made for its generated hostname gets released,
+// so that it doesn't block the pod's corrected retry.
 func (webhook *webhook) validateCreateRequest(ctx context.Context, pod *corev1.Pod, namespace string) (*admissionV1.AdmissionResponse, *podAdmissionError) {
-	if err := iterateOverWindowsSecurityOptions(pod, func(windowsOptions *corev1.WindowsSecurityContextOptions, resourceKind gmsaResourceKind, resourceName string, _ int) *podAdmissionError {
-		if credSpecName := windowsOptions.GMSACredentialSpecName; credSpecName != nil {
-			// let's check that the associated service account can read the relevant cred spec CRD
-			if authorized, reason := webhook.client.isAuthorizedToUseCredSpec(ctx, pod.Spec.ServiceAccountName, namespace, *credSpecName); !authorized {
-				msg := fmt.Sprintf("service account %q is not authorized to `use` GMSA cred spec %q", pod.Spec.ServiceAccountName, *credSpecName)
-				if reason != "" {
-					msg += fmt.Sprintf(", reason: %q", reason)
-				}
-				return &podAdmissionError{error: fmt.Errorf(msg), pod: pod, code: http.StatusForbidden}
-			}
+	if webhook.config.EnableCredSpecMetadata {
+		if err := checkCredSpecLabels(pod); err != nil {
+			webhook.releaseHostnameReservation(ctx, pod, namespace)
+			return nil, err
+		}
+	}
 
-			// and the contents should match the ones contained in the GMSA resource with that name
-			if credSpecContents := windowsOptions.GMSACredentialSpec; credSpecContents != nil {
-				if expectedContents, code, retrieveErr := webhook.client.retrieveCredSpecContents(ctx, *credSpecName); retrieveErr != nil {
-					return &podAdmissionError{error: retrieveErr, pod: pod, code: code}
-				} else if specsEqual, compareErr := compareCredSpecContents(*credSpecContents, expectedContents); !specsEqual || compareErr != nil {
-					msg := fmt.Sprintf("the GMSA cred spec contents for %s %q does not match the contents of GMSA resource %q", resourceKind, resourceName, *credSpecName)
-					if compareErr != nil {
-						msg += fmt.Sprintf(": %v", compareErr)
-					}
-					return &podAdmissionError{error: fmt.Errorf(msg), pod: pod, code: http.StatusUnprocessableEntity}
-				}
-			}
-		} else if windowsOptions.GMSACredentialSpec != nil {
-			// the GMSA's name is not set, but the contents are
-			msg := fmt.Sprintf("%s %q has a GMSA cred spec set, but does not define the name of the corresponding resource", resourceKind, resourceName)
-			return &podAdmissionError{error: fmt.Errorf(msg), pod: pod, code: http.StatusUnprocessableEntity}
+	response, err := webhook.validatePodSpec(ctx, pod, namespace)
+	if err != nil {
+		webhook.releaseHostnameReservation(ctx, pod, namespace)
+		return nil, err
+	}
+	if pod.Spec.Hostname != "" && hasGMSASettings(pod) {
+		// reserves explicit hostnames, and binds generated ones that the mutating webhook reserved before
+		// the pod had a name and UID
+		if err := webhook.reserveExplicitHostname(ctx, pod, namespace); err != nil {
+			return nil, err
 		}
+	}
+	return response, nil
+}
 
-		return nil
+// validatePodSpec ensures that the GMSA contents set in the pod's spec
+// match the corresponding GMSA names, that the pod's service account
+// is authorized to `use` the requested GMSA's, and allowed to by the GMSAPolicies
+// applying to them if enabled, that the pod doesn't declare it runs on Linux
+// and uses an allowed runtime class, and that its hostname, if it sets one, is
+// a valid NetBIOS name. Containers' images must also be allowed by their cred
+// specs, see allowedImagesAnnotation, and the pod must follow its GMSA profile.
+// GMSA's can't be used by HostProcess containers, nor by those running as
+// users that don't authenticate with them.
+// All violations get collected, then denied together, audited or returned as
+// warnings depending on the pod's policy modes.
+// It has no side effects, so that it can also check workloads' pod templates.
+func (webhook *webhook) validatePodSpec(ctx context.Context, pod *corev1.Pod, namespace string) (*admissionV1.AdmissionResponse, *podAdmissionError) {
+	// warnings about the settings themselves already got returned by the mutating webhook
+	settings, _, err := webhook.podSettings(ctx, pod, namespace)
+	if err != nil {
+		return nil, err
+	}
+	violations := &policyViolations{modes: settings.policyModes}
+	credSpecs := newCredSpecCache(webhook.client)
+
+	if err := iterateOverWindowsSecurityOptions(pod, func(windowsOptions *corev1.WindowsSecurityContextOptions, resourceKind gmsaResourceKind, resourceName string, containerIndex int) *podAdmissionError {
+		return webhook.validateWindowsOptions(ctx, pod, namespace, credSpecs, windowsOptions, resourceKind, resourceName, containerIndex, violations)
 	}); err != nil {
 		return nil, err
 	}
 
-	return &admissionV1.AdmissionResponse{Allowed: true}, nil
-}
+	if err := webhook.checkAllowedImages(ctx, pod, credSpecs, violations, nil); err != nil {
+		return nil, err
+	}
+	checkGMSAProfile(pod, settings.profile, violations, nil)
+	checkWindowsOptionsCompatibility(pod, violations, nil)
+	if err := webhook.checkCustomRules(ctx, pod, namespace, credSpecs, violations); err != nil {
+		return nil, err
+	}
 
-// compareCredSpecContents returns true iff the two strings represent the same credential spec contents.
-func compareCredSpecContents(fromResource, fromCRD string) (bool, error) {
-	// this is actually what happens almost all the time, when users don't set the GMSA contents directly
-	// but instead rely on the mutating webhook to do that for them; and in that case no need for a slow
-	// JSON parsing and comparison
-	if fromResource == fromCRD {
-		return true, nil
+	if pod.Spec.Hostname != "" && hasGMSASettings(pod) {
+		setAuditAnnotation(ctx, hostnameAuditAnnotation, pod.Spec.Hostname)
+		if !webhook.warnsOnInvalidHostnames() {
+			violations.check(invalidHostnameError(pod))
+		}
 	}
 
-	var (
-		jsonObjectFromResource map[string]interface{}
-		jsonObjectFromCRD      map[string]interface{}
-	)
+	return violations.admissionResponse()
+}
 
-	if err := json.Unmarshal([]byte(fromResource), &jsonObjectFromResource); err != nil {
-		return false, fmt.Errorf("unable to parse %q as a JSON object: %v", fromResource, err)
+// validateWindowsOptions runs the checks from validatePodSpec on a single pod or container's
+// `WindowsSecurityOptions`, recording every violation it finds. It only returns internal errors.
+// It also warns about deprecated cred specs, and about cred spec contents that only match once normalized.
+func (webhook *webhook) validateWindowsOptions(ctx context.Context, pod *corev1.Pod, namespace string, credSpecs *credSpecCache, windowsOptions *corev1.WindowsSecurityContextOptions, resourceKind gmsaResourceKind, resourceName string, containerIndex int, violations *policyViolations) *podAdmissionError {
+	windowsOptionsPath := resourceSpecPath(resourceKind, containerIndex) + "/securityContext/windowsOptions"
+	credSpecNameField := fieldPath(windowsOptionsPath + "/gmsaCredentialSpecName")
+	credSpecContentsField := fieldPath(windowsOptionsPath + "/gmsaCredentialSpec")
+
+	// GMSA's can only ever work on Windows
+	if pod.Spec.OS != nil && pod.Spec.OS.Name == corev1.Linux && (windowsOptions.GMSACredentialSpecName != nil || windowsOptions.GMSACredentialSpec != nil) {
+		msg := fmt.Sprintf("%s %q has GMSA settings, but its pod declares spec.os.name=%s; GMSA's are only supported on Windows", resourceKind, resourceName, corev1.Linux)
+		violations.check(&podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusUnprocessableEntity, reason: gmsaOnLinuxReason, field: "spec.os.name"})
 	}
-	if err := json.Unmarshal([]byte(fromCRD), &jsonObjectFromCRD); err != nil {
-		return false, fmt.Errorf("unable to parse CRD %q as a JSON object: %v", fromCRD, err)
+
+	if credSpecName := windowsOptions.GMSACredentialSpecName; credSpecName != nil {
+		auditCredSpecUse(ctx, resourceKind, resourceName, *credSpecName)
+
+		// the pod must run on node pools that can actually retrieve GMSA's
+		if !webhook.isAllowedRuntimeClass(pod) {
+			msg := fmt.Sprintf("%s %q uses GMSA cred spec %q, but its pod's runtime class %s is not one of the runtime classes allowed for GMSA's: %s",
+				resourceKind, resourceName, *credSpecName, runtimeClassDescription(pod), strings.Join(webhook.config.AllowedRuntimeClasses, ", "))
+			violations.check(&podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusForbidden, reason: runtimeClassNotAllowedReason, field: "spec.runtimeClassName"})
+		}
+
+		// let's check that the associated service account can read the relevant cred spec CRD
+		authorized, reason := webhook.client.isAuthorizedToUseCredSpec(ctx, pod.Spec.ServiceAccountName, namespace, *credSpecName)
+		auditAuthorization(ctx, pod.Spec.ServiceAccountName, *credSpecName, authorized)
+		if !authorized {
+			msg := fmt.Sprintf("service account %q is not authorized to `use` GMSA cred spec %q", pod.Spec.ServiceAccountName, *credSpecName)
+			if reason != "" {
+				msg += fmt.Sprintf(", reason: %q", reason)
+			}
+			violation := &podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusForbidden, reason: credSpecUseNotAuthorizedReason, field: credSpecNameField}
+			if violations.enforced() {
+				violation.hint = webhook.credSpecUseRemediation(ctx, pod.Spec.ServiceAccountName, namespace, *credSpecName)
+			}
+			violations.check(violation)
+		}
+
+		// on top of that, GMSAPolicies might restrict which pods may use that cred spec
+		if webhook.config.EnableGMSAPolicies {
+			if err := violations.check(webhook.checkGMSAPolicies(ctx, pod, namespace, credSpecs, resourceKind, resourceName, containerIndex, *credSpecName, credSpecNameField)); err != nil {
+				return err
+			}
+		}
+
+		// and the contents should match the ones contained in the GMSA resource with that name
+		if credSpecContents := windowsOptions.GMSACredentialSpec; credSpecContents != nil {
+			credSpec, code, retrieveErr := credSpecs.get(ctx, *credSpecName)
+			if retrieveErr != nil {
+				reason := credSpecInvalidReason
+				if code == http.StatusNotFound {
+					reason = credSpecNotFoundReason
+				}
+				return violations.check(&podAdmissionError{error: retrieveErr, pod: pod, code: code, reason: reason, field: credSpecNameField})
+			}
+			auditCredSpec(ctx, credSpec)
+
+			if warning := deprecatedCredSpecWarning(credSpec); warning != "" {
+				addWarnings(ctx, warning)
+			}
+
+			if difference, compareErr := compareCredSpecContents(*credSpecContents, credSpec.contents); difference != nil || compareErr != nil {
+				msg := fmt.Sprintf("the GMSA cred spec contents for %s %q does not match the contents of GMSA resource %q", resourceKind, resourceName, *credSpecName)
+				if compareErr != nil {
+					msg += fmt.Sprintf(": %v", compareErr)
+				} else {
+					msg += fmt.Sprintf(": %v", difference)
+				}
+				violations.check(&podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusUnprocessableEntity, reason: credSpecContentsMismatchReason, field: credSpecContentsField})
+			} else if *credSpecContents != credSpec.contents {
+				addWarnings(ctx, fmt.Sprintf("the GMSA cred spec contents for %s %q are not identical to the contents of GMSA resource %q, "+
+					"they only match once normalized; consider leaving them out so that they get set automatically", resourceKind, resourceName, *credSpecName))
+			}
+		}
+	} else if windowsOptions.GMSACredentialSpec != nil {
+		// the GMSA's name is not set, but the contents are
+		msg := fmt.Sprintf("%s %q has a GMSA cred spec set, but does not define the name of the corresponding resource", resourceKind, resourceName)
+		violations.check(&podAdmissionError{error: errors.New(msg), pod: pod, code: http.StatusUnprocessableEntity, reason: credSpecContentsWithoutNameReason, field: credSpecNameField})
 	}
 
-	return reflect.DeepEqual(jsonObjectFromResource, jsonObjectFromCRD), nil
+	return nil
 }
 
 // mutateCreateRequest inlines the requested GMSA's into the pod's and containers' `WindowsSecurityOptions` structs.
-func (webhook *webhook) mutateCreateRequest(ctx context.Context, pod *corev1.Pod) (*admissionV1.AdmissionResponse, *podAdmissionError) {
-	var patches []map[string]string
+// If enabled, it first translates legacy alpha GMSA annotations into the corresponding fields, then sets the
+// pod's GMSA name to the default one for its service account or namespace when the pod doesn't request any GMSA.
+// Pods using GMSA's also get their runtime class set and get steered towards Windows nodes, as configured, and
+// towards the nodes that their cred specs' node selectors require. Their hostnames, whether generated or set
+// explicitly, get reserved cluster-wide if the hostname registry is enabled; explicit hostnames that aren't valid
+// NetBIOS names get fixed if so configured. If repairing is enabled, pre-set cred spec contents that don't match
+// their GMSA resource's get replaced with them, instead of getting the pod denied at validation.
+// Random hostnames, default cred specs, setting the pod's OS and repairing cred spec contents can be overridden
+// per namespace and per pod, see podSettings.
+func (webhook *webhook) mutateCreateRequest(ctx context.Context, pod *corev1.Pod, namespace string) (*admissionV1.AdmissionResponse, *podAdmissionError) {
+	var patches []jsonPatchOperation
 	hasGMSA := false
+	inlined := make(map[string]bool)
+	credSpecs := newCredSpecCache(webhook.client)
+
+	settings, settingsWarnings, err := webhook.podSettings(ctx, pod, namespace)
+	if err != nil {
+		return nil, err
+	}
+	addWarnings(ctx, settingsWarnings...)
+
+	if webhook.config.EnableLegacyAnnotationsMigration {
+		legacyPatches, legacyWarnings := translateLegacyAnnotations(pod)
+		patches = append(patches, legacyPatches...)
+		addWarnings(ctx, legacyWarnings...)
+	}
+
+	if settings.defaultCredSpec {
+		defaultPatches, err := webhook.defaultCredSpecPatches(ctx, pod, namespace)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, defaultPatches...)
+	}
 
 	if err := iterateOverWindowsSecurityOptions(pod, func(windowsOptions *corev1.WindowsSecurityContextOptions, resourceKind gmsaResourceKind, resourceName string, containerIndex int) *podAdmissionError {
-		if credSpecName := windowsOptions.GMSACredentialSpecName; credSpecName != nil {
+		if windowsOptions.GMSACredentialSpecName != nil {
 			hasGMSA = true
-			// if the user has pre-set the GMSA's contents, we won't override it - it'll be down
-			// to the validation endpoint to make sure the contents actually are what they should
-			if credSpecContents := windowsOptions.GMSACredentialSpec; credSpecContents == nil {
-				contents, code, retrieveErr := webhook.client.retrieveCredSpecContents(ctx, *credSpecName)
-				if retrieveErr != nil {
-					return &podAdmissionError{error: retrieveErr, pod: pod, code: code}
-				}
-
-				partialPath := ""
-				if resourceKind == containerKind {
-					partialPath = fmt.Sprintf("/containers/%d", containerIndex)
-				}
+			auditCredSpecUse(ctx, resourceKind, resourceName, *windowsOptions.GMSACredentialSpecName)
+		}
 
-				// worth noting that this JSON patch is guaranteed to work since we know at this point
-				// that the resource comprises a `windowsOptions` object, and and that it doesn't have a
-				// "gmsaCredentialSpec" field
-				patches = append(patches, map[string]string{
-					"op":    "add",
-					"path":  fmt.Sprintf("/spec%s/securityContext/windowsOptions/gmsaCredentialSpec", partialPath),
-					"value": contents,
-				})
+		if settings.repairCredSpecContents {
+			patch, err := webhook.repairCredSpecContentsPatch(ctx, pod, credSpecs, windowsOptions, resourceKind, resourceName, containerIndex)
+			if err != nil {
+				return err
+			}
+			if patch != nil {
+				patches = append(patches, *patch)
+				inlined[*windowsOptions.GMSACredentialSpecName] = true
+				return nil
 			}
 		}
 
-		return nil
+		patch, err := webhook.inlineCredSpecContents(ctx, pod, credSpecs, windowsOptions, resourceKind, containerIndex)
+		if patch != nil {
+			patches = append(patches, *patch)
+			inlined[*windowsOptions.GMSACredentialSpecName] = true
+		}
+		return err
 	}); err != nil {
 		return nil, err
 	}
 
-	if hasGMSA && webhook.config.EnableRandomHostName {
-		// Pods are GMSA related, Env enabled, patch the hostname only if it is empty
-		hostName := pod.Spec.Hostname
-		if hostName == "" {
-			hostName = generateUUID()
-			patches = append(patches, map[string]string{
-				"op":    "add",
-				"path":  "/spec/hostname",
-				"value": hostName,
-			})
-		} else {
-			// Will honor the hostname set in the spec, print out a message
-			logrus.Warnf("hostname is set in spec and will be hornored instead of being randomized")
+	if webhook.config.EnableCredSpecMetadata {
+		labelPatches, labelWarnings := spoofedCredSpecLabelPatches(pod)
+		patches = append(patches, labelPatches...)
+		addWarnings(ctx, labelWarnings...)
+	}
+
+	if hasGMSA {
+		runtimeClassPatches, err := webhook.runtimeClassPatches(ctx, pod, namespace, credSpecs)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, runtimeClassPatches...)
+
+		nodeAffinityPatches, err := webhook.nodeAffinityPatches(ctx, pod, credSpecs)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, nodeAffinityPatches...)
+
+		patches = append(patches, webhook.schedulingPatches(pod, settings)...)
+
+		if webhook.config.EnableCredSpecMetadata {
+			metadataPatches, err := webhook.credSpecMetadataPatches(ctx, pod, credSpecs, inlined)
+			if err != nil {
+				return nil, err
+			}
+			patches = append(patches, metadataPatches...)
 		}
 	}
 
+	if hasGMSA && webhook.config.EnableUniqueHostnames {
+		patches = append(patches, hostnameReservationPatches(pod)...)
+	}
+
+	if hasGMSA && settings.randomHostname && pod.Spec.Hostname == "" {
+		// Pods are GMSA related, Env enabled, generate the hostname only if it is empty
+		patch, hostnameWarnings, err := webhook.hostnamePatch(ctx, pod, namespace, settings, credSpecs)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, *patch)
+		addWarnings(ctx, hostnameWarnings...)
+	} else if hasGMSA && pod.Spec.Hostname != "" {
+		if settings.randomHostname {
+			// Will honor the hostname set in the spec, let the user know
+			addWarnings(ctx, fmt.Sprintf("hostname %q is set explicitly and will be honored instead of being randomized", pod.Spec.Hostname))
+		}
+		patch, hostnameWarnings := webhook.explicitHostnamePatch(pod)
+		if patch != nil {
+			patches = append(patches, *patch)
+		}
+		addWarnings(ctx, hostnameWarnings...)
+		// explicit hostnames only get reserved once the pod has passed validation
+	}
+
+	if hasGMSA && pod.Spec.Hostname != "" {
+		setAuditAnnotation(ctx, hostnameAuditAnnotation, pod.Spec.Hostname)
+	}
+
+	return patchAdmissionResponse(pod, patches)
+}
+
+// mutateEphemeralContainersUpdateRequest inlines the requested GMSA's into the `WindowsSecurityOptions`
+// structs of ephemeral containers that are being attached to an existing pod.
+func (webhook *webhook) mutateEphemeralContainersUpdateRequest(ctx context.Context, pod, oldPod *corev1.Pod) (*admissionV1.AdmissionResponse, *podAdmissionError) {
+	var patches []jsonPatchOperation
+	credSpecs := newCredSpecCache(webhook.client)
+	oldEphemeralContainerNames := ephemeralContainerNames(oldPod)
+
+	if err := iterateOverWindowsSecurityOptions(pod, func(windowsOptions *corev1.WindowsSecurityContextOptions, resourceKind gmsaResourceKind, resourceName string, containerIndex int) *podAdmissionError {
+		if resourceKind != ephemeralContainerKind || oldEphemeralContainerNames[resourceName] {
+			return nil
+		}
+		if windowsOptions.GMSACredentialSpecName != nil {
+			auditCredSpecUse(ctx, resourceKind, resourceName, *windowsOptions.GMSACredentialSpecName)
+		}
+
+		patch, err := webhook.inlineCredSpecContents(ctx, pod, credSpecs, windowsOptions, resourceKind, containerIndex)
+		if patch != nil {
+			patches = append(patches, *patch)
+		}
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return patchAdmissionResponse(pod, patches)
+}
+
+// inlineCredSpecContents returns the JSON patch inlining the contents of the GMSA named in `windowsOptions`,
+// if any. If the user has pre-set the GMSA's contents, we won't override it - it'll be down to the validation
+// endpoint to make sure the contents actually are what they should, unless repairing is enabled (see
+// repairCredSpecContentsPatch); in that case, it returns nil.
+func (webhook *webhook) inlineCredSpecContents(ctx context.Context, pod *corev1.Pod, credSpecs *credSpecCache, windowsOptions *corev1.WindowsSecurityContextOptions, resourceKind gmsaResourceKind, containerIndex int) (*jsonPatchOperation, *podAdmissionError) {
+	if windowsOptions.GMSACredentialSpecName == nil || windowsOptions.GMSACredentialSpec != nil {
+		return nil, nil
+	}
+
+	credSpec, code, retrieveErr := credSpecs.get(ctx, *windowsOptions.GMSACredentialSpecName)
+	if retrieveErr != nil {
+		return nil, &podAdmissionError{error: retrieveErr, pod: pod, code: code}
+	}
+	auditCredSpec(ctx, credSpec)
+
+	// worth noting that this JSON patch is guaranteed to work since we know at this point
+	// that the resource comprises a `windowsOptions` object, and and that it doesn't have a
+	// "gmsaCredentialSpec" field
+	return &jsonPatchOperation{
+		Op:    "add",
+		Path:  fmt.Sprintf("%s/securityContext/windowsOptions/gmsaCredentialSpec", resourceSpecPath(resourceKind, containerIndex)),
+		Value: credSpec.contents,
+	}, nil
+}
+
+// jsonPatchOperation is a single operation of a JSON patch, see https://tools.ietf.org/html/rfc6902
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// patchAdmissionResponse builds an AdmissionResponse allowing the pod, and applying the given JSON patches if any.
+func patchAdmissionResponse(pod *corev1.Pod, patches []jsonPatchOperation) (*admissionV1.AdmissionResponse, *podAdmissionError) {
 	admissionResponse := &admissionV1.AdmissionResponse{Allowed: true}
 	if len(patches) != 0 {
 		patchesBytes, err := json.Marshal(patches)
@@ -432,11 +885,98 @@ func (webhook *webhook) mutateCreateRequest(ctx context.Context, pod *corev1.Pod
 	return admissionResponse, nil
 }
 
-// validateUpdateRequest ensures that there are no updates to any of the GMSA names or contents.
-func validateUpdateRequest(pod, oldPod *corev1.Pod) (*admissionV1.AdmissionResponse, *podAdmissionError) {
-	var oldPodContainerOptions map[string]*corev1.WindowsSecurityContextOptions
+// resourceSpecPath returns the JSON path to the spec of a pod (if `resourceKind` is `podKind`),
+// or to that of the container at index `containerIndex` in the relevant list of the pod's spec.
+func resourceSpecPath(resourceKind gmsaResourceKind, containerIndex int) string {
+	if resourceKind == podKind {
+		return "/spec"
+	}
+	return fmt.Sprintf("/spec/%s/%d", containerListFields[resourceKind], containerIndex)
+}
+
+// fieldPath turns a JSON patch path into the corresponding field path as displayed by the API server,
+// e.g. `/spec/containers/0/securityContext` into `spec.containers[0].securityContext`.
+func fieldPath(jsonPath string) string {
+	var builder strings.Builder
+	for _, segment := range strings.Split(strings.TrimPrefix(jsonPath, "/"), "/") {
+		if _, err := strconv.Atoi(segment); err == nil {
+			builder.WriteString("[" + segment + "]")
+			continue
+		}
+		if builder.Len() != 0 {
+			builder.WriteString(".")
+		}
+		builder.WriteString(segment)
+	}
+	return builder.String()
+}
+
+// ensureWindowsOptions returns the `WindowsSecurityOptions` of the pod (if `resourceKind` is `podKind`) or of
+// the container at index `containerIndex` in the relevant list of the pod's spec, along with the JSON patches
+// creating its `securityContext` and `windowsOptions` objects if they don't exist yet.
+// It also creates these objects on the pod itself, so that subsequent calls and iterations see them, and
+// so that callers can set fields on the returned struct to keep the pod in sync with their own patches.
+func ensureWindowsOptions(pod *corev1.Pod, resourceKind gmsaResourceKind, containerIndex int) (*corev1.WindowsSecurityContextOptions, []jsonPatchOperation) {
+	var (
+		patches        []jsonPatchOperation
+		windowsOptions **corev1.WindowsSecurityContextOptions
+	)
+	specPath := resourceSpecPath(resourceKind, containerIndex)
+
+	if resourceKind == podKind {
+		if pod.Spec.SecurityContext == nil {
+			pod.Spec.SecurityContext = &corev1.PodSecurityContext{}
+			patches = append(patches, jsonPatchOperation{Op: "add", Path: specPath + "/securityContext", Value: struct{}{}})
+		}
+		windowsOptions = &pod.Spec.SecurityContext.WindowsOptions
+	} else {
+		var securityContext **corev1.SecurityContext
+		switch resourceKind {
+		case containerKind:
+			securityContext = &pod.Spec.Containers[containerIndex].SecurityContext
+		case initContainerKind:
+			securityContext = &pod.Spec.InitContainers[containerIndex].SecurityContext
+		case ephemeralContainerKind:
+			securityContext = &pod.Spec.EphemeralContainers[containerIndex].SecurityContext
+		default:
+			panic(fmt.Errorf("unexpected resource kind: %v", resourceKind))
+		}
+
+		if *securityContext == nil {
+			*securityContext = &corev1.SecurityContext{}
+			patches = append(patches, jsonPatchOperation{Op: "add", Path: specPath + "/securityContext", Value: struct{}{}})
+		}
+		windowsOptions = &(*securityContext).WindowsOptions
+	}
+
+	if *windowsOptions == nil {
+		*windowsOptions = &corev1.WindowsSecurityContextOptions{}
+		patches = append(patches, jsonPatchOperation{Op: "add", Path: specPath + "/securityContext/windowsOptions", Value: struct{}{}})
+	}
+
+	return *windowsOptions, patches
+}
+
+// validateUpdateRequest ensures that there are no updates to any of the GMSA names or contents, nor to the
+// cred spec labels if cred spec metadata is enabled.
+// The only exception is ephemeral containers being attached to the pod, which get validated the
+// same way as containers are when creating a pod, images, GMSA profile and other Windows options included.
+func (webhook *webhook) validateUpdateRequest(ctx context.Context, pod, oldPod *corev1.Pod, namespace string) (*admissionV1.AdmissionResponse, *podAdmissionError) {
+	var oldPodContainerOptions map[gmsaResource]*corev1.WindowsSecurityContextOptions
+	oldEphemeralContainerNames := ephemeralContainerNames(oldPod)
+	// updates are never subject to the audit or warn policy modes
+	violations := &policyViolations{modes: map[PolicyMode]bool{EnforcePolicyMode: true}}
+	credSpecs := newCredSpecCache(webhook.client)
+
+	if webhook.config.EnableCredSpecMetadata {
+		violations.check(checkCredSpecLabelsUpdate(pod, oldPod))
+	}
+
+	if err := iterateOverWindowsSecurityOptions(pod, func(windowsOptions *corev1.WindowsSecurityContextOptions, resourceKind gmsaResourceKind, resourceName string, containerIndex int) *podAdmissionError {
+		if resourceKind == ephemeralContainerKind && !oldEphemeralContainerNames[resourceName] {
+			return webhook.validateWindowsOptions(ctx, pod, namespace, credSpecs, windowsOptions, resourceKind, resourceName, containerIndex, violations)
+		}
 
-	if err := iterateOverWindowsSecurityOptions(pod, func(windowsOptions *corev1.WindowsSecurityContextOptions, resourceKind gmsaResourceKind, resourceName string, _ int) *podAdmissionError {
 		var oldWindowsOptions *corev1.WindowsSecurityContextOptions
 		if resourceKind == podKind {
 			if oldPod.Spec.SecurityContext != nil {
@@ -444,18 +984,18 @@ func validateUpdateRequest(pod, oldPod *corev1.Pod) (*admissionV1.AdmissionRespo
 			}
 		} else {
 			// it's a container; look for the same container in the old pod,
-			// lazily building the map of container names to security options if needed
+			// lazily building the map of containers to security options if needed
 			if oldPodContainerOptions == nil {
-				oldPodContainerOptions = make(map[string]*corev1.WindowsSecurityContextOptions)
+				oldPodContainerOptions = make(map[gmsaResource]*corev1.WindowsSecurityContextOptions)
 				iterateOverWindowsSecurityOptions(oldPod, func(winOpts *corev1.WindowsSecurityContextOptions, rsrcKind gmsaResourceKind, rsrcName string, _ int) *podAdmissionError {
-					if rsrcKind == containerKind {
-						oldPodContainerOptions[rsrcName] = winOpts
+					if rsrcKind != podKind {
+						oldPodContainerOptions[gmsaResource{kind: rsrcKind, name: rsrcName}] = winOpts
 					}
 					return nil
 				})
 			}
 
-			oldWindowsOptions = oldPodContainerOptions[resourceName]
+			oldWindowsOptions = oldPodContainerOptions[gmsaResource{kind: resourceKind, name: resourceName}]
 		}
 
 		if oldWindowsOptions == nil {
@@ -472,7 +1012,8 @@ func validateUpdateRequest(pod, oldPod *corev1.Pod) (*admissionV1.AdmissionRespo
 
 		if len(modifiedFieldNames) != 0 {
 			msg := fmt.Errorf("cannot update an existing pod's GMSA settings (GMSA %s modified on %s %q)", strings.Join(modifiedFieldNames, " and "), resourceKind, resourceName)
-			return &podAdmissionError{error: msg, pod: pod, code: http.StatusForbidden}
+			field := fieldPath(resourceSpecPath(resourceKind, containerIndex) + "/securityContext/windowsOptions")
+			violations.check(&podAdmissionError{error: msg, pod: pod, code: http.StatusForbidden, reason: gmsaSettingsUpdatedReason, field: field})
 		}
 
 		return nil
@@ -480,7 +1021,57 @@ func validateUpdateRequest(pod, oldPod *corev1.Pod) (*admissionV1.AdmissionRespo
 		return nil, err
 	}
 
-	return &admissionV1.AdmissionResponse{Allowed: true}, nil
+	// new ephemeral containers can inherit the pod's GMSA
+	isExistingContainer := func(container podContainer) bool {
+		return container.kind != ephemeralContainerKind || oldEphemeralContainerNames[container.name]
+	}
+	if podCredSpecName := effectiveCredSpecName(pod, podContainer{}); podCredSpecName != "" && webhook.config.EnableGMSAPolicies {
+		// GMSAPolicies must allow them to use it too, e.g. with their images; those setting their own cred spec
+		// got checked above
+		field := fieldPath(resourceSpecPath(podKind, 0) + "/securityContext/windowsOptions/gmsaCredentialSpecName")
+		for _, container := range podContainers(pod) {
+			if isExistingContainer(container) || container.credSpecName() != "" {
+				continue
+			}
+			if err := violations.check(webhook.checkGMSAPolicies(ctx, pod, namespace, credSpecs, container.kind, container.name, container.index, podCredSpecName, field)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if webhook.config.EnableCredSpecMetadata {
+		violations.check(checkNewContainersCredSpecLabels(pod, isExistingContainer))
+	}
+	if err := webhook.checkAllowedImages(ctx, pod, credSpecs, violations, isExistingContainer); err != nil {
+		return nil, err
+	}
+	checkWindowsOptionsCompatibility(pod, violations, isExistingContainer)
+
+	if len(pod.Spec.EphemeralContainers) != len(oldEphemeralContainerNames) {
+		settings, _, err := webhook.podSettings(ctx, pod, namespace)
+		if err != nil {
+			return nil, err
+		}
+		checkGMSAProfile(pod, settings.profile, violations, func(resourceKind gmsaResourceKind, resourceName string) bool {
+			return resourceKind != ephemeralContainerKind || oldEphemeralContainerNames[resourceName]
+		})
+	}
+
+	return violations.admissionResponse()
+}
+
+// gmsaResource identifies a pod or one of its containers.
+type gmsaResource struct {
+	kind gmsaResourceKind
+	name string
+}
+
+// ephemeralContainerNames returns the set of the names of the pod's ephemeral containers.
+func ephemeralContainerNames(pod *corev1.Pod) map[string]bool {
+	names := make(map[string]bool, len(pod.Spec.EphemeralContainers))
+	for _, container := range pod.Spec.EphemeralContainers {
+		names[container.Name] = true
+	}
+	return names
 }
 
 func equalStringPointers(s1, s2 *string) bool {
@@ -494,10 +1085,12 @@ func equalStringPointers(s1, s2 *string) bool {
 }
 
 // iterateOverWindowsSecurityOptions calls `f` on the pod's `.Spec.SecurityContext.WindowsOptions` field,
-// as well as over each of its container's `.SecurityContext.WindowsOptions` field.
+// as well as over each of its containers', init containers' and ephemeral containers'
+// `.SecurityContext.WindowsOptions` field.
 // `f` can assume it only gets called with non-nil `WindowsSecurityOptions` pointers; the other
 // arguments give information on the resource owning that pointer - in particular, if that
-// resource is a container, `containerIndex` is the index of the container in the spec's list (-1 for pods).
+// resource is a container, `containerIndex` is the index of the container in the spec's relevant
+// list (-1 for pods).
 // If `f` returns an error, that breaks the loop, and the error is bubbled up.
 func iterateOverWindowsSecurityOptions(pod *corev1.Pod, f func(windowsOptions *corev1.WindowsSecurityContextOptions, resourceKind gmsaResourceKind, resourceName string, containerIndex int) *podAdmissionError) *podAdmissionError {
 	if pod.Spec.SecurityContext != nil && pod.Spec.SecurityContext.WindowsOptions != nil {
@@ -506,6 +1099,14 @@ func iterateOverWindowsSecurityOptions(pod *corev1.Pod, f func(windowsOptions *c
 		}
 	}
 
+	for i, container := range pod.Spec.InitContainers {
+		if container.SecurityContext != nil && container.SecurityContext.WindowsOptions != nil {
+			if err := f(container.SecurityContext.WindowsOptions, initContainerKind, container.Name, i); err != nil {
+				return err
+			}
+		}
+	}
+
 	for i, container := range pod.Spec.Containers {
 		if container.SecurityContext != nil && container.SecurityContext.WindowsOptions != nil {
 			if err := f(container.SecurityContext.WindowsOptions, containerKind, container.Name, i); err != nil {
@@ -514,6 +1115,14 @@ func iterateOverWindowsSecurityOptions(pod *corev1.Pod, f func(windowsOptions *c
 		}
 	}
 
+	for i, container := range pod.Spec.EphemeralContainers {
+		if container.SecurityContext != nil && container.SecurityContext.WindowsOptions != nil {
+			if err := f(container.SecurityContext.WindowsOptions, ephemeralContainerKind, container.Name, i); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -540,13 +1149,27 @@ func deniedAdmissionResponse(err error, httpCode ...int) *admissionV1.AdmissionR
 
 	logrus.Infof("%s: %v", logMsg, err)
 
-	return &admissionV1.AdmissionResponse{
+	response := &admissionV1.AdmissionResponse{
 		Allowed: false,
 		Result: &metav1.Status{
 			Message: err.Error(),
 			Code:    int32(code),
 		},
 	}
+
+	if admissionError, ok := err.(*podAdmissionError); ok {
+		// policy violations get reported as the status' causes, so that clients can tell each of them apart
+		if len(admissionError.causes) != 0 {
+			response.Result.Details = &metav1.StatusDetails{Kind: "pods", Causes: admissionError.causes}
+			if admissionError.pod != nil {
+				response.Result.Details.Name = admissionError.pod.Name
+			}
+		}
+		response.Warnings = admissionError.warnings
+		response.AuditAnnotations = admissionError.auditAnnotations
+	}
+
+	return response
 }
 
 // stolen from https://github.com/golang/go/blob/go1.12/src/net/http/server.go#L3255-L3271
@@ -563,11 +1186,3 @@ func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
 	tc.SetKeepAlivePeriod(3 * time.Minute)
 	return tc, nil
 }
-
-func generateUUID() string {
-	// Generate a new UUID
-	id := uuid.New()
-	// Convert to string and get the first 15 characters in lower case
-	shortUUID := strings.ToLower(id.String()[:15])
-	return shortUUID
-}
@@ -23,7 +23,7 @@ func TestValidateCreateRequest(t *testing.T) {
 		},
 	} {
 		t.Run(testCaseName, func(t *testing.T) {
-			webhook := newWebhook(nil)
+			webhook := newWebhook(&dummyKubeClient{})
 			pod := buildPod(dummyServiceAccoutName, winOptionsFactory(), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: winOptionsFactory()})
 
 			response, err := webhook.validateCreateRequest(context.Background(), pod, dummyNamespace)
@@ -93,7 +93,7 @@ func TestValidateCreateRequest(t *testing.T) {
 			assert.Nil(t, response)
 
 			assertPodAdmissionErrorContains(t, err, pod, http.StatusUnprocessableEntity,
-				"the GMSA cred spec contents for %s %q does not match the contents of GMSA resource %q",
+				"the GMSA cred spec contents for %s %q does not match the contents of GMSA resource %q: field We don't need no[0] differs",
 				resourceKind, resourceName, dummyCredSpecName)
 		},
 
@@ -186,10 +186,10 @@ func TestMutateCreateRequest(t *testing.T) {
 		},
 	} {
 		t.Run(testCaseName, func(t *testing.T) {
-			webhook := newWebhookWithOptions(nil, WithRandomHostname(false))
+			webhook := newWebhookWithOptions(&dummyKubeClient{}, WithRandomHostname(false))
 			pod := buildPod(dummyServiceAccoutName, winOptionsFactory(), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: winOptionsFactory()})
 
-			response, err := webhook.mutateCreateRequest(context.Background(), pod)
+			response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
 			assert.Nil(t, err)
 
 			require.NotNil(t, response)
@@ -209,10 +209,10 @@ func TestMutateCreateRequest(t *testing.T) {
 		},
 	} {
 		t.Run(testCaseName, func(t *testing.T) {
-			webhook := newWebhookWithOptions(nil, WithRandomHostname(true))
+			webhook := newWebhookWithOptions(&dummyKubeClient{}, WithRandomHostname(true))
 			pod := buildPod(dummyServiceAccoutName, winOptionsFactory(), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: winOptionsFactory()})
 
-			response, err := webhook.mutateCreateRequest(context.Background(), pod)
+			response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
 			assert.Nil(t, err)
 
 			require.NotNil(t, response)
@@ -229,10 +229,10 @@ func TestMutateCreateRequest(t *testing.T) {
 		return &corev1.WindowsSecurityContextOptions{GMSACredentialSpecName: &dummyCredSpecNameVar, GMSACredentialSpec: &dummyCredSpecContentsVar}
 	}
 	t.Run(testCaseName, func(t *testing.T) {
-		webhook := newWebhookWithOptions(nil, WithRandomHostname(true))
+		webhook := newWebhookWithOptions(&dummyKubeClient{}, WithRandomHostname(true))
 		pod := buildPod(dummyServiceAccoutName, winOptionsFactory1(), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: winOptionsFactory1()})
 
-		response, err := webhook.mutateCreateRequest(context.Background(), pod)
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
 		assert.Nil(t, err)
 
 		require.NotNil(t, response)
@@ -261,11 +261,11 @@ func TestMutateCreateRequest(t *testing.T) {
 		return &corev1.WindowsSecurityContextOptions{GMSACredentialSpecName: &dummyCredSpecNameVar, GMSACredentialSpec: &dummyCredSpecContentsVar}
 	}
 	t.Run(testCaseName, func(t *testing.T) {
-		webhook := newWebhookWithOptions(nil, WithRandomHostname(true))
+		webhook := newWebhookWithOptions(&dummyKubeClient{}, WithRandomHostname(true))
 		dummyPodNameVar := dummyPodName
 		pod := buildPodWithHostName(dummyServiceAccoutName, &dummyPodNameVar, winOptionsFactory1(), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: winOptionsFactory1()})
 
-		response, err := webhook.mutateCreateRequest(context.Background(), pod)
+		response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
 		assert.Nil(t, err)
 
 		require.NotNil(t, response)
@@ -297,7 +297,7 @@ func TestMutateCreateRequest(t *testing.T) {
 
 			setWindowsOptions(optionsSelector(pod), dummyCredSpecName, "")
 
-			response, err := webhook.mutateCreateRequest(context.Background(), pod)
+			response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
 			assert.Nil(t, err)
 
 			require.NotNil(t, response)
@@ -308,24 +308,36 @@ func TestMutateCreateRequest(t *testing.T) {
 			}
 
 			patchPath := func(kind gmsaResourceKind, name string) string {
-				partialPath := ""
-
-				if kind == containerKind {
-					containerIndex := -1
-					for i, container := range pod.Spec.Containers {
-						if container.Name == name {
+				containerIndex := -1
+
+				if kind != podKind {
+					var containerNames []string
+					switch kind {
+					case containerKind:
+						for _, container := range pod.Spec.Containers {
+							containerNames = append(containerNames, container.Name)
+						}
+					case initContainerKind:
+						for _, container := range pod.Spec.InitContainers {
+							containerNames = append(containerNames, container.Name)
+						}
+					case ephemeralContainerKind:
+						for _, container := range pod.Spec.EphemeralContainers {
+							containerNames = append(containerNames, container.Name)
+						}
+					}
+					for i, containerName := range containerNames {
+						if containerName == name {
 							containerIndex = i
 							break
 						}
 					}
 					if containerIndex == -1 {
-						t.Fatalf("Did not find any container named %q", name)
+						t.Fatalf("Did not find any %s named %q", kind, name)
 					}
-
-					partialPath = fmt.Sprintf("/containers/%d", containerIndex)
 				}
 
-				return fmt.Sprintf("/spec%s/securityContext/windowsOptions/gmsaCredentialSpec", partialPath)
+				return fmt.Sprintf("%s/securityContext/windowsOptions/gmsaCredentialSpec", resourceSpecPath(kind, containerIndex))
 			}
 
 			// maps the contents to the expected patch for that container
@@ -370,7 +382,7 @@ func TestMutateCreateRequest(t *testing.T) {
 
 			setWindowsOptions(optionsSelector(pod), dummyCredSpecName, `{"pre-set GMSA": "cred contents"}`)
 
-			response, err := webhook.mutateCreateRequest(context.Background(), pod)
+			response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
 			assert.Nil(t, err)
 
 			// all the patches we receive should be for the extra containers
@@ -407,7 +419,7 @@ func TestMutateCreateRequest(t *testing.T) {
 
 			setWindowsOptions(optionsSelector(pod), dummyCredSpecName, "")
 
-			response, err := webhook.mutateCreateRequest(context.Background(), pod)
+			response, err := webhook.mutateCreateRequest(context.Background(), pod, dummyNamespace)
 
 			assert.Nil(t, response)
 
@@ -429,7 +441,7 @@ func TestValidateUpdateRequest(t *testing.T) {
 			pod := buildPod(dummyServiceAccoutName, winOptionsFactory(), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: winOptionsFactory()})
 			oldPod := buildPod(dummyServiceAccoutName, winOptionsFactory(), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: winOptionsFactory()})
 
-			response, err := validateUpdateRequest(pod, oldPod)
+			response, err := newWebhook(nil).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
 			assert.Nil(t, err)
 
 			require.NotNil(t, response)
@@ -447,7 +459,7 @@ func TestValidateUpdateRequest(t *testing.T) {
 
 			oldPod := pod.DeepCopy()
 
-			response, err := validateUpdateRequest(pod, oldPod)
+			response, err := newWebhook(nil).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
 			assert.Nil(t, err)
 
 			require.NotNil(t, response)
@@ -460,7 +472,7 @@ func TestValidateUpdateRequest(t *testing.T) {
 			oldPod := pod.DeepCopy()
 			setWindowsOptions(optionsSelector(oldPod), dummyCredSpecName, "")
 
-			response, err := validateUpdateRequest(pod, oldPod)
+			response, err := newWebhook(nil).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
 			assert.Nil(t, response)
 
 			assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden,
@@ -474,7 +486,7 @@ func TestValidateUpdateRequest(t *testing.T) {
 			oldPod := pod.DeepCopy()
 			setWindowsOptions(optionsSelector(oldPod), "", dummyCredSpecContents)
 
-			response, err := validateUpdateRequest(pod, oldPod)
+			response, err := newWebhook(nil).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
 			assert.Nil(t, response)
 
 			assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden,
@@ -488,7 +500,7 @@ func TestValidateUpdateRequest(t *testing.T) {
 			oldPod := pod.DeepCopy()
 			setWindowsOptions(optionsSelector(oldPod), dummyCredSpecName, dummyCredSpecContents)
 
-			response, err := validateUpdateRequest(pod, oldPod)
+			response, err := newWebhook(nil).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
 			assert.Nil(t, response)
 
 			assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden,
@@ -498,6 +510,93 @@ func TestValidateUpdateRequest(t *testing.T) {
 	})
 }
 
+func TestValidateUpdateRequestWithNewEphemeralContainer(t *testing.T) {
+	buildPods := func(credSpecName, credSpecContents string) (*corev1.Pod, *corev1.Pod) {
+		oldPod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+		pod := oldPod.DeepCopy()
+		pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{buildEphemeralContainer(dummyEphemeralContainerName, buildWindowsOptions(credSpecName, credSpecContents))}
+		return pod, oldPod
+	}
+
+	t.Run("if the service account is authorized to use the cred spec, it passes", func(t *testing.T) {
+		pod, oldPod := buildPods("debug-cred-spec", "")
+
+		client := &dummyKubeClient{
+			isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string) {
+				assert.Equal(t, dummyServiceAccoutName, serviceAccountName)
+				assert.Equal(t, dummyNamespace, namespace)
+				assert.Equal(t, "debug-cred-spec", credSpecName)
+				return true, ""
+			},
+		}
+
+		response, err := newWebhook(client).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
+		assert.Nil(t, err)
+
+		require.NotNil(t, response)
+		assert.True(t, response.Allowed)
+	})
+
+	t.Run("if the service account is not authorized to use the cred spec, it fails", func(t *testing.T) {
+		pod, oldPod := buildPods("debug-cred-spec", "")
+
+		client := &dummyKubeClient{
+			isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string) {
+				return false, ""
+			},
+		}
+
+		response, err := newWebhook(client).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
+		assert.Nil(t, response)
+
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusForbidden,
+			"service account %q is not authorized to `use` GMSA cred spec %q", dummyServiceAccoutName, "debug-cred-spec")
+	})
+
+	t.Run("if the cred spec contents do not match, it fails", func(t *testing.T) {
+		pod, oldPod := buildPods(dummyCredSpecName, `{"pre-set GMSA": "cred contents"}`)
+
+		response, err := newWebhook(&dummyKubeClient{}).validateUpdateRequest(context.Background(), pod, oldPod, dummyNamespace)
+		assert.Nil(t, response)
+
+		assertPodAdmissionErrorContains(t, err, pod, http.StatusUnprocessableEntity,
+			"the GMSA cred spec contents for %s %q does not match the contents of GMSA resource %q",
+			ephemeralContainerKind, dummyEphemeralContainerName, dummyCredSpecName)
+	})
+}
+
+func TestMutateEphemeralContainersUpdateRequest(t *testing.T) {
+	oldPod := buildPod(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, dummyCredSpecContents), map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+	oldPod.Spec.EphemeralContainers = []corev1.EphemeralContainer{buildEphemeralContainer("existing-debugger", buildWindowsOptions("existing-cred-spec", ""))}
+
+	pod := oldPod.DeepCopy()
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, buildEphemeralContainer(dummyEphemeralContainerName, buildWindowsOptions(dummyCredSpecName, "")))
+
+	client := &dummyKubeClient{
+		retrieveCredSpecContentsFunc: func(ctx context.Context, credSpecName string) (contents string, httpCode int, err error) {
+			assert.Equal(t, dummyCredSpecName, credSpecName)
+			contents = dummyCredSpecContents
+			return
+		},
+	}
+
+	response, err := newWebhook(client).mutateEphemeralContainersUpdateRequest(context.Background(), pod, oldPod)
+	assert.Nil(t, err)
+
+	require.NotNil(t, response)
+	assert.True(t, response.Allowed)
+
+	var patches []map[string]string
+	if err := json.Unmarshal(response.Patch, &patches); assert.Nil(t, err) && assert.Equal(t, 1, len(patches)) {
+		expectedPatch := map[string]string{
+			"op":    "add",
+			"path":  "/spec/ephemeralContainers/1/securityContext/windowsOptions/gmsaCredentialSpec",
+			"value": dummyCredSpecContents,
+		}
+		assert.Equal(t, expectedPatch, patches[0])
+	}
+}
+
 func TestDefaultWebhookConfig(t *testing.T) {
 	expectedCertReload := false
 	webhook := newWebhookWithOptions(nil, WithCertReload(expectedCertReload))
@@ -597,7 +696,7 @@ func runWebhookValidateOrMutateTests(t *testing.T, winOptionsFactory containerWi
 			testNameSuffix = fmt.Sprintf(" and %d extra containers", extraContainersCount)
 		}
 
-		for _, resourceKind := range []gmsaResourceKind{podKind, containerKind} {
+		for _, resourceKind := range []gmsaResourceKind{podKind, containerKind, initContainerKind, ephemeralContainerKind} {
 			for testName, testFunc := range tests {
 				podWindowsOptions := &corev1.WindowsSecurityContextOptions{}
 				containerNamesAndWindowsOptions[dummyContainerName] = &corev1.WindowsSecurityContextOptions{}
@@ -631,6 +730,29 @@ func runWebhookValidateOrMutateTests(t *testing.T, winOptionsFactory containerWi
 					}
 
 					resourceName = dummyContainerName
+				case initContainerKind:
+					pod.Spec.InitContainers = []corev1.Container{{
+						Name:            dummyInitContainerName,
+						SecurityContext: &corev1.SecurityContext{WindowsOptions: &corev1.WindowsSecurityContextOptions{}},
+					}}
+					optionsSelector = func(pod *corev1.Pod) *corev1.WindowsSecurityContextOptions {
+						if pod != nil && len(pod.Spec.InitContainers) != 0 && pod.Spec.InitContainers[0].SecurityContext != nil {
+							return pod.Spec.InitContainers[0].SecurityContext.WindowsOptions
+						}
+						return nil
+					}
+
+					resourceName = dummyInitContainerName
+				case ephemeralContainerKind:
+					pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{buildEphemeralContainer(dummyEphemeralContainerName, &corev1.WindowsSecurityContextOptions{})}
+					optionsSelector = func(pod *corev1.Pod) *corev1.WindowsSecurityContextOptions {
+						if pod != nil && len(pod.Spec.EphemeralContainers) != 0 && pod.Spec.EphemeralContainers[0].SecurityContext != nil {
+							return pod.Spec.EphemeralContainers[0].SecurityContext.WindowsOptions
+						}
+						return nil
+					}
+
+					resourceName = dummyEphemeralContainerName
 				default:
 					t.Fatalf("Unknown resource kind: %q", resourceKind)
 				}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	admissionV1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultServiceAccountName is the service account that pods get when they don't specify one.
+const defaultServiceAccountName = "default"
+
+// builtinPodTemplatePaths maps the built-in workload kinds to the path to the pod template
+// embedded in their objects.
+var builtinPodTemplatePaths = map[schema.GroupKind][]string{
+	{Group: "apps", Kind: "Deployment"}:  {"spec", "template"},
+	{Group: "apps", Kind: "StatefulSet"}: {"spec", "template"},
+	{Group: "apps", Kind: "DaemonSet"}:   {"spec", "template"},
+	{Group: "apps", Kind: "ReplicaSet"}:  {"spec", "template"},
+	{Group: "batch", Kind: "Job"}:        {"spec", "template"},
+	{Group: "batch", Kind: "CronJob"}:    {"spec", "jobTemplate", "spec", "template"},
+}
+
+// PodTemplatePathConfig tells the webhook where to find the pod template embedded in objects
+// of a given kind, typically a CRD-based workload.
+type PodTemplatePathConfig struct {
+	Group string `json:"group"`
+	// Version can be left empty to match all versions of the kind.
+	Version string `json:"version,omitempty"`
+	Kind    string `json:"kind"`
+	// Path is the dot-separated path to the pod template in the object, e.g. `spec.template`.
+	Path string `json:"path"`
+}
+
+// matches returns true iff this config applies to objects of the given kind.
+func (config PodTemplatePathConfig) matches(kind metav1.GroupVersionKind) bool {
+	return config.Group == kind.Group && config.Kind == kind.Kind && (config.Version == "" || config.Version == kind.Version)
+}
+
+// pathSegments splits the config's path into its fields.
+func (config PodTemplatePathConfig) pathSegments() []string {
+	return strings.Split(strings.TrimPrefix(config.Path, "."), ".")
+}
+
+// loadPodTemplatePaths reads a list of PodTemplatePathConfig's from a YAML or JSON file.
+func loadPodTemplatePaths(filePath string) ([]PodTemplatePathConfig, error) {
+	contents, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pod template paths config file %s: %v", filePath, err)
+	}
+
+	var configs []PodTemplatePathConfig
+	if err := yaml.UnmarshalStrict(contents, &configs); err != nil {
+		return nil, fmt.Errorf("unable to parse pod template paths config file %s: %v", filePath, err)
+	}
+
+	for i, config := range configs {
+		if config.Kind == "" || strings.Trim(config.Path, ".") == "" {
+			return nil, fmt.Errorf("entry #%d in pod template paths config file %s must define both a kind and a path", i, filePath)
+		}
+		for _, segment := range config.pathSegments() {
+			if segment == "" {
+				return nil, fmt.Errorf("entry #%d in pod template paths config file %s has an invalid path %q", i, filePath, config.Path)
+			}
+		}
+	}
+
+	return configs, nil
+}
+
+// podTemplatePath returns the path to the pod template embedded in objects of the given kind,
+// and whether that's a kind we know how to handle. Kinds configured with WithPodTemplatePaths
+// take precedence over the built-in ones.
+func (webhook *webhook) podTemplatePath(kind metav1.GroupVersionKind) ([]string, bool) {
+	for _, config := range webhook.config.PodTemplatePaths {
+		if config.matches(kind) {
+			return config.pathSegments(), true
+		}
+	}
+
+	path, present := builtinPodTemplatePaths[schema.GroupKind{Group: kind.Group, Kind: kind.Kind}]
+	return path, present
+}
+
+// validateWorkloadRequest runs the same checks as validatePodSpec against the pod template
+// embedded in a workload object, so that users get denied when creating or updating the workload,
+// rather than it only failing later when its controller tries to create pods.
+func (webhook *webhook) validateWorkloadRequest(ctx context.Context, request *admissionV1.AdmissionRequest, templatePath []string) (*admissionV1.AdmissionResponse, *podAdmissionError) {
+	if request.Operation != admissionV1.Create && request.Operation != admissionV1.Update {
+		return &admissionV1.AdmissionResponse{Allowed: true}, nil
+	}
+
+	workloadName, template, err := extractPodTemplate(request.Object, templatePath)
+	if err != nil {
+		return nil, err
+	}
+	if template == nil {
+		logrus.Warnf("no pod template found at path %v in %s %q", templatePath, request.Kind.Kind, workloadName)
+		return &admissionV1.AdmissionResponse{Allowed: true}, nil
+	}
+
+	if request.Operation == admissionV1.Update {
+		// no need to re-validate if the pod template hasn't changed, e.g. when just scaling a workload
+		_, oldTemplate, err := extractPodTemplate(request.OldObject, templatePath)
+		if err != nil {
+			return nil, err
+		}
+		if apiequality.Semantic.DeepEqual(template, oldTemplate) {
+			return &admissionV1.AdmissionResponse{Allowed: true}, nil
+		}
+	}
+
+	pod := podFromTemplate(template, workloadName, request.Namespace)
+
+	response, admissionErr := webhook.validatePodSpec(ctx, pod, request.Namespace)
+	if admissionErr != nil {
+		admissionErr.error = fmt.Errorf("%s %q: %v", request.Kind.Kind, workloadName, admissionErr.error)
+		// causes' field paths are relative to the pod, make them relative to the workload
+		fieldPrefix := strings.Join(templatePath, ".") + "."
+		for i := range admissionErr.causes {
+			admissionErr.causes[i].Field = fieldPrefix + admissionErr.causes[i].Field
+		}
+		if admissionErr.field != "" {
+			admissionErr.field = fieldPrefix + admissionErr.field
+		}
+	}
+	return response, admissionErr
+}
+
+// extractPodTemplate unmarshalls the pod template found at `templatePath` in a workload object from its
+// raw JSON representation. It also returns the workload's name.
+// If there is no pod template at that path, it returns a nil template.
+func extractPodTemplate(object runtime.RawExtension, templatePath []string) (string, *corev1.PodTemplateSpec, *podAdmissionError) {
+	var workload map[string]interface{}
+	if err := json.Unmarshal(object.Raw, &workload); err != nil {
+		return "", nil, &podAdmissionError{error: fmt.Errorf("unable to unmarshall workload JSON object: %v", err), code: http.StatusBadRequest}
+	}
+
+	workloadName, _, _ := unstructured.NestedString(workload, "metadata", "name")
+
+	rawTemplate, found, err := unstructured.NestedMap(workload, templatePath...)
+	if err != nil {
+		return workloadName, nil, &podAdmissionError{error: fmt.Errorf("unable to read the pod template of %q: %v", workloadName, err), code: http.StatusBadRequest}
+	}
+	if !found {
+		return workloadName, nil, nil
+	}
+
+	template := &corev1.PodTemplateSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(rawTemplate, template); err != nil {
+		return workloadName, nil, &podAdmissionError{error: fmt.Errorf("unable to unmarshall the pod template of %q: %v", workloadName, err), code: http.StatusBadRequest}
+	}
+
+	return workloadName, template, nil
+}
+
+// podFromTemplate builds the pod that a workload's controller would create from its pod template,
+// at least as far as GMSA settings are concerned.
+func podFromTemplate(template *corev1.PodTemplateSpec, workloadName, namespace string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: *template.ObjectMeta.DeepCopy(),
+		Spec:       *template.Spec.DeepCopy(),
+	}
+
+	if pod.Name == "" {
+		pod.Name = workloadName
+	}
+	pod.Namespace = namespace
+
+	// mimic the service account admission plugin, which runs before webhooks for actual pods
+	if pod.Spec.ServiceAccountName == "" {
+		pod.Spec.ServiceAccountName = pod.Spec.DeprecatedServiceAccount
+	}
+	if pod.Spec.ServiceAccountName == "" {
+		pod.Spec.ServiceAccountName = defaultServiceAccountName
+	}
+
+	return pod
+}
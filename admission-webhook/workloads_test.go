@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionV1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const dummyWorkloadName = "dummy-workload-name"
+
+func TestValidateWorkloadRequest(t *testing.T) {
+	one := int32(1)
+
+	for kind, workloadFactory := range map[string]func(template corev1.PodTemplateSpec) (metav1.GroupVersionKind, interface{}){
+		"Deployment": func(template corev1.PodTemplateSpec) (metav1.GroupVersionKind, interface{}) {
+			return metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+				&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: dummyWorkloadName}, Spec: appsv1.DeploymentSpec{Replicas: &one, Template: template}}
+		},
+		"StatefulSet": func(template corev1.PodTemplateSpec) (metav1.GroupVersionKind, interface{}) {
+			return metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+				&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: dummyWorkloadName}, Spec: appsv1.StatefulSetSpec{Replicas: &one, Template: template}}
+		},
+		"DaemonSet": func(template corev1.PodTemplateSpec) (metav1.GroupVersionKind, interface{}) {
+			return metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+				&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: dummyWorkloadName}, Spec: appsv1.DaemonSetSpec{Template: template}}
+		},
+		"ReplicaSet": func(template corev1.PodTemplateSpec) (metav1.GroupVersionKind, interface{}) {
+			return metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+				&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: dummyWorkloadName}, Spec: appsv1.ReplicaSetSpec{Replicas: &one, Template: template}}
+		},
+		"Job": func(template corev1.PodTemplateSpec) (metav1.GroupVersionKind, interface{}) {
+			return metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+				&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: dummyWorkloadName}, Spec: batchv1.JobSpec{Completions: &one, Template: template}}
+		},
+		"CronJob": func(template corev1.PodTemplateSpec) (metav1.GroupVersionKind, interface{}) {
+			return metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"},
+				&batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: dummyWorkloadName}, Spec: batchv1.CronJobSpec{
+					Schedule:    "* * * * *",
+					JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}},
+				}}
+		},
+	} {
+		buildRequest := func(t *testing.T, operation admissionV1.Operation, template corev1.PodTemplateSpec, oldTemplate *corev1.PodTemplateSpec) *admissionV1.AdmissionRequest {
+			gvk, workload := workloadFactory(template)
+			request := &admissionV1.AdmissionRequest{
+				Kind:      gvk,
+				Namespace: dummyNamespace,
+				Operation: operation,
+				Object:    rawExtension(t, workload),
+			}
+			if oldTemplate != nil {
+				_, oldWorkload := workloadFactory(*oldTemplate)
+				request.OldObject = rawExtension(t, oldWorkload)
+			}
+			return request
+		}
+
+		t.Run(fmt.Sprintf("with a %s whose service account is authorized to use the cred spec, it passes", kind), func(t *testing.T) {
+			client := &dummyKubeClient{
+				isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string) {
+					assert.Equal(t, dummyServiceAccoutName, serviceAccountName)
+					assert.Equal(t, dummyNamespace, namespace)
+					assert.Equal(t, dummyCredSpecName, credSpecName)
+					return true, ""
+				},
+			}
+
+			template := buildPodTemplate(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""))
+			response, err := newWebhook(client).validateOrMutate(context.Background(), buildRequest(t, admissionV1.Create, template, nil), validate)
+			assert.Nil(t, err)
+
+			require.NotNil(t, response)
+			assert.True(t, response.Allowed)
+
+			// pod templates don't get labelled with their cred specs, only their pods do
+			response, err = newWebhookWithOptions(client, WithCredSpecMetadata(true)).validateOrMutate(context.Background(), buildRequest(t, admissionV1.Create, template, nil), validate)
+			assert.Nil(t, err)
+			require.NotNil(t, response)
+			assert.True(t, response.Allowed)
+		})
+
+		t.Run(fmt.Sprintf("with a %s whose service account is not authorized to use the cred spec, it fails", kind), func(t *testing.T) {
+			client := &dummyKubeClient{
+				isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string) {
+					return false, ""
+				},
+			}
+
+			template := buildPodTemplate(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""))
+			response, err := newWebhook(client).validateOrMutate(context.Background(), buildRequest(t, admissionV1.Create, template, nil), validate)
+			assert.Nil(t, response)
+
+			if assert.NotNil(t, err) {
+				assert.Equal(t, http.StatusForbidden, err.code)
+				assert.Contains(t, err.Error(), fmt.Sprintf("%s %q: service account %q is not authorized to `use` GMSA cred spec %q", kind, dummyWorkloadName, dummyServiceAccoutName, dummyCredSpecName))
+				if assert.Equal(t, 1, len(err.causes)) {
+					assert.True(t, strings.HasSuffix(err.causes[0].Field, ".template.spec.securityContext.windowsOptions.gmsaCredentialSpecName"), err.causes[0].Field)
+				}
+			}
+		})
+
+		t.Run(fmt.Sprintf("with a %s whose pod template has mismatching contents, it fails", kind), func(t *testing.T) {
+			template := buildPodTemplate(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, `{"pre-set GMSA": "cred contents"}`))
+			response, err := newWebhook(&dummyKubeClient{}).validateOrMutate(context.Background(), buildRequest(t, admissionV1.Create, template, nil), validate)
+			assert.Nil(t, response)
+
+			if assert.NotNil(t, err) {
+				assert.Equal(t, http.StatusUnprocessableEntity, err.code)
+				assert.Contains(t, err.Error(), fmt.Sprintf("does not match the contents of GMSA resource %q", dummyCredSpecName))
+			}
+		})
+
+		t.Run(fmt.Sprintf("with a %s that doesn't set a service account, it checks the default one", kind), func(t *testing.T) {
+			checked := false
+			client := &dummyKubeClient{
+				isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string) {
+					checked = true
+					assert.Equal(t, defaultServiceAccountName, serviceAccountName)
+					return true, ""
+				},
+			}
+
+			template := buildPodTemplate("", buildWindowsOptions(dummyCredSpecName, ""))
+			response, err := newWebhook(client).validateOrMutate(context.Background(), buildRequest(t, admissionV1.Create, template, nil), validate)
+			assert.Nil(t, err)
+
+			require.NotNil(t, response)
+			assert.True(t, response.Allowed)
+			assert.True(t, checked)
+		})
+
+		t.Run(fmt.Sprintf("when updating a %s without changing its pod template, it passes without checking authorizations", kind), func(t *testing.T) {
+			client := &dummyKubeClient{
+				isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string) {
+					t.Errorf("should not have checked authorizations")
+					return false, ""
+				},
+			}
+
+			template := buildPodTemplate(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""))
+			response, err := newWebhook(client).validateOrMutate(context.Background(), buildRequest(t, admissionV1.Update, template, &template), validate)
+			assert.Nil(t, err)
+
+			require.NotNil(t, response)
+			assert.True(t, response.Allowed)
+		})
+
+		t.Run(fmt.Sprintf("when updating a %s's pod template to use an unauthorized cred spec, it fails", kind), func(t *testing.T) {
+			client := &dummyKubeClient{
+				isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string) {
+					return credSpecName != "new-cred-spec", ""
+				},
+			}
+
+			oldTemplate := buildPodTemplate(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""))
+			template := buildPodTemplate(dummyServiceAccoutName, buildWindowsOptions("new-cred-spec", ""))
+			response, err := newWebhook(client).validateOrMutate(context.Background(), buildRequest(t, admissionV1.Update, template, &oldTemplate), validate)
+			assert.Nil(t, response)
+
+			if assert.NotNil(t, err) {
+				assert.Equal(t, http.StatusForbidden, err.code)
+			}
+		})
+
+		t.Run(fmt.Sprintf("with a %s whose pod template sets a hostname, it doesn't reserve it", kind), func(t *testing.T) {
+			client := &dummyKubeClient{}
+			template := buildPodTemplate(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""))
+			template.Spec.Hostname = "my-host"
+
+			webhook := newWebhookWithOptions(client, WithUniqueHostnames(true, dummyLeaseNamespace))
+			response, err := webhook.validateOrMutate(context.Background(), buildRequest(t, admissionV1.Create, template, nil), validate)
+			assert.Nil(t, err)
+			require.NotNil(t, response)
+			assert.True(t, response.Allowed)
+			assert.Equal(t, 0, len(client.leases))
+		})
+
+		t.Run(fmt.Sprintf("with a %s sent to the mutating endpoint, it fails", kind), func(t *testing.T) {
+			template := buildPodTemplate(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""))
+			response, err := newWebhook(&dummyKubeClient{}).validateOrMutate(context.Background(), buildRequest(t, admissionV1.Create, template, nil), mutate)
+			assert.Nil(t, response)
+
+			if assert.NotNil(t, err) {
+				assert.Equal(t, http.StatusBadRequest, err.code)
+				assert.Equal(t, fmt.Sprintf("expected a Pod object, got a %s", kind), err.Error())
+			}
+		})
+	}
+}
+
+func buildPodTemplate(serviceAccountName string, podWindowsOptions *corev1.WindowsSecurityContextOptions) corev1.PodTemplateSpec {
+	pod := buildPod(serviceAccountName, podWindowsOptions, map[string]*corev1.WindowsSecurityContextOptions{dummyContainerName: nil})
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": dummyWorkloadName}},
+		Spec:       pod.Spec,
+	}
+}
+
+func rawExtension(t *testing.T, object interface{}) runtime.RawExtension {
+	raw, err := json.Marshal(object)
+	require.Nil(t, err)
+	return runtime.RawExtension{Raw: raw}
+}
+
+func TestValidateCustomWorkloadRequest(t *testing.T) {
+	rolloutKind := metav1.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}
+	template := buildPodTemplate(dummyServiceAccoutName, buildWindowsOptions(dummyCredSpecName, ""))
+	rollout := map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata":   map[string]interface{}{"name": dummyWorkloadName},
+		"spec":       map[string]interface{}{"template": template},
+	}
+
+	request := &admissionV1.AdmissionRequest{
+		Kind:      rolloutKind,
+		Namespace: dummyNamespace,
+		Operation: admissionV1.Create,
+		Object:    rawExtension(t, rollout),
+	}
+
+	client := &dummyKubeClient{
+		isAuthorizedToUseCredSpecFunc: func(ctx context.Context, serviceAccountName, namespace, credSpecName string) (authorized bool, reason string) {
+			return false, ""
+		},
+	}
+
+	t.Run("if the kind is not configured, it fails", func(t *testing.T) {
+		response, err := newWebhook(client).validateOrMutate(context.Background(), request, validate)
+		assert.Nil(t, response)
+
+		if assert.NotNil(t, err) {
+			assert.Equal(t, http.StatusBadRequest, err.code)
+			assert.Equal(t, "expected a Pod object, got a Rollout", err.Error())
+		}
+	})
+
+	for _, testCase := range []struct {
+		name   string
+		config PodTemplatePathConfig
+	}{
+		{
+			name:   "for all versions",
+			config: PodTemplatePathConfig{Group: "argoproj.io", Kind: "Rollout", Path: "spec.template"},
+		},
+		{
+			name:   "for that specific version, with a leading dot",
+			config: PodTemplatePathConfig{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout", Path: ".spec.template"},
+		},
+	} {
+		t.Run(fmt.Sprintf("if the kind is configured %s, its pod template gets validated", testCase.name), func(t *testing.T) {
+			webhook := newWebhookWithOptions(client, WithPodTemplatePaths([]PodTemplatePathConfig{testCase.config}))
+
+			response, err := webhook.validateOrMutate(context.Background(), request, validate)
+			assert.Nil(t, response)
+
+			if assert.NotNil(t, err) {
+				assert.Equal(t, http.StatusForbidden, err.code)
+				assert.Contains(t, err.Error(), fmt.Sprintf("Rollout %q: service account %q is not authorized to `use` GMSA cred spec %q", dummyWorkloadName, dummyServiceAccoutName, dummyCredSpecName))
+			}
+		})
+	}
+
+	t.Run("if the kind is configured for another version, it fails", func(t *testing.T) {
+		webhook := newWebhookWithOptions(client, WithPodTemplatePaths([]PodTemplatePathConfig{{Group: "argoproj.io", Version: "v1", Kind: "Rollout", Path: "spec.template"}}))
+
+		response, err := webhook.validateOrMutate(context.Background(), request, validate)
+		assert.Nil(t, response)
+
+		if assert.NotNil(t, err) {
+			assert.Equal(t, http.StatusBadRequest, err.code)
+		}
+	})
+}
+
+func TestLoadPodTemplatePaths(t *testing.T) {
+	writeConfig := func(t *testing.T, contents string) string {
+		filePath := path.Join(t.TempDir(), "pod-template-paths.yml")
+		require.Nil(t, os.WriteFile(filePath, []byte(contents), 0644))
+		return filePath
+	}
+
+	t.Run("with a valid config, it parses it", func(t *testing.T) {
+		configs, err := loadPodTemplatePaths(writeConfig(t, `
+- group: argoproj.io
+  version: v1alpha1
+  kind: Rollout
+  path: spec.template
+- group: apps.kruise.io
+  kind: CloneSet
+  path: .spec.template
+`))
+		require.Nil(t, err)
+
+		assert.Equal(t, []PodTemplatePathConfig{
+			{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout", Path: "spec.template"},
+			{Group: "apps.kruise.io", Kind: "CloneSet", Path: ".spec.template"},
+		}, configs)
+		assert.Equal(t, []string{"spec", "template"}, configs[1].pathSegments())
+	})
+
+	for testName, contents := range map[string]string{
+		"with an unknown field":  "- group: argoproj.io\n  kind: Rollout\n  path: spec.template\n  pth: spec.template",
+		"without a kind":         "- group: argoproj.io\n  path: spec.template",
+		"without a path":         "- group: argoproj.io\n  kind: Rollout",
+		"with an invalid path":   "- group: argoproj.io\n  kind: Rollout\n  path: spec..template",
+		"with an invalid format": "group: argoproj.io",
+	} {
+		t.Run(testName+", it fails", func(t *testing.T) {
+			_, err := loadPodTemplatePaths(writeConfig(t, contents))
+			assert.NotNil(t, err)
+		})
+	}
+
+	t.Run("with a non-existing file, it fails", func(t *testing.T) {
+		_, err := loadPodTemplatePaths(path.Join(t.TempDir(), "i-dont-exist.yml"))
+		assert.NotNil(t, err)
+	})
+}